@@ -59,6 +59,17 @@ func (self *HttpServer) ListenAndServe() {
 	self.Serve(self.conn)
 }
 
+/*
+* Close stops accepting api requests.
+ */
+func (self *HttpServer) Close() {
+	if self.conn != nil {
+		log.Info("Closing http server")
+		self.conn.Close()
+		self.conn = nil
+	}
+}
+
 func (self *HttpServer) registerEndpoint(method string, pattern string, f libhttp.HandlerFunc) {
 	version, _ := config.GetString("version")
 	switch method {
@@ -81,6 +92,18 @@ func (self *HttpServer) Serve(listener net.Listener) {
 	// with each batch of points we get back
 	self.registerEndpoint("get", "/index", self.query)
 
+	// inspect the ip pools, reserve and release addresses by hand
+	self.registerIpamEndpoints()
+
+	// stream the container and knife logs
+	self.registerLogEndpoints()
+
+	// the docker hosts the scheduler places containers on
+	self.registerHostEndpoints()
+
+	// check a compose file before it is put on an assembly
+	self.registerComposeEndpoints()
+
 	self.serveListener(listener, self.p)
 }
 
@@ -0,0 +1,49 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package http
+
+import (
+	"io/ioutil"
+	libhttp "net/http"
+
+	"github.com/megamsys/megamd/compose"
+)
+
+// the largest compose file validated.
+const maxComposeSize = 1 << 20
+
+/*
+* registers the compose endpoints.
+*
+*   POST /compose/validate?domain=megam.co   the report of the compose file in the body
+ */
+func (self *HttpServer) registerComposeEndpoints() {
+	self.registerEndpoint("post", "/compose/validate", self.validateCompose)
+}
+
+func (self *HttpServer) validateCompose(w libhttp.ResponseWriter, r *libhttp.Request) {
+	data, err := ioutil.ReadAll(libhttp.MaxBytesReader(w, r.Body, maxComposeSize))
+	if err != nil {
+		libhttp.Error(w, err.Error(), libhttp.StatusBadRequest)
+		return
+	}
+	_, report := compose.Translate(string(data), r.URL.Query().Get("domain"))
+	status := libhttp.StatusOK
+	if !report.Valid() {
+		status = 422
+	}
+	writeJson(w, r, status, report)
+}
@@ -0,0 +1,42 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package http
+
+import (
+	libhttp "net/http"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/provisioner/docker"
+)
+
+/*
+* registers the docker host endpoints.
+*
+*   GET /docker/hosts   every host with the cpus and memory placed on it
+ */
+func (self *HttpServer) registerHostEndpoints() {
+	self.registerEndpoint("get", "/docker/hosts", self.listHosts)
+}
+
+func (self *HttpServer) listHosts(w libhttp.ResponseWriter, r *libhttp.Request) {
+	hosts, err := docker.ListHostUsage()
+	if err != nil {
+		log.Error("Failed to list the docker hosts : %s", err)
+		libhttp.Error(w, err.Error(), libhttp.StatusInternalServerError)
+		return
+	}
+	writeJson(w, r, libhttp.StatusOK, hosts)
+}
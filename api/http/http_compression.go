@@ -78,6 +78,14 @@ func (self *CompressedResponseWriter) WriteHeader(responseCode int) {
 	self.responseWriter.WriteHeader(responseCode)
 }
 
+// CloseNotify tells when the client went away, never if the writer can't.
+func (self *CompressedResponseWriter) CloseNotify() <-chan bool {
+	if n, ok := self.responseWriter.(libhttp.CloseNotifier); ok {
+		return n.CloseNotify()
+	}
+	return make(chan bool)
+}
+
 func CompressionHandler(enableCompression bool, handler libhttp.HandlerFunc) libhttp.HandlerFunc {
 	if !enableCompression {
 		return handler
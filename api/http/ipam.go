@@ -0,0 +1,131 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package http
+
+import (
+	"encoding/json"
+	"net"
+	libhttp "net/http"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/ipam"
+)
+
+type reservation struct {
+	IP    string `json:"ip"`
+	Owner string `json:"owner"`
+}
+
+/*
+* registers the ip pool endpoints.
+*
+*   GET  /ipam/pools                         every pool with its utilization
+*   GET  /ipam/pools/:pool                   the pool and its allocations
+*   POST /ipam/pools/:pool/reservations      reserve {"ip": "", "owner": ""}
+*   DEL  /ipam/pools/:pool/reservations/:ip  release the address, ?force=true
+*                                            when a container holds it
+ */
+func (self *HttpServer) registerIpamEndpoints() {
+	self.registerEndpoint("get", "/ipam/pools", self.listPools)
+	self.registerEndpoint("get", "/ipam/pools/:pool", self.showPool)
+	self.registerEndpoint("post", "/ipam/pools/:pool/reservations", self.reserveIP)
+	self.registerEndpoint("del", "/ipam/pools/:pool/reservations/:ip", self.releaseIP)
+}
+
+func (self *HttpServer) listPools(w libhttp.ResponseWriter, r *libhttp.Request) {
+	pools, err := ipam.ListUsage()
+	if err != nil {
+		writeIpamError(w, err)
+		return
+	}
+	writeJson(w, r, libhttp.StatusOK, pools)
+}
+
+func (self *HttpServer) showPool(w libhttp.ResponseWriter, r *libhttp.Request) {
+	usage, err := ipam.GetUsage(r.URL.Query().Get(":pool"))
+	if err != nil {
+		writeIpamError(w, err)
+		return
+	}
+	writeJson(w, r, libhttp.StatusOK, usage)
+}
+
+func (self *HttpServer) reserveIP(w libhttp.ResponseWriter, r *libhttp.Request) {
+	res := &reservation{}
+	if err := json.NewDecoder(r.Body).Decode(res); err != nil {
+		libhttp.Error(w, "the reservation must be {\"ip\": \"\", \"owner\": \"\"}", libhttp.StatusBadRequest)
+		return
+	}
+	ip := net.ParseIP(res.IP)
+	if ip == nil {
+		libhttp.Error(w, res.IP+" is not an ip address", libhttp.StatusBadRequest)
+		return
+	}
+	if res.Owner == "" {
+		res.Owner = "reserved"
+	}
+	// an owner holds one address per pool, keep manual reservations apart.
+	owner := res.Owner + ":" + ip.String()
+
+	if err := ipam.Reserve(r.URL.Query().Get(":pool"), ip, owner); err != nil {
+		writeIpamError(w, err)
+		return
+	}
+	writeJson(w, r, libhttp.StatusCreated, &reservation{IP: ip.String(), Owner: owner})
+}
+
+func (self *HttpServer) releaseIP(w libhttp.ResponseWriter, r *libhttp.Request) {
+	ip := net.ParseIP(r.URL.Query().Get(":ip"))
+	if ip == nil {
+		libhttp.Error(w, r.URL.Query().Get(":ip")+" is not an ip address", libhttp.StatusBadRequest)
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+	if err := ipam.ReleaseIP(r.URL.Query().Get(":pool"), ip, force); err != nil {
+		writeIpamError(w, err)
+		return
+	}
+	w.WriteHeader(libhttp.StatusNoContent)
+}
+
+func writeIpamError(w libhttp.ResponseWriter, err error) {
+	status := libhttp.StatusBadRequest
+	switch err.(type) {
+	case *ipam.NotConfiguredError:
+		status = libhttp.StatusNotFound
+	case *ipam.InUseError, *ipam.ExhaustedError, *ipam.HeldError:
+		status = libhttp.StatusConflict
+	}
+	log.Error("ipam request failed : %s", err)
+	libhttp.Error(w, err.Error(), status)
+}
+
+func writeJson(w libhttp.ResponseWriter, r *libhttp.Request, status int, data interface{}) {
+	var body []byte
+	var err error
+	if isPretty(r) {
+		body, err = json.MarshalIndent(data, "", "  ")
+	} else {
+		body, err = json.Marshal(data)
+	}
+	if err != nil {
+		libhttp.Error(w, err.Error(), libhttp.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,362 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	libhttp "net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/app"
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/provisioner/docker"
+	"github.com/tsuru/config"
+)
+
+// how often a followed knife log is read again.
+const followInterval = 500 * time.Millisecond
+
+var errStreamClosed = errors.New("the log stream is closed")
+
+/*
+* registers the log endpoints. Lines are flushed as they come, as server
+* sent events when the client accepts text/event-stream, plain text
+* otherwise.
+*
+*   GET /logs/components/:id   the docker logs of the component container
+*   GET /logs/apps/:app        the knife output of the app (name.domain)
+*
+* follow=true keeps streaming, tail=<n|all> starts at the last n lines,
+* since=<unix time|duration> skips older docker logs. stream picks stdout
+* or stderr of a component, out (default) or err of an app.
+ */
+func (self *HttpServer) registerLogEndpoints() {
+	self.registerEndpoint("get", "/logs/components/:id", self.componentLogs)
+	self.registerEndpoint("get", "/logs/apps/:app", self.appLogs)
+}
+
+func (self *HttpServer) componentLogs(w libhttp.ResponseWriter, r *libhttp.Request) {
+	opts, err := logOptions(r)
+	if err != nil {
+		libhttp.Error(w, err.Error(), libhttp.StatusBadRequest)
+		return
+	}
+	switch r.URL.Query().Get("stream") {
+	case "":
+	case "stdout":
+		opts.Stdout = true
+	case "stderr":
+		opts.Stderr = true
+	default:
+		libhttp.Error(w, "stream is stdout or stderr", libhttp.StatusBadRequest)
+		return
+	}
+
+	com := &global.Component{}
+	com, err = com.Get(r.URL.Query().Get(":id"))
+	if err != nil {
+		libhttp.Error(w, err.Error(), libhttp.StatusNotFound)
+		return
+	}
+
+	stream := newLogStream(w, r)
+	gone := closeNotify(w)
+	// closed once the request is over, the docker client then stops.
+	closed := make(chan struct{})
+	defer close(closed)
+	done := make(chan error, 1)
+	go func() {
+		stdout, stderr := stream.writer("stdout"), stream.writer("stderr")
+		err := docker.ComponentLogs(com, opts, stdout, stderr, closed)
+		stdout.flush()
+		stderr.flush()
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			log.Error("Failed to read the logs of %s : %s", com.Name, err)
+			stream.fail(err)
+		}
+	case <-gone:
+	}
+	stream.close()
+}
+
+func (self *HttpServer) appLogs(w libhttp.ResponseWriter, r *libhttp.Request) {
+	opts, err := logOptions(r)
+	if err != nil {
+		libhttp.Error(w, err.Error(), libhttp.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get(":app")
+	kind := r.URL.Query().Get("stream")
+	if kind == "" {
+		kind = "out"
+	}
+	if kind != "out" && kind != "err" {
+		libhttp.Error(w, "stream is out or err", libhttp.StatusBadRequest)
+		return
+	}
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		libhttp.Error(w, name+" is not an app", libhttp.StatusBadRequest)
+		return
+	}
+
+	megam_home, _ := config.GetString("megam_home")
+	f, err := os.Open(app.LogPath(megam_home, name, kind))
+	if err != nil {
+		libhttp.Error(w, "app "+name+" has no "+kind+" log", libhttp.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	stream := newLogStream(w, r)
+	if err := followFile(f, opts, stream.writer(kind), closeNotify(w)); err != nil && err != errStreamClosed {
+		log.Error("Failed to read the logs of %s : %s", name, err)
+		stream.fail(err)
+	}
+	stream.close()
+}
+
+/*
+* logOptions parses follow, tail and since.
+ */
+func logOptions(r *libhttp.Request) (docker.LogOptions, error) {
+	q := r.URL.Query()
+	opts := docker.LogOptions{Follow: q.Get("follow") == "true" || q.Get("follow") == "1", Tail: q.Get("tail")}
+	if opts.Tail != "" && opts.Tail != "all" {
+		if n, err := strconv.Atoi(opts.Tail); err != nil || n < 0 {
+			return opts, fmt.Errorf("tail is a number of lines or all, not %s", opts.Tail)
+		}
+	}
+	if since := q.Get("since"); since != "" {
+		if secs, err := strconv.ParseInt(since, 10, 64); err == nil {
+			opts.Since = secs
+		} else if d, err := time.ParseDuration(since); err == nil && d > 0 {
+			opts.Since = time.Now().Add(-d).Unix()
+		} else {
+			return opts, fmt.Errorf("since is a unix time or a duration, not %s", since)
+		}
+	}
+	return opts, nil
+}
+
+/*
+* closeNotify tells when the client went away, never when the writer
+* can't tell.
+ */
+func closeNotify(w libhttp.ResponseWriter) <-chan bool {
+	if n, ok := w.(libhttp.CloseNotifier); ok {
+		return n.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+/*
+* followFile writes the file from the tail asked for, then what is
+* appended to it while following, until the client is gone.
+ */
+func followFile(f *os.File, opts docker.LogOptions, out *lineWriter, gone <-chan bool) error {
+	if opts.Tail != "" && opts.Tail != "all" {
+		n, _ := strconv.Atoi(opts.Tail)
+		offset, err := tailOffset(f, n)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(offset, os.SEEK_SET); err != nil {
+			return err
+		}
+	}
+	for {
+		if _, err := io.Copy(out, f); err != nil {
+			return err
+		}
+		if !opts.Follow {
+			return out.flush()
+		}
+		select {
+		case <-gone:
+			return nil
+		case <-time.After(followInterval):
+		}
+		// a truncated file is read again from its start.
+		pos, _ := f.Seek(0, os.SEEK_CUR)
+		if fi, err := f.Stat(); err == nil && fi.Size() < pos {
+			f.Seek(0, os.SEEK_SET)
+		}
+	}
+}
+
+/*
+* tailOffset is where the last n lines of the file start, read backwards
+* so a long log isn't read whole.
+ */
+func tailOffset(f *os.File, n int) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := fi.Size()
+	if n == 0 {
+		return end, nil
+	}
+	buf := make([]byte, 4096)
+	lines := 0
+	for pos := end; pos > 0; {
+		size := int64(len(buf))
+		if pos < size {
+			size = pos
+		}
+		pos -= size
+		if _, err := f.ReadAt(buf[:size], pos); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := size - 1; i >= 0; i-- {
+			// the newline ending the last line doesn't start one.
+			if buf[i] != '\n' || pos+i == end-1 {
+				continue
+			}
+			if lines++; lines == n {
+				return pos + i + 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+/*
+* logStream writes the log lines to the client, flushing every one. It
+* is shared by the stdout and stderr writers, and refuses lines once the
+* request is over.
+ */
+type logStream struct {
+	mu      sync.Mutex
+	w       libhttp.ResponseWriter
+	sse     bool
+	started bool
+	closed  bool
+}
+
+func newLogStream(w libhttp.ResponseWriter, r *libhttp.Request) *logStream {
+	return &logStream{w: w, sse: strings.Contains(r.Header.Get("Accept"), "text/event-stream")}
+}
+
+func (s *logStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	if s.sse {
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		s.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	s.w.WriteHeader(libhttp.StatusOK)
+}
+
+func (s *logStream) line(event string, line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStreamClosed
+	}
+	s.start()
+	var err error
+	if s.sse {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, line)
+	} else {
+		if _, err = s.w.Write(line); err == nil {
+			_, err = s.w.Write([]byte("\n"))
+		}
+	}
+	if f, ok := s.w.(libhttp.Flusher); ok {
+		f.Flush()
+	}
+	return err
+}
+
+/*
+* fail reports an error, as the response when nothing was streamed yet.
+ */
+func (s *logStream) fail(err error) {
+	s.mu.Lock()
+	if !s.started {
+		s.started, s.closed = true, true
+		s.mu.Unlock()
+		libhttp.Error(s.w, err.Error(), libhttp.StatusInternalServerError)
+		return
+	}
+	s.mu.Unlock()
+	if s.sse {
+		s.line("error", []byte(err.Error()))
+	}
+}
+
+func (s *logStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start()
+	s.closed = true
+}
+
+func (s *logStream) writer(event string) *lineWriter {
+	return &lineWriter{stream: s, event: event}
+}
+
+/*
+* lineWriter cuts what is written in lines, the last one is held until
+* it ends or the writer is flushed.
+ */
+type lineWriter struct {
+	stream  *logStream
+	event   string
+	partial []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.partial = append(lw.partial, p...)
+	for {
+		i := bytes.IndexByte(lw.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := bytes.TrimSuffix(lw.partial[:i], []byte("\r"))
+		if err := lw.stream.line(lw.event, line); err != nil {
+			return 0, err
+		}
+		lw.partial = lw.partial[i+1:]
+	}
+}
+
+func (lw *lineWriter) flush() error {
+	if len(lw.partial) == 0 {
+		return nil
+	}
+	line := lw.partial
+	lw.partial = nil
+	return lw.stream.line(lw.event, line)
+}
@@ -0,0 +1,99 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package http
+
+import (
+	"io/ioutil"
+	libhttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func knifeLog(c *check.C, app string, content string) {
+	home := c.MkDir() + "/"
+	config.Set("megam_home", home)
+	dir := filepath.Join(home, "logs", app)
+	c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, app+"_out"), []byte(content), 0644), check.IsNil)
+}
+
+func get(url string, accept string) *httptest.ResponseRecorder {
+	server := NewHttpServer()
+	server.registerLogEndpoints()
+	r, _ := libhttp.NewRequest("GET", url, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	server.p.ServeHTTP(w, r)
+	return w
+}
+
+func (s *S) TestAppLogsTail(c *check.C) {
+	knifeLog(c, "web.megam.co", "one\ntwo\r\nthree\nfour")
+
+	w := get("/logs/apps/web.megam.co?tail=2", "")
+	c.Assert(w.Code, check.Equals, libhttp.StatusOK)
+	c.Assert(w.Body.String(), check.Equals, "three\nfour\n")
+
+	w = get("/logs/apps/web.megam.co", "")
+	c.Assert(w.Body.String(), check.Equals, "one\ntwo\nthree\nfour\n")
+
+	w = get("/logs/apps/web.megam.co?tail=0", "")
+	c.Assert(w.Body.String(), check.Equals, "")
+}
+
+func (s *S) TestAppLogsEvents(c *check.C) {
+	knifeLog(c, "web.megam.co", "one\ntwo\n")
+
+	w := get("/logs/apps/web.megam.co?tail=1", "text/event-stream")
+	c.Assert(w.Header().Get("Content-Type"), check.Equals, "text/event-stream")
+	c.Assert(w.Body.String(), check.Equals, "event: out\ndata: two\n\n")
+}
+
+func (s *S) TestAppLogsInvalid(c *check.C) {
+	knifeLog(c, "web.megam.co", "one\n")
+
+	c.Assert(get("/logs/apps/web.megam.co?stream=err", "").Code, check.Equals, libhttp.StatusNotFound)
+	c.Assert(get("/logs/apps/web.megam.co?stream=all", "").Code, check.Equals, libhttp.StatusBadRequest)
+	c.Assert(get("/logs/apps/web.megam.co?tail=-1", "").Code, check.Equals, libhttp.StatusBadRequest)
+	c.Assert(get("/logs/apps/..", "").Code, check.Equals, libhttp.StatusBadRequest)
+}
+
+func (s *S) TestLogOptionsSince(c *check.C) {
+	r, _ := libhttp.NewRequest("GET", "/logs/components/COM1?since=1450000000&follow=true", nil)
+	opts, err := logOptions(r)
+	c.Assert(err, check.IsNil)
+	c.Assert(opts.Since, check.Equals, int64(1450000000))
+	c.Assert(opts.Follow, check.Equals, true)
+
+	r, _ = libhttp.NewRequest("GET", "/logs/components/COM1?since=yesterday", nil)
+	_, err = logOptions(r)
+	c.Assert(err, check.ErrorMatches, "since is a unix time or a duration, not yesterday")
+}
@@ -22,20 +22,39 @@ import (
 	log "code.google.com/p/log4go"
 	"strings"
 	"github.com/tsuru/config"
+	"io/ioutil"
 	"os"
 	"path"
 	"bufio"
-	"github.com/megamsys/libgo/db"
 	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/provisioner"
 )
 
 
+/*
+* LogPath is the file the knife command of the app (name.domain) writes
+* its stdout (out) or stderr (err) to.
+*/
+func LogPath(megam_home string, appName string, stream string) string {
+	return path.Join(megam_home + "logs", appName, appName + "_" + stream)
+}
+
 func CommandExecutor(app *global.AssemblyWithComponents) (action.Result, error) {
     var e exec.OsExecutor
     var commandWords []string
     appName := ""
     commandWords = strings.Fields(app.Command)
-    log.Debug("Command Executor entry: %s\n", app)
+    log.Debug("Command Executor entry: %s\n", app.Name)
+    // the attributes hold the secrets of the components, their file
+    // lives only as long as the command.
+    if len(app.Attributes) > 0 {
+        file, aerr := writeAttributes(app.Attributes)
+        if aerr != nil {
+            return nil, aerr
+        }
+        defer os.Remove(file)
+        commandWords = append(commandWords, "--json-attributes", "@"+file)
+    }
     megam_home, ckberr := config.GetString("megam_home")
 	if ckberr != nil {
 		return nil, ckberr
@@ -47,11 +66,10 @@ func CommandExecutor(app *global.AssemblyWithComponents) (action.Result, error)
 		
 	appName = app.Name + "." + pair.Value
 	
-	basePath := megam_home + "logs" 
-	dir := path.Join(basePath, appName)
+	dir := path.Join(megam_home + "logs", appName)
 	
-	fileOutPath := path.Join(dir, appName + "_out" )
-	fileErrPath := path.Join(dir, appName + "_err" )
+	fileOutPath := LogPath(megam_home, appName, "out")
+	fileErrPath := LogPath(megam_home, appName, "err")
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		log.Info("Creating directory: %s\n", dir)
 		if errm := os.MkdirAll(dir, 0777); errm != nil {
@@ -73,8 +91,7 @@ func CommandExecutor(app *global.AssemblyWithComponents) (action.Result, error)
   
 	foutwriter := bufio.NewWriterSize(fout, 1)
 	ferrwriter := bufio.NewWriterSize(ferr, 1)
-    log.Debug(commandWords)
-    log.Debug("Length: %s", len(commandWords))
+    log.Debug("Length: %d", len(commandWords))
     
     defer ferrwriter.Flush()
     defer foutwriter.Flush()
@@ -89,6 +106,27 @@ func CommandExecutor(app *global.AssemblyWithComponents) (action.Result, error)
   return &app, nil
 }
 
+/*
+* writeAttributes writes the json attributes of the knife command to a
+* file only megamd can read, the secrets stay off the command line.
+*/
+func writeAttributes(attributes []byte) (string, error) {
+	f, err := ioutil.TempFile("", "megamd-attributes")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := f.Chmod(0600); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if _, err := f.Write(attributes); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
 
 var launchedApp = action.Action{
 	Name: "launchedapp",
@@ -122,33 +160,14 @@ var updateStatus = action.Action{
 		default:
 			return nil, errors.New("First parameter must be App or *global.AssemblyWithComponents.")
 		}
-		asm := &global.Assembly{}
-	    conn, err := db.Conn("assembly")
-	     if err != nil {	
-		    return nil, err
-	      }	
+		_, ferr := global.UpdateAssembly(app.Id, func(asm *global.Assembly) error {
+			asm.Status = "Terminated"
+			return nil
+		})
+		if ferr != nil {
+			return nil, ferr
+		}
 
-	    ferr := conn.FetchStruct(app.Id, asm)
-	    if ferr != nil {	
-		   return nil, ferr
-	     }	
-	
-	   update := global.Assembly{
-		Id:            asm.Id, 
-        JsonClaz:      asm.JsonClaz, 
-        Name:          asm.Name,         
-        Components:    asm.Components,
-        ToscaType:     asm.ToscaType,
-        Requirements:  asm.Requirements,
-        Policies:      asm.Policies,
-        Inputs:        asm.Inputs,
-        Operations:    asm.Operations,
-        Outputs:       asm.Outputs,
-        Status:        "Terminated",
-        CreatedAt:     asm.CreatedAt,
-	   }
-	   err = conn.StoreStruct(app.Id, &update)		
-		
 		return CommandExecutor(&app)
 	},
 	Backward: func(ctx action.BWContext) {
@@ -160,3 +179,112 @@ var updateStatus = action.Action{
 
 
 
+
+func assemblyParam(params []interface{}) (*global.AssemblyWithComponents, error) {
+	switch params[0].(type) {
+	case global.AssemblyWithComponents:
+		app := params[0].(global.AssemblyWithComponents)
+		return &app, nil
+	case *global.AssemblyWithComponents:
+		return params[0].(*global.AssemblyWithComponents), nil
+	}
+	return nil, errors.New("First parameter must be App or *global.AssemblyWithComponents.")
+}
+
+/*
+* provisioner actions take the assembly, the request id, the account id
+* and whether a bare instance is launched.
+ */
+var launchedDocker = action.Action{
+	Name: "launcheddocker",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		app, err := assemblyParam(ctx.Params)
+		if err != nil {
+			return nil, err
+		}
+		p, err := provisioner.GetProvisioner("docker")
+		if err != nil {
+			return nil, err
+		}
+		_, perr := p.Create(app, ctx.Params[1].(string), ctx.Params[3].(bool), ctx.Params[2].(string))
+		if perr != nil {
+			return nil, perr
+		}
+		return app, nil
+	},
+	Backward: func(ctx action.BWContext) {
+		log.Info("[%s] Nothing to recover", "launcheddocker")
+	},
+	MinParams: 4,
+}
+
+var chefCommand = action.Action{
+	Name: "chefcommand",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		app, err := assemblyParam(ctx.Params)
+		if err != nil {
+			return nil, err
+		}
+		p, err := provisioner.GetProvisioner("chef")
+		if err != nil {
+			return nil, err
+		}
+		str, perr := p.Create(app, ctx.Params[1].(string), ctx.Params[3].(bool), ctx.Params[2].(string))
+		if perr != nil {
+			return nil, perr
+		}
+		app.Command = str
+		return app, nil
+	},
+	Backward: func(ctx action.BWContext) {
+		log.Info("[%s] Nothing to recover", "chefcommand")
+	},
+	MinParams: 4,
+}
+
+var deletedDocker = action.Action{
+	Name: "deleteddocker",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		app, err := assemblyParam(ctx.Params)
+		if err != nil {
+			return nil, err
+		}
+		p, err := provisioner.GetProvisioner("docker")
+		if err != nil {
+			return nil, err
+		}
+		_, perr := p.Delete(app, ctx.Params[1].(string))
+		if perr != nil {
+			return nil, perr
+		}
+		return app, nil
+	},
+	Backward: func(ctx action.BWContext) {
+		log.Info("[%s] Nothing to recover", "deleteddocker")
+	},
+	MinParams: 2,
+}
+
+var chefDeleteCommand = action.Action{
+	Name: "chefdeletecommand",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		app, err := assemblyParam(ctx.Params)
+		if err != nil {
+			return nil, err
+		}
+		p, err := provisioner.GetProvisioner("chef")
+		if err != nil {
+			return nil, err
+		}
+		str, perr := p.Delete(app, ctx.Params[1].(string))
+		if perr != nil {
+			return nil, perr
+		}
+		app.Command = str
+		return app, nil
+	},
+	Backward: func(ctx action.BWContext) {
+		log.Info("[%s] Nothing to recover", "chefdeletecommand")
+	},
+	MinParams: 2,
+}
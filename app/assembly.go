@@ -18,9 +18,8 @@ package app
 import (
 	log "code.google.com/p/log4go"
 	"github.com/megamsys/libgo/action"
-	"github.com/megamsys/libgo/db"
-	"github.com/megamsys/megamd/provisioner"
 	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/storage"
 )
 
 const PREDEFCLOUDSBUCKET= "predefclouds"
@@ -28,112 +27,73 @@ const PREDEFCLOUDSBUCKET= "predefclouds"
 func GetPredefClouds(host string) (*global.PredefClouds, error) {
 	pdc := &global.PredefClouds{}
 
-	conn, err := db.Conn(PREDEFCLOUDSBUCKET)
-
-	if err != nil {
-		return pdc, err
-	}
-
-	ferr := conn.FetchStruct(host, pdc)
+	ferr := storage.FetchStruct(PREDEFCLOUDSBUCKET, host, pdc)
 	if ferr != nil {
 		return pdc, ferr
 	}
 	return pdc, nil
 }
 
-func LaunchApp(asm *global.AssemblyWithComponents, id string, act_id string) error {
+/*
+* LaunchApp runs the provisioning pipeline of the assembly, recording
+* each action in progress. Actions already done are skipped, so the
+* launch of an interrupted job resumes where it stopped.
+ */
+func LaunchApp(asm *global.AssemblyWithComponents, id string, act_id string, progress Progress) error {
 	log.Debug("Launch App entry")
-	if len(asm.Components) > 0 {
-		LauncherHelper(asm, id, false, act_id)
-	} else {
-		LauncherHelper(asm, id, true, act_id)
+	err := LauncherHelper(asm, id, len(asm.Components) == 0, act_id, progress)
+	if ierr, ok := err.(*InterruptedError); ok {
+		log.Info("Rolling back %s, %s was interrupted", asm.Name, ierr.Action)
+		ierr.Rollback = DeleteApp(asm, id, NoProgress{})
+		if ierr.Rollback != nil {
+			log.Error("Failed to roll back %s : %s", asm.Name, ierr.Rollback)
+		}
 	}
-	return nil
+	return err
 }
 
-func LauncherHelper(asm *global.AssemblyWithComponents, id string, instance bool, act_id string) error {
+func LauncherHelper(asm *global.AssemblyWithComponents, id string, instance bool, act_id string, progress Progress) error {
 	pair_host, perrscm := global.ParseKeyValuePair(asm.Inputs, "provider")
 	if perrscm != nil {
 		log.Error("Failed to get the host value : %s", perrscm)
+		return perrscm
 	}
 
-	if pair_host.Value == "docker" {
-
+	var actions []*action.Action
+	switch pair_host.Value {
+	case "docker":
 		log.Debug("Docker provisioner entry")
-		// Provisioner
-		p, err := provisioner.GetProvisioner("docker")
-		if err != nil {
-			return err
-		}
-		log.Info("Provisioner: %v", p)
-		_, perr := p.Create(asm, id, instance, act_id)
-		if perr != nil {
-			return perr
-		}
+		actions = []*action.Action{&launchedDocker}
+	case "chef":
+		actions = []*action.Action{&chefCommand, &launchedApp}
+	default:
+		return nil
 	}
 
-	if pair_host.Value == "chef" {
-
-		p, err := provisioner.GetProvisioner("chef")
-		if err != nil {
-			return err
-		}
-
-		str, perr := p.Create(asm, id, instance, act_id)
-		if perr != nil {
-			return perr
-		}
-		asm.Command = str
-		actions := []*action.Action{&launchedApp}
-
-		pipeline := action.NewPipeline(actions...)
-		aerr := pipeline.Execute(asm)
-		if aerr != nil {
-			return aerr
-		}
-	}
-	return nil
+	pipeline := recordedPipeline(asm.Id, progress, actions...)
+	return pipeline.Execute(asm, id, act_id, instance)
 }
 
-func DeleteApp(asm *global.AssemblyWithComponents, id string) error {
+func DeleteApp(asm *global.AssemblyWithComponents, id string, progress Progress) error {
 	log.Debug("Delete App entry")
 
 	pair_host, perrscm := global.ParseKeyValuePair(asm.Inputs, "provider")
 	if perrscm != nil {
 		log.Error("Failed to get the host value : %s", perrscm)
+		return perrscm
 	}
 
-	if pair_host.Value == "docker" {
-
+	var actions []*action.Action
+	switch pair_host.Value {
+	case "docker":
 		log.Debug("Docker provisioner entry")
-		// Provisioner
-		p, err := provisioner.GetProvisioner("docker")
-		if err != nil {
-			return err
-		}
-		log.Info("Provisioner: %v", p)
-		_, perr := p.Delete(asm, id)
-		if perr != nil {
-			return perr
-		}
+		actions = []*action.Action{&deletedDocker}
+	case "chef":
+		actions = []*action.Action{&chefDeleteCommand, &updateStatus}
+	default:
+		return nil
 	}
-	if pair_host.Value == "chef" {
 
-		p, err := provisioner.GetProvisioner("chef")
-		if err != nil {
-			return err
-		}
-		str, perr := p.Delete(asm, id)
-		if perr != nil {
-			return perr
-		}
-		asm.Command = str
-		actions := []*action.Action{&updateStatus}
-		pipeline := action.NewPipeline(actions...)
-		aerr := pipeline.Execute(asm)
-		if aerr != nil {
-			return aerr
-		}
-	}
-	return nil
+	pipeline := recordedPipeline(asm.Id, progress, actions...)
+	return pipeline.Execute(asm, id)
 }
@@ -0,0 +1,126 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package bind
+
+import (
+	"github.com/megamsys/megamd/global"
+)
+
+/*
+* ComponentApp is a component services are bound to, its container is
+* the single unit.
+ */
+type ComponentApp struct {
+	Component *global.Component
+}
+
+type componentUnit struct {
+	ip string
+}
+
+func (u *componentUnit) GetIp() string {
+	return u.ip
+}
+
+func NewComponentApp(com *global.Component) *ComponentApp {
+	return &ComponentApp{Component: com}
+}
+
+func (a *ComponentApp) GetIp() string {
+	return output(a.Component, "ip")
+}
+
+func (a *ComponentApp) GetName() string {
+	return a.Component.Name
+}
+
+func (a *ComponentApp) GetUnits() []Unit {
+	return []Unit{&componentUnit{ip: a.GetIp()}}
+}
+
+/*
+* InstanceEnv returns the variables the named service instance set, all
+* the bound ones when the name is empty.
+ */
+func (a *ComponentApp) InstanceEnv(name string) (map[string]EnvVar, error) {
+	envs, err := GetEnvs(a.Component.Id)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]EnvVar)
+	for _, v := range envs.Vars {
+		if name == "" || v.InstanceName == name {
+			vars[v.Name] = v
+		}
+	}
+	return vars, nil
+}
+
+/*
+* SetEnvs sets the variables, replacing the ones of the same name. With
+* publicOnly a private variable already set is left as it is.
+ */
+func (a *ComponentApp) SetEnvs(vars []EnvVar, publicOnly bool) error {
+	_, err := UpdateEnvs(a.Component.Id, func(envs *Envs) error {
+		for _, v := range vars {
+			replaced := false
+			for i := range envs.Vars {
+				if envs.Vars[i].Name != v.Name {
+					continue
+				}
+				if !publicOnly || envs.Vars[i].Public {
+					envs.Vars[i] = v
+				}
+				replaced = true
+			}
+			if !replaced {
+				envs.Vars = append(envs.Vars, v)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+/*
+* UnsetEnvs removes the named variables. With publicOnly the private ones
+* are kept.
+ */
+func (a *ComponentApp) UnsetEnvs(names []string, publicOnly bool) error {
+	unset := make(map[string]bool, len(names))
+	for _, name := range names {
+		unset[name] = true
+	}
+	_, err := UpdateEnvs(a.Component.Id, func(envs *Envs) error {
+		kept := envs.Vars[:0]
+		for _, v := range envs.Vars {
+			if unset[v.Name] && (!publicOnly || v.Public) {
+				continue
+			}
+			kept = append(kept, v)
+		}
+		envs.Vars = kept
+		return nil
+	})
+	return err
+}
+
+func output(com *global.Component, key string) string {
+	if pair, err := global.ParseKeyValuePair(com.Outputs, key); err == nil {
+		return pair.Value
+	}
+	return ""
+}
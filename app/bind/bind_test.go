@@ -0,0 +1,172 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package bind
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/storage"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	config.Set("storage:backend", "file")
+	config.Set("storage:path", filepath.Join(c.MkDir(), "megamd.db"))
+	config.Set("bind:secret", "s3cr3t")
+}
+
+func postgres() *global.Component {
+	return &global.Component{
+		Id:   "COMPG",
+		Name: "my-pg",
+		Inputs: []*global.KeyValuePair{
+			global.GetKeyValuePair("bind.password", "team4dog"),
+			global.GetKeyValuePair("source", "postgres"),
+		},
+		Outputs: []*global.KeyValuePair{
+			global.GetKeyValuePair("ip", "103.56.93.5"),
+			global.GetKeyValuePair("port", "5432"),
+		},
+	}
+}
+
+func (s *S) TestEncryptRoundTrip(c *check.C) {
+	sealed, err := Encrypt("team4dog")
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.HasPrefix(sealed, encryptedPrefix), check.Equals, true)
+	c.Assert(strings.Contains(sealed, "team4dog"), check.Equals, false)
+	plain, err := Decrypt(sealed)
+	c.Assert(err, check.IsNil)
+	c.Assert(plain, check.Equals, "team4dog")
+}
+
+func (s *S) TestEncryptNeedsSecret(c *check.C) {
+	config.Set("bind:secret", "")
+	defer config.Set("bind:secret", "s3cr3t")
+	_, err := Encrypt("team4dog")
+	c.Assert(err, check.NotNil)
+}
+
+// brokenRepository fails every read, like riak when it is down.
+type brokenRepository struct {
+	storage.Repository
+}
+
+func (brokenRepository) FetchStruct(bucket string, key string, out interface{}) error {
+	return errors.New("riak didn't answer")
+}
+
+func (brokenRepository) FetchRevision(bucket string, key string, out interface{}) (storage.Version, error) {
+	return storage.Version{}, errors.New("riak didn't answer")
+}
+
+func (s *S) TestGetEnvsNotStoredYet(c *check.C) {
+	envs, err := GetEnvs("COMNEW")
+	c.Assert(err, check.IsNil)
+	c.Assert(envs.ComponentId, check.Equals, "COMNEW")
+	c.Assert(envs.Vars, check.HasLen, 0)
+}
+
+func (s *S) TestGetEnvsReturnsStorageErrors(c *check.C) {
+	storage.Register("broken", func() (storage.Repository, error) { return brokenRepository{}, nil })
+	config.Set("storage:backend", "broken")
+	defer config.Set("storage:backend", "file")
+	_, err := GetEnvs("COMWEB")
+	c.Assert(err, check.ErrorMatches, "riak didn't answer")
+
+	svc := &Service{Component: &global.Component{Id: "COMDB", Name: "db"}}
+	err = svc.UnbindApp(NewComponentApp(&global.Component{Id: "COMWEB", Name: "web"}))
+	c.Assert(err, check.ErrorMatches, "riak didn't answer")
+}
+
+func (s *S) TestPrivateVarsStoredEncrypted(c *check.C) {
+	app := NewComponentApp(&global.Component{Id: "COMSEAL", Name: "web"})
+	err := app.SetEnvs([]EnvVar{{Name: "TOKEN", Value: "abc"}, {Name: "MODE", Value: "prod", Public: true}}, false)
+	c.Assert(err, check.IsNil)
+
+	raw := &Envs{}
+	c.Assert(storage.FetchStruct(ENVSBUCKET, "COMSEAL", raw), check.IsNil)
+	c.Assert(raw.Vars[0].Value, check.Not(check.Equals), "abc")
+	c.Assert(raw.Vars[1].Value, check.Equals, "prod")
+
+	envs, err := GetEnvs("COMSEAL")
+	c.Assert(err, check.IsNil)
+	c.Assert(envs.Vars[0].Value, check.Equals, "abc")
+}
+
+func (s *S) TestSetEnvsPublicOnlyKeepsPrivate(c *check.C) {
+	app := NewComponentApp(&global.Component{Id: "COMPUB", Name: "web"})
+	c.Assert(app.SetEnvs([]EnvVar{{Name: "KEY", Value: "private"}}, false), check.IsNil)
+	c.Assert(app.SetEnvs([]EnvVar{{Name: "KEY", Value: "public", Public: true}}, true), check.IsNil)
+	vars, err := app.InstanceEnv("")
+	c.Assert(err, check.IsNil)
+	c.Assert(vars["KEY"].Value, check.Equals, "private")
+
+	c.Assert(app.UnsetEnvs([]string{"KEY"}, true), check.IsNil)
+	vars, err = app.InstanceEnv("")
+	c.Assert(err, check.IsNil)
+	c.Assert(vars, check.HasLen, 1)
+	c.Assert(app.UnsetEnvs([]string{"KEY"}, false), check.IsNil)
+	vars, err = app.InstanceEnv("")
+	c.Assert(err, check.IsNil)
+	c.Assert(vars, check.HasLen, 0)
+}
+
+func (s *S) TestServiceBindAndUnbind(c *check.C) {
+	web := &global.Component{
+		Id:     "COMWEB",
+		Name:   "web",
+		Inputs: []*global.KeyValuePair{global.GetKeyValuePair("env.MODE", "prod")},
+	}
+	svc := NewService(postgres())
+	c.Assert(svc.BindApp(NewComponentApp(web)), check.IsNil)
+
+	vars, err := ComponentEnv(web)
+	c.Assert(err, check.IsNil)
+	c.Assert(DockerEnv(vars), check.DeepEquals, []string{
+		"MODE=prod", "MY_PG_HOST=103.56.93.5", "MY_PG_PORT=5432", "MY_PG_PASSWORD=team4dog",
+	})
+	c.Assert(Masked(vars), check.Equals,
+		"MODE=prod, MY_PG_HOST=103.56.93.5, MY_PG_PASSWORD=*** (private variable), MY_PG_PORT=5432")
+
+	c.Assert(svc.UnbindApp(NewComponentApp(web)), check.IsNil)
+	vars, err = ComponentEnv(web)
+	c.Assert(err, check.IsNil)
+	c.Assert(DockerEnv(vars), check.DeepEquals, []string{"MODE=prod"})
+}
+
+func (s *S) TestComponentEnvSecretInputs(c *check.C) {
+	com := &global.Component{
+		Id:     "COMSECRET",
+		Inputs: []*global.KeyValuePair{global.GetKeyValuePair("secret.API_KEY", "xyz")},
+	}
+	vars, err := ComponentEnv(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(vars, check.DeepEquals, []EnvVar{{Name: "API_KEY", Value: "xyz"}})
+}
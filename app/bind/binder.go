@@ -19,10 +19,10 @@ import "fmt"
 
 // EnvVar represents a environment variable for an app.
 type EnvVar struct {
-	Name         string
-	Value        string
-	Public       bool
-	InstanceName string
+	Name         string `json:"name"`
+	Value        string `json:"value"`
+	Public       bool   `json:"public"`
+	InstanceName string `json:"instance_name"`
 }
 
 func (e *EnvVar) String() string {
@@ -52,7 +52,7 @@ type App interface {
 	GetUnits() []Unit
 
 	// InstanceEnv returns the app enviroment variables.
-	InstanceEnv(string) map[string]EnvVar
+	InstanceEnv(string) (map[string]EnvVar, error)
 
 	// SetEnvs adds enviroment variables in the app.
 	SetEnvs([]EnvVar, bool) error
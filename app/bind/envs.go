@@ -0,0 +1,179 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package bind
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/storage"
+)
+
+const (
+	ENVSBUCKET = "envs"
+
+	// component inputs env.NAME are public variables, secret.NAME private ones.
+	publicInput  = "env."
+	privateInput = "secret."
+)
+
+/*
+* Envs are the variables bound services set on a component. Private
+* values are stored encrypted.
+ */
+type Envs struct {
+	ComponentId string   `json:"component_id"`
+	Vars        []EnvVar `json:"vars"`
+	Revision    int      `json:"revision"`
+	// the version GetEnvs read, store writes over it.
+	read storage.Version
+}
+
+/*
+* GetEnvs returns the variables bound to the component, none when nothing
+* was bound yet.
+ */
+func GetEnvs(componentId string) (*Envs, error) {
+	envs := &Envs{}
+	read, err := storage.FetchRevision(ENVSBUCKET, componentId, envs)
+	if storage.IsNotFound(err) || (err == nil && envs.ComponentId == "") {
+		// a record stored meanwhile makes the first store a conflict.
+		return &Envs{ComponentId: componentId, read: read}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range envs.Vars {
+		value, err := Decrypt(envs.Vars[i].Value)
+		if err != nil {
+			return nil, err
+		}
+		envs.Vars[i].Value = value
+	}
+	envs.read = read
+	return envs, nil
+}
+
+func (envs *Envs) store() error {
+	sealed := &Envs{ComponentId: envs.ComponentId, Vars: make([]EnvVar, len(envs.Vars)), Revision: envs.Revision + 1}
+	for i, v := range envs.Vars {
+		if !v.Public {
+			value, err := Encrypt(v.Value)
+			if err != nil {
+				return err
+			}
+			v.Value = value
+		}
+		sealed.Vars[i] = v
+	}
+	read, err := storage.StoreRevision(ENVSBUCKET, envs.ComponentId, sealed, envs.read)
+	if err != nil {
+		return err
+	}
+	envs.Revision, envs.read = sealed.Revision, read
+	return nil
+}
+
+/*
+* UpdateEnvs reads the variables of the component, applies change to them
+* and stores them back, again when a concurrent write won.
+ */
+func UpdateEnvs(componentId string, change func(*Envs) error) (*Envs, error) {
+	var envs *Envs
+	err := storage.RetryOnConflict(func() error {
+		var err error
+		if envs, err = GetEnvs(componentId); err != nil {
+			return err
+		}
+		if err := change(envs); err != nil {
+			return err
+		}
+		return envs.store()
+	})
+	return envs, err
+}
+
+/*
+* ComponentEnv returns the variables of the component inputs followed by
+* the ones of its bound services. A bound variable wins over an input of
+* the same name.
+ */
+func ComponentEnv(com *global.Component) ([]EnvVar, error) {
+	vars := []EnvVar{}
+	index := map[string]int{}
+	add := func(v EnvVar) {
+		if i, ok := index[v.Name]; ok {
+			vars[i] = v
+			return
+		}
+		index[v.Name] = len(vars)
+		vars = append(vars, v)
+	}
+	for _, input := range com.Inputs {
+		if input == nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(input.Key, publicInput):
+			add(EnvVar{Name: strings.TrimPrefix(input.Key, publicInput), Value: input.Value, Public: true})
+		case strings.HasPrefix(input.Key, privateInput):
+			add(EnvVar{Name: strings.TrimPrefix(input.Key, privateInput), Value: input.Value})
+		}
+	}
+	envs, err := GetEnvs(com.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range envs.Vars {
+		add(v)
+	}
+	return vars, nil
+}
+
+/*
+* DockerEnv formats the variables as docker takes them, NAME=value.
+ */
+func DockerEnv(vars []EnvVar) []string {
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		env = append(env, v.Name+"="+v.Value)
+	}
+	return env
+}
+
+/*
+* EnvMap returns the variables by name, the way chef attributes take them.
+ */
+func EnvMap(vars []EnvVar) map[string]string {
+	env := make(map[string]string, len(vars))
+	for _, v := range vars {
+		env[v.Name] = v.Value
+	}
+	return env
+}
+
+/*
+* Masked formats the variables for the logs, private values hidden.
+ */
+func Masked(vars []EnvVar) string {
+	masked := make([]string, 0, len(vars))
+	for i := range vars {
+		masked = append(masked, vars[i].Name+"="+vars[i].String())
+	}
+	sort.Strings(masked)
+	return strings.Join(masked, ", ")
+}
@@ -0,0 +1,108 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package bind
+
+import (
+	"strings"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/global"
+)
+
+// service inputs bind.KEY are handed to the apps as private variables.
+const bindInput = "bind."
+
+/*
+* Service is a component apps bind to, a database or a queue. An app
+* bound to the service postgres gets
+*
+*   POSTGRES_HOST, POSTGRES_PORT
+*
+* and POSTGRES_<KEY> for every bind.<key> input of the service.
+ */
+type Service struct {
+	Component *global.Component
+}
+
+func NewService(com *global.Component) *Service {
+	return &Service{Component: com}
+}
+
+/*
+* Envs returns the variables the service hands to the apps bound to it.
+ */
+func (s *Service) Envs() []EnvVar {
+	prefix := envName(s.Component.Name) + "_"
+	instance := s.Component.Name
+	vars := []EnvVar{}
+	if ip := output(s.Component, "ip"); ip != "" {
+		vars = append(vars, EnvVar{Name: prefix + "HOST", Value: ip, Public: true, InstanceName: instance})
+	}
+	if port := output(s.Component, "port"); port != "" {
+		vars = append(vars, EnvVar{Name: prefix + "PORT", Value: port, Public: true, InstanceName: instance})
+	}
+	for _, input := range s.Component.Inputs {
+		if input == nil || !strings.HasPrefix(input.Key, bindInput) {
+			continue
+		}
+		name := prefix + envName(strings.TrimPrefix(input.Key, bindInput))
+		vars = append(vars, EnvVar{Name: name, Value: input.Value, InstanceName: instance})
+	}
+	return vars
+}
+
+func (s *Service) BindApp(app App) error {
+	vars := s.Envs()
+	log.Info("binding %s to %s : %s", s.Component.Name, app.GetName(), Masked(vars))
+	return app.SetEnvs(vars, false)
+}
+
+func (s *Service) BindUnit(app App, unit Unit) (map[string]string, error) {
+	return EnvMap(s.Envs()), nil
+}
+
+func (s *Service) UnbindApp(app App) error {
+	vars, err := app.InstanceEnv(s.Component.Name)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range vars {
+		names = append(names, name)
+	}
+	log.Info("unbinding %s from %s : %s", s.Component.Name, app.GetName(), strings.Join(names, ", "))
+	return app.UnsetEnvs(names, false)
+}
+
+func (s *Service) UnbindUnit(unit Unit) error {
+	return nil
+}
+
+/*
+* envName upper cases the name, anything but letters and digits is an
+* underscore.
+ */
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
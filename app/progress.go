@@ -0,0 +1,137 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package app
+
+import (
+	"fmt"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/libgo/action"
+)
+
+const (
+	STEP_STARTED = "started"
+	STEP_DONE    = "done"
+	STEP_FAILED  = "failed"
+	// a step still started when the job was resumed, cut short by a crash or a shutdown.
+	STEP_INTERRUPTED = "interrupted"
+)
+
+/*
+* Progress records the pipeline actions run on an assembly, so a
+* pipeline interrupted by a restart can pick up where it stopped.
+ */
+type Progress interface {
+	// Step returns the recorded status of the action, empty if it never started.
+	Step(assemblyId string, action string) string
+
+	// Record stores the status of the action.
+	Record(assemblyId string, action string, status string) error
+}
+
+// NoProgress is used when nothing tracks the pipeline.
+type NoProgress struct{}
+
+func (NoProgress) Step(assemblyId string, action string) string { return "" }
+
+func (NoProgress) Record(assemblyId string, action string, status string) error { return nil }
+
+/*
+* actions that only build a command, they are run again on resume.
+ */
+var idempotentSteps = map[string]bool{
+	"chefcommand":       true,
+	"chefdeletecommand": true,
+}
+
+/*
+* actions that leave a half provisioned assembly when interrupted. the
+* assembly is rolled back instead of running them again. a failure of
+* theirs is retried as is.
+ */
+var rollbackSteps = map[string]bool{
+	"launcheddocker": true,
+	"launchedapp":    true,
+}
+
+/*
+* InterruptedError is returned when a pipeline finds an action that was
+* interrupted and can't be run again. Rollback is the error of rolling
+* the assembly back, if that failed too.
+ */
+type InterruptedError struct {
+	AssemblyId string
+	Action     string
+	Rollback   error
+}
+
+func (e *InterruptedError) Error() string {
+	if e.Rollback != nil {
+		return fmt.Sprintf("%s was interrupted on assembly %s, the rollback failed : %s", e.Action, e.AssemblyId, e.Rollback)
+	}
+	return fmt.Sprintf("%s was interrupted on assembly %s, rolled back", e.Action, e.AssemblyId)
+}
+
+/*
+* recorded wraps the action so its progress on the assembly is recorded.
+* done actions are skipped, unless idempotent. failed ones run again.
+ */
+func recorded(a *action.Action, assemblyId string, p Progress) *action.Action {
+	return &action.Action{
+		Name:      a.Name,
+		MinParams: a.MinParams,
+		Backward:  a.Backward,
+		Forward: func(ctx action.FWContext) (action.Result, error) {
+			switch p.Step(assemblyId, a.Name) {
+			case STEP_DONE:
+				if !idempotentSteps[a.Name] {
+					log.Info("[%s] already done on %s, skipped", a.Name, assemblyId)
+					return ctx.Previous, nil
+				}
+			case STEP_INTERRUPTED:
+				if rollbackSteps[a.Name] {
+					return nil, &InterruptedError{AssemblyId: assemblyId, Action: a.Name}
+				}
+				log.Info("[%s] was interrupted on %s, running it again", a.Name, assemblyId)
+			case STEP_STARTED, STEP_FAILED:
+				log.Info("[%s] failed on %s, running it again", a.Name, assemblyId)
+			}
+
+			if err := p.Record(assemblyId, a.Name, STEP_STARTED); err != nil {
+				log.Error("Failed to record the progress of %s : %s", a.Name, err)
+			}
+			res, err := a.Forward(ctx)
+			if err != nil {
+				if rerr := p.Record(assemblyId, a.Name, STEP_FAILED); rerr != nil {
+					log.Error("Failed to record the progress of %s : %s", a.Name, rerr)
+				}
+				return res, err
+			}
+			if rerr := p.Record(assemblyId, a.Name, STEP_DONE); rerr != nil {
+				log.Error("Failed to record the progress of %s : %s", a.Name, rerr)
+			}
+			return res, nil
+		},
+	}
+}
+
+func recordedPipeline(assemblyId string, p Progress, actions ...*action.Action) *action.Pipeline {
+	wrapped := make([]*action.Action, len(actions))
+	for i, a := range actions {
+		wrapped[i] = recorded(a, assemblyId, p)
+	}
+	return action.NewPipeline(wrapped...)
+}
@@ -0,0 +1,120 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package app
+
+import (
+	"errors"
+
+	"github.com/megamsys/libgo/action"
+	"gopkg.in/check.v1"
+)
+
+type fakeProgress struct {
+	steps map[string]string
+}
+
+func (p *fakeProgress) Step(assemblyId string, action string) string {
+	return p.steps[assemblyId+"/"+action]
+}
+
+func (p *fakeProgress) Record(assemblyId string, action string, status string) error {
+	p.steps[assemblyId+"/"+action] = status
+	return nil
+}
+
+func countingAction(name string, calls *int, err error) *action.Action {
+	return &action.Action{
+		Name: name,
+		Forward: func(ctx action.FWContext) (action.Result, error) {
+			*calls++
+			return "result", err
+		},
+		MinParams: 1,
+	}
+}
+
+func (s *S) TestRecordedMarksDone(c *check.C) {
+	p := &fakeProgress{steps: map[string]string{}}
+	calls := 0
+	a := recorded(countingAction("launcheddocker", &calls, nil), "ASM1", p)
+	_, err := a.Forward(action.FWContext{Params: []interface{}{"asm"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(calls, check.Equals, 1)
+	c.Assert(p.Step("ASM1", "launcheddocker"), check.Equals, STEP_DONE)
+}
+
+func (s *S) TestRecordedMarksFailed(c *check.C) {
+	p := &fakeProgress{steps: map[string]string{}}
+	calls := 0
+	a := recorded(countingAction("updatestatus", &calls, errors.New("knife failed")), "ASM1", p)
+	_, err := a.Forward(action.FWContext{Params: []interface{}{"asm"}})
+	c.Assert(err, check.NotNil)
+	c.Assert(p.Step("ASM1", "updatestatus"), check.Equals, STEP_FAILED)
+}
+
+func (s *S) TestRecordedRetriesFailedLaunch(c *check.C) {
+	p := &fakeProgress{steps: map[string]string{"ASM1/launchedapp": STEP_FAILED}}
+	calls := 0
+	a := recorded(countingAction("launchedapp", &calls, nil), "ASM1", p)
+	_, err := a.Forward(action.FWContext{Params: []interface{}{"asm"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(calls, check.Equals, 1)
+	c.Assert(p.Step("ASM1", "launchedapp"), check.Equals, STEP_DONE)
+}
+
+func (s *S) TestRecordedSkipsDone(c *check.C) {
+	p := &fakeProgress{steps: map[string]string{"ASM1/launcheddocker": STEP_DONE}}
+	calls := 0
+	a := recorded(countingAction("launcheddocker", &calls, nil), "ASM1", p)
+	_, err := a.Forward(action.FWContext{Params: []interface{}{"asm"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(calls, check.Equals, 0)
+}
+
+func (s *S) TestRecordedRunsIdempotentAgain(c *check.C) {
+	p := &fakeProgress{steps: map[string]string{"ASM1/chefcommand": STEP_DONE}}
+	calls := 0
+	a := recorded(countingAction("chefcommand", &calls, nil), "ASM1", p)
+	_, err := a.Forward(action.FWContext{Params: []interface{}{"asm"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(calls, check.Equals, 1)
+}
+
+func (s *S) TestRecordedRollsBackInterrupted(c *check.C) {
+	p := &fakeProgress{steps: map[string]string{"ASM1/launchedapp": STEP_INTERRUPTED}}
+	calls := 0
+	a := recorded(countingAction("launchedapp", &calls, nil), "ASM1", p)
+	_, err := a.Forward(action.FWContext{Params: []interface{}{"asm"}})
+	c.Assert(err, check.FitsTypeOf, &InterruptedError{})
+	c.Assert(calls, check.Equals, 0)
+}
+
+func (s *S) TestRecordedResumesInterrupted(c *check.C) {
+	p := &fakeProgress{steps: map[string]string{"ASM1/updatestatus": STEP_INTERRUPTED}}
+	calls := 0
+	a := recorded(countingAction("updatestatus", &calls, nil), "ASM1", p)
+	_, err := a.Forward(action.FWContext{Params: []interface{}{"asm"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(calls, check.Equals, 1)
+	c.Assert(p.Step("ASM1", "updatestatus"), check.Equals, STEP_DONE)
+}
+
+func (s *S) TestInterruptedErrorReportsRollback(c *check.C) {
+	err := &InterruptedError{AssemblyId: "ASM1", Action: "launchedapp"}
+	c.Assert(err, check.ErrorMatches, "launchedapp was interrupted on assembly ASM1, rolled back")
+	err.Rollback = errors.New("container busy")
+	c.Assert(err, check.ErrorMatches, "launchedapp was interrupted on assembly ASM1, the rollback failed : container busy")
+}
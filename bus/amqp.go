@@ -0,0 +1,88 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package bus
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/megamsys/libgo/amqp"
+)
+
+/*
+ * amqpBus talks to rabbitmq through libgo, as configured by amqp:url.
+ */
+type amqpBus struct {
+	mu   sync.Mutex
+	subs map[string]amqp.PubSubQ
+}
+
+func newAmqpBus() *amqpBus {
+	return &amqpBus{subs: make(map[string]amqp.PubSubQ)}
+}
+
+func (b *amqpBus) Sub(queue string) (chan []byte, error) {
+	factor, err := amqp.Factory()
+	if err != nil {
+		return nil, err
+	}
+	pubsub, err := factor.Get(queue)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := pubsub.Sub()
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.subs[queue] = pubsub
+	b.mu.Unlock()
+	return msgs, nil
+}
+
+func (b *amqpBus) UnSub(queue string) error {
+	b.mu.Lock()
+	pubsub, ok := b.subs[queue]
+	delete(b.subs, queue)
+	b.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("not subscribed to %s", queue)
+	}
+	return pubsub.UnSub()
+}
+
+func (b *amqpBus) Pub(queue string, msg []byte) error {
+	factor, err := amqp.Factory()
+	if err != nil {
+		return err
+	}
+	pubsub, err := factor.Get(queue)
+	if err != nil {
+		return err
+	}
+	return pubsub.Pub(msg)
+}
+
+func (b *amqpBus) Ping() error {
+	factor, err := amqp.Factory()
+	if err != nil {
+		return err
+	}
+	_, err = factor.Dial()
+	return err
+}
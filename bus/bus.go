@@ -0,0 +1,84 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package bus
+
+import (
+	"fmt"
+
+	"github.com/tsuru/config"
+)
+
+/*
+ * MessageBus is what the queue servers consume from and publish to.
+ */
+type MessageBus interface {
+	// Sub subscribes to the named queue.
+	Sub(queue string) (chan []byte, error)
+
+	// UnSub ends the subscription, closing the channel returned by Sub.
+	UnSub(queue string) error
+
+	// Pub publishes the message on the named queue.
+	Pub(queue string, msg []byte) error
+
+	// Ping verifies the bus can be used.
+	Ping() error
+}
+
+const defaultBus = "amqp"
+
+var buses = make(map[string]MessageBus)
+
+func init() {
+	Register("amqp", newAmqpBus())
+	Register("memory", newMemoryBus())
+}
+
+/*
+ * Register registers a new message bus in the MessageBus registry.
+ */
+func Register(name string, b MessageBus) {
+	buses[name] = b
+}
+
+func GetBus(name string) (MessageBus, error) {
+	b, ok := buses[name]
+	if !ok {
+		return nil, fmt.Errorf("Message bus %s not registered", name)
+	}
+	return b, nil
+}
+
+/*
+ * Get returns the bus named by queue:bus in the conf file, amqp when
+ * it isn't set.
+ */
+func Get() (MessageBus, error) {
+	name, err := config.GetString("queue:bus")
+	if err != nil || name == "" {
+		name = defaultBus
+	}
+	return GetBus(name)
+}
+
+/*
+ * InProcess tells if the queues of the bus live inside the process that
+ * consumes them, a message published from another process never gets there.
+ */
+func InProcess(b MessageBus) bool {
+	_, ok := b.(*memoryBus)
+	return ok
+}
@@ -0,0 +1,91 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package bus
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tsuru/config"
+)
+
+const defaultMemoryBuffer = 1024
+
+/*
+ * memoryBus keeps every queue as a buffered channel inside the process.
+ * Meant for single node setups and tests, messages don't survive a restart.
+ */
+type memoryBus struct {
+	mu     sync.Mutex
+	queues map[string]chan []byte
+}
+
+func newMemoryBus() *memoryBus {
+	return &memoryBus{queues: make(map[string]chan []byte)}
+}
+
+// queue returns the channel of the named queue, creating it. Callers hold mu.
+func (b *memoryBus) queue(name string) chan []byte {
+	q, ok := b.queues[name]
+	if !ok {
+		size, err := config.GetInt("queue:memory_buffer")
+		if err != nil || size <= 0 {
+			size = defaultMemoryBuffer
+		}
+		q = make(chan []byte, size)
+		b.queues[name] = q
+	}
+	return q
+}
+
+func (b *memoryBus) Sub(queue string) (chan []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.queue(queue), nil
+}
+
+/*
+ * UnSub closes the queue. Messages still buffered are drained by the
+ * subscriber before its range loop ends.
+ */
+func (b *memoryBus) UnSub(queue string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return fmt.Errorf("not subscribed to %s", queue)
+	}
+	delete(b.queues, queue)
+	close(q)
+	return nil
+}
+
+func (b *memoryBus) Pub(queue string, msg []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case b.queue(queue) <- msg:
+		return nil
+	default:
+		return fmt.Errorf("queue %s is full", queue)
+	}
+}
+
+func (b *memoryBus) Ping() error {
+	return nil
+}
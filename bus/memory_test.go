@@ -0,0 +1,73 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package bus
+
+import (
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestMemoryBusIsRegistered(c *check.C) {
+	b, err := GetBus("memory")
+	c.Assert(err, check.IsNil)
+	c.Assert(b, check.FitsTypeOf, &memoryBus{})
+}
+
+func (s *S) TestGetBusUnknown(c *check.C) {
+	_, err := GetBus("kafka")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestMemoryBusKeepsMessagesPublishedBeforeSub(c *check.C) {
+	b := newMemoryBus()
+	c.Assert(b.Pub("events", []byte("one")), check.IsNil)
+	c.Assert(b.Pub("events", []byte("two")), check.IsNil)
+	msgs, err := b.Sub("events")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(<-msgs), check.Equals, "one")
+	c.Assert(string(<-msgs), check.Equals, "two")
+}
+
+func (s *S) TestMemoryBusUnSubClosesTheChannel(c *check.C) {
+	b := newMemoryBus()
+	msgs, _ := b.Sub("dockerstate")
+	b.Pub("dockerstate", []byte("start"))
+	c.Assert(b.UnSub("dockerstate"), check.IsNil)
+	var got []string
+	for msg := range msgs {
+		got = append(got, string(msg))
+	}
+	c.Assert(got, check.DeepEquals, []string{"start"})
+}
+
+func (s *S) TestMemoryBusUnSubUnknown(c *check.C) {
+	b := newMemoryBus()
+	c.Assert(b.UnSub("cloudstandup"), check.NotNil)
+}
+
+func (s *S) TestInProcess(c *check.C) {
+	c.Assert(InProcess(newMemoryBus()), check.Equals, true)
+	c.Assert(InProcess(newAmqpBus()), check.Equals, false)
+}
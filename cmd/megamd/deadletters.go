@@ -0,0 +1,102 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/megamsys/libgo/cmd"
+	"github.com/megamsys/megamd/cmd/megamd/server/queue"
+	"launchpad.net/gnuflag"
+)
+
+type DeadLetters struct{}
+
+func (c *DeadLetters) Info() *cmd.Info {
+	desc := `lists the messages that failed every retry.
+
+Use 'megamd replay' to publish them back once the outage is over.
+`
+	return &cmd.Info{
+		Name:    "deadletters",
+		Usage:   `deadletters`,
+		Desc:    desc,
+		MinArgs: 0,
+	}
+}
+
+func (c *DeadLetters) Run(context *cmd.Context, client *cmd.Client) error {
+	letters, err := queue.DeadLetters()
+	if err != nil {
+		return err
+	}
+	for _, dl := range letters {
+		fmt.Fprintf(context.Stdout, "%s  %s  %s  attempts=%d  %s\n", dl.Id, dl.Queue, dl.CreatedAt, dl.Attempts, dl.Reason)
+	}
+	return nil
+}
+
+type Replay struct {
+	fs  *gnuflag.FlagSet
+	all bool
+}
+
+func (c *Replay) Info() *cmd.Info {
+	desc := `replays dead-lettered messages on the queue they came from.
+
+If you use the '--all' flag every dead letter is replayed.
+`
+	return &cmd.Info{
+		Name:    "replay",
+		Usage:   `replay [<id>...] [--all]`,
+		Desc:    desc,
+		MinArgs: 0,
+	}
+}
+
+func (c *Replay) Run(context *cmd.Context, client *cmd.Client) error {
+	ids := context.Args
+	if c.all {
+		letters, err := queue.DeadLetters()
+		if err != nil {
+			return err
+		}
+		ids = make([]string, 0, len(letters))
+		for _, dl := range letters {
+			ids = append(ids, dl.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return errors.New("nothing to replay, give the dead letter ids or --all")
+	}
+	for _, id := range ids {
+		if err := queue.Replay(id); err != nil {
+			return fmt.Errorf("failed to replay %s: %s", id, err)
+		}
+		fmt.Fprintf(context.Stdout, "%s replayed\n", id)
+	}
+	return nil
+}
+
+func (c *Replay) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("megamd", gnuflag.ExitOnError)
+		c.fs.BoolVar(&c.all, "all", false, "all: replay every dead letter")
+		c.fs.BoolVar(&c.all, "a", false, "all: replay every dead letter")
+	}
+	return c.fs
+}
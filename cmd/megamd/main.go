@@ -33,7 +33,9 @@ const defaultConfigPath = "conf/megamd.conf"
 
 func buildManager(name string) *cmd.Manager {
 	m := cmd.BuildBaseManager(name, version, header)
-	m.Register(&StartD{}) //sudo megamd start
+	m.Register(&StartD{})      //sudo megamd start
+	m.Register(&DeadLetters{}) //megamd deadletters
+	m.Register(&Replay{})      //megamd replay --all
 	return m
 }
 
@@ -0,0 +1,67 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package queue
+
+import (
+	"errors"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/bus"
+	"github.com/megamsys/megamd/global"
+)
+
+/*
+* DeadLetterQueue is where a message that failed every retry, or failed
+* in a way retrying can't fix, is republished with the failure reason.
+ */
+func DeadLetterQueue(name string) string {
+	return name + "_dlq"
+}
+
+/*
+* DeadLetters lists the dead letters recorded in riak, the ones that can
+* be replayed by id.
+ */
+func DeadLetters() ([]*global.DeadLetter, error) {
+	return global.ListDeadLetters()
+}
+
+var ErrInProcessBus = errors.New("the dead letters can't be replayed on the memory bus, its queues live inside the running megamd")
+
+/*
+* Replay publishes a dead-lettered payload back on the queue it was
+* consumed from and removes it from the dead letters. The memory bus is
+* refused, the message would be published in the replaying process only
+* and lost.
+ */
+func Replay(id string) error {
+	b, err := bus.Get()
+	if err != nil {
+		return err
+	}
+	if bus.InProcess(b) {
+		return ErrInProcessBus
+	}
+	dl := &global.DeadLetter{}
+	if _, err := dl.Get(id); err != nil {
+		return err
+	}
+	log.Info("Replaying dead letter %s on %s", dl.Id, dl.Queue)
+	if err := b.Pub(dl.Queue, []byte(dl.Payload)); err != nil {
+		return err
+	}
+	return dl.Remove()
+}
@@ -0,0 +1,94 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package queue
+
+import (
+	"sync"
+
+	"github.com/tsuru/config"
+)
+
+const (
+	defaultWorkers = 4
+	defaultWaiting = 64
+)
+
+/*
+* WorkerPool runs the work on messages with a fixed number of
+* goroutines. Submit blocks while every worker is busy.
+ */
+type WorkerPool struct {
+	tasks chan func()
+	wg    sync.WaitGroup
+}
+
+func NewWorkerPool(size int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &WorkerPool{tasks: make(chan func())}
+	p.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go func() {
+			defer p.wg.Done()
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+func (p *WorkerPool) Submit(task func()) {
+	p.tasks <- task
+}
+
+/*
+* Close stops accepting work and waits for the workers to finish what
+* they are running.
+ */
+func (p *WorkerPool) Close() {
+	close(p.tasks)
+	p.wg.Wait()
+}
+
+/*
+* workers reads queue:<name>:workers, falling back to queue:workers.
+ */
+func workers(name string) int {
+	if v, err := config.GetInt("queue:" + name + ":workers"); err == nil {
+		return v
+	}
+	if v, err := config.GetInt("queue:workers"); err == nil {
+		return v
+	}
+	return defaultWorkers
+}
+
+/*
+* waiting reads queue:<name>:waiting, falling back to queue:waiting. The
+* consume loop stops reading the queue while as many messages wait for
+* their turn or a worker, so a burst of messages waits in the queue.
+ */
+func waiting(name string) int {
+	if v, err := config.GetInt("queue:" + name + ":waiting"); err == nil && v > 0 {
+		return v
+	}
+	if v, err := config.GetInt("queue:waiting"); err == nil && v > 0 {
+		return v
+	}
+	return defaultWaiting
+}
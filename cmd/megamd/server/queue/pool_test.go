@@ -0,0 +1,69 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package queue
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestWorkerPoolBoundsConcurrency(c *check.C) {
+	var running, peak int32
+	var mu sync.Mutex
+	pool := NewWorkerPool(2)
+	task := func() {
+		n := atomic.AddInt32(&running, 1)
+		mu.Lock()
+		if n > peak {
+			peak = n
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}
+	for i := 0; i < 6; i++ {
+		pool.Submit(task)
+	}
+	pool.Close()
+	c.Assert(peak, check.Equals, int32(2))
+}
+
+func (s *S) TestWorkerPoolCloseWaitsForWork(c *check.C) {
+	var handled int32
+	pool := NewWorkerPool(3)
+	for i := 0; i < 5; i++ {
+		pool.Submit(func() {
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&handled, 1)
+		})
+	}
+	pool.Close()
+	c.Assert(atomic.LoadInt32(&handled), check.Equals, int32(5))
+}
+
+func (s *S) TestWaitingFallsBackToTheQueueDefault(c *check.C) {
+	c.Assert(waiting("cloudstandup"), check.Equals, defaultWaiting)
+	config.Set("queue:waiting", 8)
+	defer config.Unset("queue:waiting")
+	c.Assert(waiting("cloudstandup"), check.Equals, 8)
+	config.Set("queue:cloudstandup:waiting", 2)
+	defer config.Unset("queue:cloudstandup:waiting")
+	c.Assert(waiting("cloudstandup"), check.Equals, 2)
+}
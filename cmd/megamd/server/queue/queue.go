@@ -16,15 +16,29 @@
 package queue
 
 import (
+	"encoding/json"
+	"sync"
+	"time"
+
 	log "code.google.com/p/log4go"
-	"github.com/megamsys/libgo/amqp"
+	"github.com/megamsys/megamd/bus"
 	"github.com/megamsys/megamd/coordinator"
+	"github.com/megamsys/megamd/global"
 )
 
 type QueueServer struct {
 	ListenAddress string
 	chann         chan []byte
 	shutdown      chan bool
+	quit          chan bool
+	retry         *RetryPolicy
+	bus           bus.MessageBus
+	// the messages waiting for their turn on an assembly.
+	waiting sync.WaitGroup
+	// a slot per message consumed and not handled yet.
+	slots chan struct{}
+	// closed once the last message consumed reserved its turn.
+	reserved chan struct{}
 }
 
 //interface arguments
@@ -36,27 +50,185 @@ func NewServer(listenAddress string) *QueueServer {
 
 	self.ListenAddress = listenAddress
 	self.shutdown = make(chan bool, 1)
+	self.quit = make(chan bool)
+	self.retry = NewRetryPolicy(listenAddress)
+	self.slots = make(chan struct{}, waiting(listenAddress))
+	self.reserved = make(chan struct{})
+	close(self.reserved)
 	log.Info(self)
 	return self
 }
 
 func (self *QueueServer) ListenAndServe() {
-	factor, err := amqp.Factory()
+	b, err := bus.Get()
 	if err != nil {
 		log.Error("Failed to get the queue instance: %s", err)
+		return
 	}
 
-	pubsub, err := factor.Get(self.ListenAddress)
+	msgChan, err := b.Sub(self.ListenAddress)
 	if err != nil {
-		log.Error("Failed to get the queue instance: %s", err)
+		log.Error("Failed to subscribe to %s: %s", self.ListenAddress, err)
+		return
 	}
+	self.bus = b
+	self.chann = msgChan
+
+	pool := NewWorkerPool(workers(self.ListenAddress))
+	defer func() {
+		self.waiting.Wait()
+		pool.Close()
+		self.shutdown <- true
+	}()
 
-	msgChan, _ := pubsub.Sub()
 	for msg := range msgChan {
 		log.Info(" [x] %q", msg)
-		coordinator.NewCoordinator(msg, self.ListenAddress)
+		self.submit(pool, msg)
 	}
+	log.Info("Stopped consuming from %s", self.ListenAddress)
+}
 
-	log.Info("Handling message %v", msgChan)
-	self.chann = msgChan
+/*
+* Stop unsubscribes from the queue and waits for the messages being
+* handled to finish. Messages waiting for their turn or for a retry
+* give up and are recorded as interrupted.
+ */
+func (self *QueueServer) Stop() {
+	close(self.quit)
+	if self.bus == nil {
+		return
+	}
+	if err := self.bus.UnSub(self.ListenAddress); err != nil {
+		log.Error("Failed to unsubscribe from %s: %s", self.ListenAddress, err)
+		return
+	}
+	<-self.shutdown
+}
+
+/*
+* submit takes the turn of the message on its assemblies in the order
+* the messages are consumed, so the operations on an assembly run in the
+* order they were queued. The message is handed to the pool once its
+* turn came, one waiting for it holds no worker. The consume loop blocks
+* while every slot is taken, and the job is recorded as this process's
+* right away, a crash leaves it for another megamd to resume.
+ */
+func (self *QueueServer) submit(pool *WorkerPool, msg []byte) {
+	job := global.NewJob(self.ListenAddress)
+	job.Payload = string(msg)
+	coordinator.Accept(job)
+
+	self.slots <- struct{}{}
+	release := func() { <-self.slots }
+	prev, reserved := self.reserved, make(chan struct{})
+	self.reserved = reserved
+
+	self.waiting.Add(1)
+	go func() {
+		defer self.waiting.Done()
+		keys, ok := self.keys(job, msg)
+		// the messages consumed before take their turn first.
+		<-prev
+		if !ok {
+			close(reserved)
+			release()
+			return
+		}
+		ready, done := coordinator.Reserve(keys)
+		close(reserved)
+		select {
+		case <-ready:
+		case <-self.quit:
+			done()
+			release()
+			coordinator.MarkInterrupted(job)
+			return
+		}
+		pool.Submit(func() {
+			defer release()
+			defer done()
+			self.handle(job, msg)
+		})
+	}()
+}
+
+/*
+* keys reads the assemblies the message works on, retrying as handle
+* does while their records can't be read. It runs off the consume loop,
+* the messages consumed after wait for it to take their turn.
+ */
+func (self *QueueServer) keys(job *global.Job, msg []byte) ([]string, bool) {
+	for attempt := 1; ; attempt++ {
+		keys, err := coordinator.Keys(self.ListenAddress, msg)
+		if err == nil {
+			return keys, true
+		}
+		if attempt >= self.retry.MaxAttempts || coordinator.IsPermanent(err) {
+			coordinator.Reject(job, err)
+			self.deadLetter(job, msg, err, attempt)
+			return nil, false
+		}
+		wait := self.retry.Backoff(attempt)
+		log.Info("Job %s failed to read its assemblies (attempt %d of %d), retrying in %s : %s", job.Id, attempt, self.retry.MaxAttempts, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-self.quit:
+			coordinator.MarkInterrupted(job)
+			return nil, false
+		}
+	}
+}
+
+/*
+* handle runs the message through the coordinator, retrying with backoff
+* as per the queue's retry policy. Once the attempts are exhausted the
+* message is dead-lettered, right away when retrying can't help. The
+* turn on the assemblies is held across the retries.
+ */
+func (self *QueueServer) handle(job *global.Job, msg []byte) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = coordinator.Dispatch(job, msg)
+		if err == nil {
+			return
+		}
+		if attempt >= self.retry.MaxAttempts || coordinator.IsPermanent(err) {
+			self.deadLetter(job, msg, err, attempt)
+			return
+		}
+		wait := self.retry.Backoff(attempt)
+		log.Info("Job %s failed (attempt %d of %d), retrying in %s : %s", job.Id, attempt, self.retry.MaxAttempts, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-self.quit:
+			coordinator.MarkInterrupted(job)
+			return
+		}
+	}
+}
+
+/*
+* deadLetter republishes the payload with the failure reason to the dead
+* letter queue, which doesn't depend on riak being up. The record stored
+* in riak lists it for replay.
+ */
+func (self *QueueServer) deadLetter(job *global.Job, msg []byte, reason error, attempts int) {
+	log.Error("Job %s gave up after %d attempts, dead-lettering : %s", job.Id, attempts, reason)
+
+	dl := global.NewDeadLetter(self.ListenAddress, job, msg, reason, attempts)
+	published := true
+	if out, err := json.Marshal(dl); err != nil {
+		published = false
+		log.Error("Failed to encode the dead letter %s : %s", dl.Id, err)
+	} else if err := self.bus.Pub(DeadLetterQueue(self.ListenAddress), out); err != nil {
+		published = false
+		log.Error("Failed to publish the dead letter %s to the dead letter queue : %s", dl.Id, err)
+	}
+	if err := dl.Store(); err != nil {
+		if published {
+			log.Error("Failed to list the dead letter %s, it is on %s only : %s", dl.Id, DeadLetterQueue(self.ListenAddress), err)
+		} else {
+			log.Error("Failed to store the dead letter %s, the message is lost : %s\n%s", dl.Id, err, msg)
+		}
+	}
 }
@@ -0,0 +1,97 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package queue
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/tsuru/config"
+)
+
+const (
+	defaultMaxAttempts = 5
+	defaultInitialMs   = 1000
+	defaultMaxMs       = 60000
+	defaultMultiplier  = 2
+	defaultJitter      = 20
+)
+
+/*
+* RetryPolicy decides how often and how far apart a failed message is
+* handled again before it is dead-lettered.
+ */
+type RetryPolicy struct {
+	MaxAttempts int
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  int
+	// Jitter is the percentage of the backoff randomly added or removed.
+	Jitter int
+}
+
+/*
+* NewRetryPolicy reads queue:<name>:retry:* from the conf file, falling
+* back to queue:retry:* and then to the defaults.
+*
+*   queue:
+*     retry:
+*       max_attempts: 5
+*       initial_ms: 1000
+*       max_ms: 60000
+*       multiplier: 2
+*       jitter: 20
+ */
+func NewRetryPolicy(name string) *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: retryInt(name, "max_attempts", defaultMaxAttempts),
+		Initial:     time.Duration(retryInt(name, "initial_ms", defaultInitialMs)) * time.Millisecond,
+		Max:         time.Duration(retryInt(name, "max_ms", defaultMaxMs)) * time.Millisecond,
+		Multiplier:  retryInt(name, "multiplier", defaultMultiplier),
+		Jitter:      retryInt(name, "jitter", defaultJitter),
+	}
+}
+
+func retryInt(name string, key string, def int) int {
+	if v, err := config.GetInt("queue:" + name + ":retry:" + key); err == nil {
+		return v
+	}
+	if v, err := config.GetInt("queue:retry:" + key); err == nil {
+		return v
+	}
+	return def
+}
+
+/*
+* Backoff returns how long to wait after the given (1 based) attempt
+* failed: initial * multiplier^(attempt-1), capped at max, +/- jitter.
+ */
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.Initial
+	for i := 1; i < attempt && d < p.Max; i++ {
+		d = d * time.Duration(p.Multiplier)
+	}
+	if d > p.Max {
+		d = p.Max
+	}
+	if p.Jitter > 0 && d > 0 {
+		spread := int64(d) * int64(p.Jitter) / 100
+		if spread > 0 {
+			d = d - time.Duration(spread) + time.Duration(rand.Int63n(2*spread+1))
+		}
+	}
+	return d
+}
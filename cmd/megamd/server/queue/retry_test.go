@@ -0,0 +1,63 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+*/
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestBackoffGrowsExponentially(c *check.C) {
+	p := &RetryPolicy{MaxAttempts: 5, Initial: time.Second, Max: time.Minute, Multiplier: 2}
+	c.Assert(p.Backoff(1), check.Equals, time.Second)
+	c.Assert(p.Backoff(2), check.Equals, 2*time.Second)
+	c.Assert(p.Backoff(4), check.Equals, 8*time.Second)
+}
+
+func (s *S) TestBackoffIsCapped(c *check.C) {
+	p := &RetryPolicy{MaxAttempts: 20, Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+	c.Assert(p.Backoff(10), check.Equals, 10*time.Second)
+}
+
+func (s *S) TestBackoffJitterStaysInRange(c *check.C) {
+	p := &RetryPolicy{MaxAttempts: 5, Initial: time.Second, Max: time.Minute, Multiplier: 2, Jitter: 20}
+	for i := 0; i < 50; i++ {
+		d := p.Backoff(2)
+		c.Assert(d >= 1600*time.Millisecond, check.Equals, true)
+		c.Assert(d <= 2400*time.Millisecond, check.Equals, true)
+	}
+}
+
+func (s *S) TestReplayRefusesTheMemoryBus(c *check.C) {
+	config.Set("queue:bus", "memory")
+	defer config.Unset("queue:bus")
+	c.Assert(Replay("DLQ1"), check.Equals, ErrInProcessBus)
+}
+
+func (s *S) TestDeadLetterQueue(c *check.C) {
+	c.Assert(DeadLetterQueue("cloudstandup"), check.Equals, "cloudstandup_dlq")
+}
@@ -16,16 +16,20 @@
 package server
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	log "code.google.com/p/log4go"
-	"github.com/megamsys/libgo/amqp"
-	"github.com/megamsys/libgo/db"
 	"github.com/megamsys/megamd/api/http"
+	"github.com/megamsys/megamd/bus"
 	"github.com/megamsys/megamd/cmd/megamd/server/queue"
+	"github.com/megamsys/megamd/coordinator"
 	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/ipam"
+	"github.com/megamsys/megamd/provisioner/docker"
+	"github.com/megamsys/megamd/storage"
 	"github.com/tsuru/config"
 )
 
@@ -53,17 +57,21 @@ func NewServer() (*Server, error) {
 func (self *Server) ListenAndServe() error {
 	log.Info("Starting admin interface on port")
 	//var etcdServerList [2]string
-	var queueInput [3]string
+	var queueInput [4]string
 	queueInput[0] = "cloudstandup"
 	queueInput[1] = "events"
 	queueInput[2] = "dockerstate"
+	queueInput[3] = "bind"
 	self.Checker()
 	self.IPInit()
+	coordinator.StartHeartbeat()
+	docker.StartMonitor()
 
 	// Queue input
 	for i := range queueInput {
 		listenQueue := queueInput[i]
 		queueserver := queue.NewServer(listenQueue)
+		self.QueueServers = append(self.QueueServers, queueserver)
 		go queueserver.ListenAndServe()
 	}
 	self.HttpApi.ListenAndServe()
@@ -76,68 +84,105 @@ type Connection struct {
 }
 
 func (self *Server) Checker() {
-	log.Info("verifying rabbitmq")
-	factor, err := amqp.Factory()
+	log.Info("verifying message bus")
+	b, err := bus.Get()
 	if err != nil {
-		log.Error("Error: %v\nFailed to get the queue", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n Please check queue:bus in the conf file.\n", err)
+		os.Exit(1)
 	}
 
-	_, connerr := factor.Dial()
+	connerr := b.Ping()
 	if connerr != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n Please start rabbitmq service.\n", connerr)
 		os.Exit(1)
 	}
-	log.Info("rabbitmq connected [ok]")
+	log.Info("message bus connected [ok]")
 
-	log.Info("verifying riak")
+	log.Info("verifying storage")
 
-	rconn, rerr := db.Conn("connection")
+	repo, rerr := storage.Get()
 	if rerr != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n Please start Riak service.\n", rerr)
+		fmt.Fprintf(os.Stderr, "Error: %v\n Please check the storage section of the conf file.\n", rerr)
 		os.Exit(1)
 	}
 
-	data := "sampledata"
-	ferr := rconn.StoreObject("sampleobject", data)
+	ferr := repo.Ping()
 	if ferr != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n Please start Riak service.\n", ferr)
 		os.Exit(1)
 	}
-	defer rconn.Close()
-	log.Info("riak connected [ok]")
+	log.Info("storage connected [ok]")
 
 }
 
+/*
+* IPInit creates the ip pools of the conf file. The addresses handed out
+* by the old ip index (ipindex/ipgen) stay reserved in the default pool.
+ */
 func (self *Server) IPInit() {
-
-	rconn, rerr := db.Conn("ipindex")
-	if rerr != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n Please start Riak service.\n", rerr)
-		os.Exit(1)
+	var handedOut uint
+	index := global.IPIndex{}
+	if old, err := index.Get(global.IPINDEXKEY); err == nil {
+		handedOut = old.Index
 	}
 
-	index := global.IPIndex{}
-	subnet, _ := config.GetString("swarm:subnet")
-	_, err := index.Get(global.IPINDEXKEY)
-	if err != nil {
-		data := &global.IPIndex{Ip: subnet, Subnet: subnet, Index: 1}
-		res2B, _ := json.Marshal(data)
-		ferr := rconn.StoreObject(global.IPINDEXKEY, string(res2B))
-		if ferr != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n Please start Riak service.\n", ferr)
+	for _, name := range ipam.PoolNames() {
+		reserved := uint(0)
+		if name == ipam.DEFAULTPOOL {
+			reserved = handedOut
+		}
+		if ierr := ipam.Init(name, reserved); ierr != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n Please check the ipam section of the conf file.\n", ierr)
 			os.Exit(1)
 		}
 	}
-
-	defer rconn.Close()
 }
 
+/*
+* Stop stops consuming from every queue and waits, at most
+* shutdown:timeout seconds, for the jobs in flight. Jobs that didn't
+* finish by then are recorded as interrupted. The api goes last as
+* ListenAndServe returns once it is closed.
+ */
 func (self *Server) Stop() {
 	if self.stopped {
 		return
 	}
 	log.Info("Bye. tata.")
 	self.stopped = true
-	//self.HttpApi.Close()
+	docker.StopMonitor()
+	coordinator.Drain()
+
+	drained := make(chan bool)
+	go func() {
+		var wg sync.WaitGroup
+		for _, q := range self.QueueServers {
+			wg.Add(1)
+			go func(q *queue.QueueServer) {
+				defer wg.Done()
+				q.Stop()
+			}(q)
+		}
+		wg.Wait()
+		close(drained)
+	}()
+
+	timeout := shutdownTimeout()
+	select {
+	case <-drained:
+		log.Info("All jobs finished")
+	case <-time.After(timeout):
+		log.Info("Jobs didn't finish in %s, marking them interrupted", timeout)
+		coordinator.Interrupt()
+	}
+	coordinator.StopHeartbeat()
+	self.HttpApi.Close()
+}
 
+func shutdownTimeout() time.Duration {
+	secs, err := config.GetInt("shutdown:timeout")
+	if err != nil || secs <= 0 {
+		secs = 60
+	}
+	return time.Duration(secs) * time.Second
 }
@@ -0,0 +1,464 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package compose
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/provisioner/docker"
+	"gopkg.in/yaml.v2"
+)
+
+// the tosca type of the components a compose file turns into.
+const COMPONENTTYPE = "tosca.addon.containers"
+
+/*
+* Issue is a key of the compose file megamd can't honour, or a value it
+* can't make sense of.
+ */
+type Issue struct {
+	Service string `json:"service,omitempty"`
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+/*
+* Report lists what the translation of a compose file left out. The
+* unsupported keys are skipped, a file with errors isn't imported.
+ */
+type Report struct {
+	Services    []string `json:"services"`
+	Unsupported []Issue  `json:"unsupported"`
+	Errors      []Issue  `json:"errors"`
+}
+
+func (r *Report) Valid() bool {
+	return len(r.Errors) == 0
+}
+
+func (r *Report) unsupported(service string, key string, format string, args ...interface{}) {
+	r.Unsupported = append(r.Unsupported, Issue{Service: service, Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *Report) fail(service string, key string, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, Issue{Service: service, Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+/*
+* Translate turns the services of the compose file into the components
+* the docker provisioner launches, named after the services and in the
+* domain given.
+ */
+func Translate(data string, domain string) ([]*global.Component, *Report) {
+	report := &Report{Services: []string{}, Unsupported: []Issue{}, Errors: []Issue{}}
+	checkDomain(report, domain)
+	file := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal([]byte(data), &file); err != nil {
+		report.fail("", "", "not a compose file : %s", err)
+		return nil, report
+	}
+
+	/*
+	 * a file without services and version is the first format, the
+	 * services are at the top.
+	 */
+	services := file
+	_, versioned := file["version"]
+	if s, ok := file["services"]; ok || versioned {
+		services, _ = s.(map[interface{}]interface{})
+		for _, key := range sortedKeys(file) {
+			switch key {
+			case "version", "services":
+			case "volumes":
+				topVolumes(report, file[key])
+			default:
+				report.unsupported("", fmt.Sprint(key), "top level %s are not supported", key)
+			}
+		}
+	}
+	if len(services) == 0 {
+		report.fail("", "services", "the file declares no service")
+		return nil, report
+	}
+
+	names := sortedKeys(services)
+	report.Services = names
+
+	components := make([]*global.Component, 0, len(names))
+	for _, name := range names {
+		def, ok := services[name].(map[interface{}]interface{})
+		if !ok {
+			report.fail(name, "", "the service is not a mapping")
+			continue
+		}
+		com := &global.Component{
+			Id:                "COM" + global.RandString(19),
+			Name:              name,
+			ToscaType:         COMPONENTTYPE,
+			Inputs:            []*global.KeyValuePair{global.GetKeyValuePair("domain", domain)},
+			Outputs:           []*global.KeyValuePair{},
+			Artifacts:         &global.Artifacts{ArtifactRequirements: []*global.KeyValuePair{}},
+			RelatedComponents: []string{},
+			Operations:        []*global.Operations{},
+		}
+		service(report, com, def, services)
+		validate(report, com)
+		components = append(components, com)
+	}
+	if report.Valid() {
+		// the components are launched in dependency order, a cycle has none.
+		asm := &global.AssemblyWithComponents{Components: components}
+		if _, err := asm.OrderedComponents(); err != nil {
+			if cycle, ok := err.(*global.CycleError); ok {
+				report.fail(cycle.Component, "depends_on", "the services depend on each other in a cycle through %s", cycle.Component)
+			} else {
+				report.fail("", "depends_on", "%s", err)
+			}
+		}
+	}
+	if !report.Valid() {
+		return nil, report
+	}
+	return components, report
+}
+
+/*
+* the named volumes are created by the provisioner, their options are
+* not passed on.
+ */
+func topVolumes(report *Report, value interface{}) {
+	volumes, _ := value.(map[interface{}]interface{})
+	for _, name := range sortedKeys(volumes) {
+		if opts, ok := volumes[name].(map[interface{}]interface{}); ok {
+			for _, key := range sortedKeys(opts) {
+				report.unsupported("", fmt.Sprintf("volumes.%s.%s", name, key), "volume options are not supported, docker:volume_driver creates the volumes")
+			}
+		}
+	}
+}
+
+func service(report *Report, com *global.Component, def map[interface{}]interface{}, services map[interface{}]interface{}) {
+	name := com.Name
+	input := func(key string, value string) {
+		com.Inputs = append(com.Inputs, global.GetKeyValuePair(key, value))
+	}
+
+	for _, key := range sortedKeys(def) {
+		value := def[key]
+		switch key {
+		case "image":
+			input("source", fmt.Sprint(value))
+		case "ports":
+			if specs := ports(report, name, value); len(specs) > 0 {
+				input("ports", strings.Join(specs, ","))
+			}
+		case "environment":
+			for _, kv := range environment(report, name, value) {
+				input("env."+kv[0], kv[1])
+			}
+		case "volumes":
+			if specs := volumes(report, name, value); len(specs) > 0 {
+				input("volumes", strings.Join(specs, ","))
+			}
+		case "depends_on":
+			for _, dep := range dependencies(value) {
+				if _, ok := services[dep]; !ok {
+					report.fail(name, key, "%s is not a service of the file", dep)
+					continue
+				}
+				com.RelatedComponents = append(com.RelatedComponents, dep)
+			}
+		case "scale":
+			input("replicas", fmt.Sprint(value))
+		case "deploy":
+			deploy(report, name, value, input)
+		case "mem_limit":
+			input("memory", size(value))
+		case "cpus":
+			input("cpu", fmt.Sprint(value))
+		case "cpu_shares":
+			input("cpushares", fmt.Sprint(value))
+		case "cpu_quota":
+			input("cpuquota", fmt.Sprint(value))
+		case "cpu_period":
+			input("cpuperiod", fmt.Sprint(value))
+		case "pids_limit":
+			input("pidslimit", fmt.Sprint(value))
+		case "healthcheck":
+			healthcheck(report, name, value, input)
+		case "build":
+			if _, ok := def["image"]; !ok {
+				report.fail(name, key, "images are not built, the service needs an image")
+			} else {
+				report.unsupported(name, key, "images are not built, %s is pulled", def["image"])
+			}
+		default:
+			report.unsupported(name, key, "%s is not supported", key)
+		}
+	}
+	if _, ok := def["image"]; !ok {
+		if _, build := def["build"]; !build {
+			report.fail(name, "image", "the service has no image")
+		}
+	}
+}
+
+/*
+* ports are [[ip:]hostport:]port[/proto] or the long syntax.
+ */
+func ports(report *Report, name string, value interface{}) []string {
+	list, _ := value.([]interface{})
+	specs := []string{}
+	for _, entry := range list {
+		if long, ok := entry.(map[interface{}]interface{}); ok {
+			spec := fmt.Sprint(long["target"])
+			if published, ok := long["published"]; ok {
+				spec = fmt.Sprint(published) + ":" + spec
+			}
+			if proto, ok := long["protocol"]; ok {
+				spec += "/" + fmt.Sprint(proto)
+			}
+			if _, ok := long["mode"]; ok {
+				report.unsupported(name, "ports.mode", "the port mode of %s is not supported", spec)
+			}
+			specs = append(specs, spec)
+			continue
+		}
+		spec := fmt.Sprint(entry)
+		if parts := strings.Split(spec, ":"); len(parts) == 3 {
+			report.unsupported(name, "ports", "the host ip of %s is not supported, every address is bound", spec)
+			spec = parts[1] + ":" + parts[2]
+		}
+		if strings.Contains(spec, "-") {
+			report.fail(name, "ports", "port ranges like %s are not supported", spec)
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+/*
+* environment is a list of NAME=value or a mapping. A name without a
+* value would be read from the shell compose runs in.
+ */
+func environment(report *Report, name string, value interface{}) [][2]string {
+	vars := [][2]string{}
+	switch env := value.(type) {
+	case []interface{}:
+		for _, entry := range env {
+			kv := strings.SplitN(fmt.Sprint(entry), "=", 2)
+			if len(kv) != 2 {
+				report.unsupported(name, "environment", "%s has no value, the shell environment is not read", kv[0])
+				continue
+			}
+			vars = append(vars, [2]string{kv[0], kv[1]})
+		}
+	case map[interface{}]interface{}:
+		for _, k := range sortedKeys(env) {
+			if env[k] == nil {
+				report.unsupported(name, "environment", "%s has no value, the shell environment is not read", k)
+				continue
+			}
+			vars = append(vars, [2]string{k, fmt.Sprint(env[k])})
+		}
+	}
+	return vars
+}
+
+/*
+* volumes are [source:]target[:ro|rw] or the long syntax, host paths are
+* absolute.
+ */
+func volumes(report *Report, name string, value interface{}) []string {
+	list, _ := value.([]interface{})
+	specs := []string{}
+	for _, entry := range list {
+		spec := ""
+		if long, ok := entry.(map[interface{}]interface{}); ok {
+			spec = fmt.Sprint(long["target"])
+			if source, ok := long["source"]; ok {
+				spec = fmt.Sprint(source) + ":" + spec
+			}
+			if ro, _ := long["read_only"].(bool); ro {
+				spec += ":ro"
+			}
+		} else {
+			spec = strings.TrimSuffix(fmt.Sprint(entry), ":rw")
+		}
+		if strings.HasPrefix(spec, ".") || strings.HasPrefix(spec, "~") {
+			report.fail(name, "volumes", "%s : relative host paths are not supported", spec)
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+func dependencies(value interface{}) []string {
+	deps := []string{}
+	switch d := value.(type) {
+	case []interface{}:
+		for _, dep := range d {
+			deps = append(deps, fmt.Sprint(dep))
+		}
+	case map[interface{}]interface{}:
+		deps = sortedKeys(d)
+	}
+	return deps
+}
+
+/*
+* deploy gives the replicas and the resource limits.
+ */
+func deploy(report *Report, name string, value interface{}, input func(string, string)) {
+	def, _ := value.(map[interface{}]interface{})
+	for _, key := range sortedKeys(def) {
+		v := def[key]
+		switch key {
+		case "replicas":
+			input("replicas", fmt.Sprint(v))
+		case "resources":
+			res, _ := v.(map[interface{}]interface{})
+			for _, kind := range sortedKeys(res) {
+				if kind != "limits" {
+					report.unsupported(name, fmt.Sprintf("deploy.resources.%s", kind), "only the limits are supported")
+					continue
+				}
+				l, _ := res[kind].(map[interface{}]interface{})
+				for _, lk := range sortedKeys(l) {
+					lv := l[lk]
+					switch lk {
+					case "cpus":
+						input("cpu", fmt.Sprint(lv))
+					case "memory":
+						input("memory", size(lv))
+					default:
+						report.unsupported(name, fmt.Sprintf("deploy.resources.limits.%s", lk), "%s is not supported", lk)
+					}
+				}
+			}
+		default:
+			report.unsupported(name, fmt.Sprintf("deploy.%s", key), "%s is not supported", key)
+		}
+	}
+}
+
+/*
+* healthcheck runs its test in the container, the monitor checks every
+* docker:health_interval.
+ */
+func healthcheck(report *Report, name string, value interface{}, input func(string, string)) {
+	def, _ := value.(map[interface{}]interface{})
+	if disabled, _ := def["disable"].(bool); disabled {
+		return
+	}
+	for _, key := range sortedKeys(def) {
+		v := def[key]
+		switch key {
+		case "test":
+			cmd := ""
+			switch test := v.(type) {
+			case string:
+				cmd = test
+			case []interface{}:
+				words := make([]string, 0, len(test))
+				for _, w := range test {
+					words = append(words, fmt.Sprint(w))
+				}
+				if len(words) > 0 && words[0] == "NONE" {
+					return
+				}
+				if len(words) > 0 && (words[0] == "CMD" || words[0] == "CMD-SHELL") {
+					words = words[1:]
+				}
+				cmd = strings.Join(words, " ")
+			}
+			input("health_check", "cmd:"+cmd)
+		case "retries":
+			input("health_retries", fmt.Sprint(v))
+		default:
+			report.unsupported(name, fmt.Sprintf("healthcheck.%s", key), "%s is not supported, the monitor checks every docker:health_interval", key)
+		}
+	}
+}
+
+/*
+* size turns a compose size (512m, 1gb, 1073741824) into one of the
+* provisioner.
+ */
+func size(value interface{}) string {
+	s := strings.ToLower(strings.TrimSpace(fmt.Sprint(value)))
+	if len(s) > 2 && strings.HasSuffix(s, "b") && strings.ContainsAny(s[len(s)-2:len(s)-1], "kmg") {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+/*
+* validate hands the component to the provisioner checks, a value it
+* refuses is an error of the service.
+ */
+func validate(report *Report, com *global.Component) {
+	if _, err := docker.ComponentPorts(com); err != nil {
+		report.fail(com.Name, "ports", "%s", err)
+	}
+	if _, err := docker.ComponentVolumes("", com); err != nil {
+		report.fail(com.Name, "volumes", "%s", err)
+	}
+	if _, err := docker.ComponentReplicas(com); err != nil {
+		report.fail(com.Name, "replicas", "%s", err)
+	}
+	if _, err := docker.ComponentResources(com); err != nil {
+		report.fail(com.Name, "resources", "%s", err)
+	}
+	if _, err := docker.ComponentHealthCheck(com); err != nil {
+		report.fail(com.Name, "healthcheck", "%s", err)
+	}
+	if pair, err := global.ParseKeyValuePair(com.Inputs, "health_retries"); err == nil {
+		if n, aerr := strconv.Atoi(pair.Value); aerr != nil || n < 1 {
+			report.fail(com.Name, "healthcheck.retries", "%s is not a number of retries", pair.Value)
+		}
+	}
+}
+
+/*
+* checkDomain refuses a domain the host names of the containers can't be
+* set up in, the provisioner wants the name.tld form.
+ */
+func checkDomain(report *Report, domain string) {
+	if strings.TrimSpace(domain) == "" {
+		report.fail("", "domain", "the assembly has no domain")
+		return
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) != 2 || labels[0] == "" || labels[1] == "" || strings.ContainsAny(domain, " \t/:") {
+		report.fail("", "domain", "%s is not a domain of the name.tld form", domain)
+	}
+}
+
+func sortedKeys(m map[interface{}]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, fmt.Sprint(k))
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,245 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package compose
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/storage"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	config.Set("storage:backend", "file")
+	config.Set("storage:path", filepath.Join(c.MkDir(), "megamd.db"))
+}
+
+const wordpress = `
+version: "3"
+services:
+  db:
+    image: mysql:5.7
+    volumes:
+      - dbdata:/var/lib/mysql
+    environment:
+      MYSQL_ROOT_PASSWORD: secret
+      MYSQL_DATABASE: wordpress
+    restart: always
+    healthcheck:
+      test: ["CMD", "mysqladmin", "ping"]
+      retries: 5
+      interval: 10s
+  web:
+    image: wordpress:latest
+    depends_on:
+      - db
+    ports:
+      - "8000:80"
+      - target: 443
+        published: 8443
+        protocol: tcp
+    environment:
+      - WORDPRESS_DB_HOST=db:3306
+      - DEBUG
+    deploy:
+      replicas: 2
+      resources:
+        limits:
+          cpus: "0.5"
+          memory: 512M
+volumes:
+  dbdata: {}
+networks:
+  front: {}
+`
+
+func inputs(com *global.Component) map[string]string {
+	m := map[string]string{}
+	for _, kv := range com.Inputs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func (s *S) TestTranslate(c *check.C) {
+	components, report := Translate(wordpress, "megam.co")
+	c.Assert(report.Errors, check.HasLen, 0)
+	c.Assert(report.Services, check.DeepEquals, []string{"db", "web"})
+	c.Assert(components, check.HasLen, 2)
+
+	db, web := components[0], components[1]
+	c.Assert(db.Name, check.Equals, "db")
+	c.Assert(db.ToscaType, check.Equals, COMPONENTTYPE)
+	c.Assert(inputs(db), check.DeepEquals, map[string]string{
+		"domain":                  "megam.co",
+		"source":                  "mysql:5.7",
+		"volumes":                 "dbdata:/var/lib/mysql",
+		"env.MYSQL_DATABASE":      "wordpress",
+		"env.MYSQL_ROOT_PASSWORD": "secret",
+		"health_check":            "cmd:mysqladmin ping",
+		"health_retries":          "5",
+	})
+	c.Assert(inputs(web), check.DeepEquals, map[string]string{
+		"domain":                "megam.co",
+		"source":                "wordpress:latest",
+		"ports":                 "8000:80,8443:443/tcp",
+		"env.WORDPRESS_DB_HOST": "db:3306",
+		"replicas":              "2",
+		"cpu":                   "0.5",
+		"memory":                "512m",
+	})
+	c.Assert(web.RelatedComponents, check.DeepEquals, []string{"db"})
+
+	unsupported := []string{}
+	for _, issue := range report.Unsupported {
+		unsupported = append(unsupported, issue.Service+":"+issue.Key)
+	}
+	c.Assert(unsupported, check.DeepEquals, []string{
+		":networks", "db:healthcheck.interval", "db:restart", "web:environment",
+	})
+}
+
+func (s *S) TestTranslateFirstFormat(c *check.C) {
+	components, report := Translate("web:\n  image: nginx\n  ports:\n    - \"127.0.0.1:80:80\"\n", "megam.co")
+	c.Assert(report.Valid(), check.Equals, true)
+	c.Assert(inputs(components[0])["ports"], check.Equals, "80:80")
+	c.Assert(report.Unsupported, check.HasLen, 1)
+}
+
+func (s *S) TestTranslateErrors(c *check.C) {
+	components, report := Translate(`
+services:
+  web:
+    build: .
+    depends_on: [cache]
+    volumes:
+      - ./html:/usr/share/nginx/html
+    ports:
+      - "8000-8005:80"
+  api:
+    image: api
+    scale: none
+`, "megam.co")
+	c.Assert(components, check.IsNil)
+	c.Assert(report.Valid(), check.Equals, false)
+
+	errors := []string{}
+	for _, issue := range report.Errors {
+		errors = append(errors, issue.Service+":"+issue.Key)
+	}
+	c.Assert(errors, check.DeepEquals, []string{"api:replicas", "web:build", "web:depends_on", "web:ports", "web:volumes"})
+
+	_, report = Translate("services: [web]", "megam.co")
+	c.Assert(report.Valid(), check.Equals, false)
+}
+
+func (s *S) TestTranslateDomain(c *check.C) {
+	for domain, message := range map[string]string{
+		"":           "the assembly has no domain",
+		"megam":      "megam is not a domain of the name.tld form",
+		"megam.co.":  "megam.co. is not a domain of the name.tld form",
+		"a.megam.co": "a.megam.co is not a domain of the name.tld form",
+	} {
+		components, report := Translate("web:\n  image: nginx\n", domain)
+		c.Assert(components, check.IsNil)
+		c.Assert(report.Errors, check.HasLen, 1)
+		c.Assert(report.Errors[0].Key, check.Equals, "domain")
+		c.Assert(report.Errors[0].Message, check.Equals, message)
+	}
+}
+
+func (s *S) TestTranslateDependencyCycle(c *check.C) {
+	components, report := Translate(`
+services:
+  web:
+    image: nginx
+    depends_on: [api]
+  api:
+    image: api
+    depends_on: [web]
+`, "megam.co")
+	c.Assert(components, check.IsNil)
+	c.Assert(report.Errors, check.HasLen, 1)
+	c.Assert(report.Errors[0].Key, check.Equals, "depends_on")
+	c.Assert(report.Errors[0].Message, check.Matches, "the services depend on each other in a cycle through (api|web)")
+}
+
+func (s *S) TestImport(c *check.C) {
+	asm := &global.Assembly{Id: "ASM81", Name: "blog", Components: []string{""}, Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair("domain", "megam.co"),
+		global.GetKeyValuePair(COMPOSEINPUT, wordpress),
+	}}
+	c.Assert(asm.Store(), check.IsNil)
+
+	report, err := Import("ASM81")
+	c.Assert(err, check.IsNil)
+	c.Assert(report.Valid(), check.Equals, true)
+
+	stored, err := (&global.Assembly{}).Get("ASM81")
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Components, check.HasLen, 2)
+	pair, err := global.ParseKeyValuePair(stored.Outputs, REPORTOUTPUT)
+	c.Assert(err, check.IsNil)
+	again := &Report{}
+	c.Assert(json.Unmarshal([]byte(pair.Value), again), check.IsNil)
+	c.Assert(again.Services, check.DeepEquals, []string{"db", "web"})
+
+	withComponents, err := stored.GetAssemblyWithComponents("ASM81")
+	c.Assert(err, check.IsNil)
+	ordered, err := withComponents.OrderedComponents()
+	c.Assert(err, check.IsNil)
+	c.Assert(ordered[0].Name, check.Equals, "db")
+
+	// the components are imported once.
+	report, err = Import("ASM81")
+	c.Assert(err, check.IsNil)
+	c.Assert(report, check.IsNil)
+}
+
+func (s *S) TestImportInvalid(c *check.C) {
+	asm := &global.Assembly{Id: "ASM82", Name: "broken", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair("domain", "megam.co"),
+		global.GetKeyValuePair(COMPOSEINPUT, "services:\n  web:\n    ports: [\"80\"]\n"),
+	}}
+	c.Assert(asm.Store(), check.IsNil)
+
+	_, err := Import("ASM82")
+	c.Assert(err, check.FitsTypeOf, &InvalidError{})
+	c.Assert(err, check.ErrorMatches, "compose file of assembly broken is invalid : web image : the service has no image")
+
+	stored, _ := (&global.Assembly{}).Get("ASM82")
+	c.Assert(stored.Components, check.HasLen, 0)
+}
+
+func (s *S) TestDiscardDeletesTheComponents(c *check.C) {
+	com := &global.Component{Id: "COM83", Name: "web"}
+	c.Assert(com.Store(), check.IsNil)
+	discard([]string{"COM83"})
+	_, err := (&global.Component{}).Get("COM83")
+	c.Assert(storage.IsNotFound(err), check.Equals, true)
+}
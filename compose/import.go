@@ -0,0 +1,137 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package compose
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/global"
+)
+
+const (
+	// the assembly input holding the compose file.
+	COMPOSEINPUT = "compose"
+	// the assembly output the report of the import is stored in.
+	REPORTOUTPUT = "compose_report"
+)
+
+// the assembly got its components while the compose file was imported.
+var errImported = errors.New("the compose file was imported already")
+
+/*
+* InvalidError is returned for a compose file that wasn't imported, the
+* report says why.
+ */
+type InvalidError struct {
+	Assembly string
+	Report   *Report
+}
+
+func (e *InvalidError) Error() string {
+	msgs := make([]string, 0, len(e.Report.Errors))
+	for _, issue := range e.Report.Errors {
+		msgs = append(msgs, strings.TrimPrefix(issue.Service+" "+issue.Key+" : "+issue.Message, " "))
+	}
+	return fmt.Sprintf("compose file of assembly %s is invalid : %s", e.Assembly, strings.Join(msgs, ", "))
+}
+
+/*
+* Import turns the compose file of the assembly into its components,
+* once. An assembly without a compose file, or whose components exist,
+* is left as it is. The report is stored in the assembly outputs. It runs
+* in the turn of the assembly, the components are checked again when the
+* assembly is stored in case another megamd imported the file meanwhile.
+ */
+func Import(assemblyId string) (*Report, error) {
+	asm := &global.Assembly{}
+	if _, err := asm.Get(assemblyId); err != nil {
+		return nil, err
+	}
+	pair, err := global.ParseKeyValuePair(asm.Inputs, COMPOSEINPUT)
+	if err != nil || strings.TrimSpace(pair.Value) == "" {
+		return nil, nil
+	}
+	for _, id := range asm.Components {
+		if strings.TrimSpace(id) != "" {
+			return nil, nil
+		}
+	}
+
+	domain := ""
+	if d, derr := global.ParseKeyValuePair(asm.Inputs, "domain"); derr == nil {
+		domain = d.Value
+	}
+	components, report := Translate(pair.Value, domain)
+	for _, issue := range report.Unsupported {
+		log.Warn("compose file of %s : %s %s : %s", asm.Name, issue.Service, issue.Key, issue.Message)
+	}
+
+	ids := []string{}
+	if report.Valid() {
+		for _, com := range components {
+			if serr := com.Store(); serr != nil {
+				discard(ids)
+				return report, serr
+			}
+			ids = append(ids, com.Id)
+		}
+	}
+
+	out, _ := json.Marshal(report)
+	_, err = global.UpdateAssembly(assemblyId, func(stored *global.Assembly) error {
+		for _, id := range stored.Components {
+			if strings.TrimSpace(id) != "" {
+				return errImported
+			}
+		}
+		stored.SetOutput(REPORTOUTPUT, string(out))
+		if report.Valid() {
+			stored.Components = ids
+		}
+		return nil
+	})
+	if err != nil {
+		discard(ids)
+	}
+	if err == errImported {
+		log.Warn("compose file of %s was imported meanwhile", asm.Name)
+		return nil, nil
+	}
+	if err != nil {
+		return report, err
+	}
+	if !report.Valid() {
+		return report, &InvalidError{Assembly: asm.Name, Report: report}
+	}
+	log.Info("compose file of %s imported, %d components", asm.Name, len(ids))
+	return report, nil
+}
+
+/*
+* discard deletes the components stored by an import the assembly never
+* got.
+ */
+func discard(ids []string) {
+	for _, id := range ids {
+		if err := global.DeleteComponent(id); err != nil {
+			log.Error("Failed to delete the unused component %s : %s", id, err)
+		}
+	}
+}
@@ -17,9 +17,13 @@ package coordinator
 
 import (
 	"encoding/json"
+	"fmt"
+	"sync"
 
 	log "code.google.com/p/log4go"
 	"github.com/megamsys/megamd/app"
+	"github.com/megamsys/megamd/app/bind"
+	"github.com/megamsys/megamd/compose"
 	"github.com/megamsys/megamd/global"
 	"github.com/megamsys/megamd/iaas/megam"
 	"github.com/megamsys/megamd/plugins"
@@ -42,9 +46,13 @@ type Message struct {
 	Args   string `json:"Args"`
 }
 
+// serializes the operations on an assembly, a delete waits for the create.
+var assemblyExecutor = NewKeyedExecutor()
+
 func init() {
 	chef.Init()
 	docker.Init()
+	docker.Serialize = assemblyExecutor.Run
 	cmp.Init()
 	github.Init()
 	gitlab.Init()
@@ -52,30 +60,150 @@ func init() {
 	megam.Init()
 }
 
-func NewCoordinator(chann []byte, queue string) {
-	log.Info("Handling coordinator message %v", string(chann))
+func NewCoordinator(chann []byte, queue string) error {
+	return dispatchInTurn(global.NewJob(queue), chann)
+}
 
+/*
+* Keys reads the assemblies a message consumed from the queue works on.
+* The turns on them are taken with Reserve before it is dispatched, so
+* the operations on an assembly run in the order they were consumed.
+ */
+func Keys(queue string, chann []byte) ([]string, error) {
 	switch queue {
 	case "cloudstandup":
-		requestHandler(chann)
+		m := &global.Message{}
+		if err := json.Unmarshal(chann, &m); err != nil {
+			return nil, permanent(err)
+		}
+		request := global.Request{Id: m.Id}
+		req, err := request.Get(m.Id)
+		if err != nil {
+			return nil, err
+		}
+		if req.ReqType != "create" {
+			return []string{req.AssembliesId}, nil
+		}
+		assemblies := global.Assemblies{Id: req.AssembliesId}
+		asm, err := assemblies.Get(req.AssembliesId)
+		if err != nil {
+			return nil, err
+		}
+		keys := []string{}
+		for _, id := range asm.Assemblies {
+			if len(id) > 1 {
+				keys = append(keys, id)
+			}
+		}
+		return keys, nil
+	case "dockerstate":
+		Msg := &Message{}
+		if err := json.Unmarshal(chann, &Msg); err != nil {
+			return nil, permanent(err)
+		}
+		apprequest := global.AppRequest{Id: Msg.Id}
+		req, err := apprequest.Get(Msg.Id)
+		if err != nil {
+			return nil, err
+		}
+		return []string{req.AppId}, nil
+	case "bind":
+		m := &global.BindMessage{}
+		if err := json.Unmarshal(chann, &m); err != nil {
+			return nil, permanent(err)
+		}
+		return []string{m.ComponentId}, nil
+	}
+	return nil, nil
+}
+
+/*
+* Reserve takes a turn on the assemblies, see KeyedExecutor.Reserve.
+ */
+func Reserve(keys []string) (ready <-chan struct{}, done func()) {
+	return assemblyExecutor.Reserve(keys...)
+}
+
+/*
+* dispatchInTurn dispatches the message once the turn on its assemblies
+* came.
+ */
+func dispatchInTurn(job *global.Job, chann []byte) error {
+	keys, err := Keys(job.Queue, chann)
+	if err != nil {
+		return err
+	}
+	ready, done := Reserve(keys)
+	defer done()
+	<-ready
+	return Dispatch(job, chann)
+}
+
+/*
+* Dispatch handles a message consumed from job.Queue, moving the job
+* through its states. The caller holds the turn on the assemblies of
+* the message. A job that failed or was interrupted earlier is
+* queued again, so the same record tracks every retry of the message.
+ */
+func Dispatch(job *global.Job, chann []byte) error {
+	log.Info("Handling coordinator message %v", string(chann))
+
+	job.Payload = string(chann)
+	if job.Status == global.JOB_FAILED || job.Status == global.JOB_INTERRUPTED {
+		if terr := job.Transition(global.JOB_QUEUED); terr != nil {
+			return terr
+		}
+	}
+	track(job)
+	defer untrack(job)
+
+	var err error
+	switch job.Queue {
+	case "cloudstandup":
+		err = requestHandler(chann, job)
 		break
 	case "events":
-		eventsHandler(chann)
+		err = eventsHandler(chann, job)
 		break
 	case "dockerstate":
-		dockerStateHandler(chann)
+		err = dockerStateHandler(chann, job)
 		break
+	case "bind":
+		err = bindHandler(chann, job)
+		break
+	default:
+		err = permanent(fmt.Errorf("no handler for queue %s", job.Queue))
+	}
+
+	jobsMu.Lock()
+	ferr := job.Finish(err)
+	jobsMu.Unlock()
+	if ferr != nil {
+		log.Error("Error: Failed to record job %s:\n%s.", job.Id, ferr)
 	}
+	return err
 }
 
-func dockerStateHandler(chann []byte) {
+/*
+* startJob marks the job as running once the request behind it is known.
+ */
+func startJob(job *global.Job, requestId string, action string) {
+	jobsMu.Lock()
+	job.RequestId = requestId
+	job.Action = action
+	jobsMu.Unlock()
+	if err := transition(job, global.JOB_RUNNING); err != nil {
+		log.Error("Error: Failed to record job %s:\n%s.", job.Id, err)
+	}
+}
+
+func dockerStateHandler(chann []byte, job *global.Job) error {
 
 	Msg := &Message{}
 	parse_err := json.Unmarshal(chann, &Msg)
-	log.Info(parse_err)
 	if parse_err != nil {
 		log.Error("Error: Message parsing error:\n%s.", parse_err)
-		return
+		return permanent(parse_err)
 	}
 
 	apprequest := global.AppRequest{Id: Msg.Id}
@@ -83,58 +211,125 @@ func dockerStateHandler(chann []byte) {
 	log.Info(req)
 	if err != nil {
 		log.Error("Error: Riak didn't cooperate:\n%s.", err)
-		return
+		return err
 	}
+	startJob(job, Msg.Id, req.Action)
 
 	assembly := global.Assembly{Id: req.AppId}
 	asm, err := assembly.GetAssemblyWithComponents(req.AppId)
 	if err != nil {
 		log.Error("Error: Riak didn't cooperate:\n%s.", err)
-		return
+		return err
+	}
+
+	switch req.Action {
+	case "start", "stop", "restart":
+	case "scale":
+		/*
+		 * the components run as many containers as their replicas
+		 * input asks for.
+		 */
+		return docker.Scale(asm)
+	default:
+		return permanent(fmt.Errorf("unknown container action %s", req.Action))
+	}
+
+	/*
+	 * the containers start in the order the components relate to each
+	 * other and stop in the reverse order.
+	 */
+	components, oerr := asm.OrderedComponents()
+	if oerr != nil {
+		log.Error("Failed to order the components : %s", oerr)
+		return oerr
+	}
+	if req.Action == "stop" {
+		for i, j := 0, len(components)-1; i < j; i, j = i+1, j-1 {
+			components[i], components[j] = components[j], components[i]
+		}
+	}
+
+	for _, com := range components {
+		if err := containerAction(req.Action, com); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	cont_id, perrscm := global.ParseKeyValuePair(asm.Components[0].Outputs, "id")
+func containerAction(action string, com *global.Component) error {
+	cont_id, perrscm := global.ParseKeyValuePair(com.Outputs, "id")
 	if perrscm != nil {
 		log.Error("Failed to get the container id : %s", perrscm)
+		return perrscm
 	}
-	endpoint, perrscm := global.ParseKeyValuePair(asm.Components[0].Outputs, "endpoint")
+	endpoint, perrscm := global.ParseKeyValuePair(com.Outputs, "endpoint")
 	if perrscm != nil {
 		log.Error("Failed to get the container id : %s", perrscm)
+		return perrscm
 	}
 
-	pair_cpu, perrscm := global.ParseKeyValuePair(asm.Components[0].Inputs, "cpu")
-	if perrscm != nil {
-		log.Error("Failed to get the cpu value : %s", perrscm)
-	}
+	switch action {
+	case "start":
+		res, rerr := docker.ComponentResources(com)
+		if rerr != nil {
+			log.Error("Failed to get the resources : %s", rerr)
+			return rerr
+		}
 
-	pair_memory, iderr := global.ParseKeyValuePair(asm.Components[0].Outputs, "memory")
-	if iderr != nil {
-		log.Error("Failed to get the memory value : %s", iderr)
-	}
+		ports, perr := docker.ComponentPorts(com)
+		if perr != nil {
+			log.Error("Failed to get the ports : %s", perr)
+			return perr
+		}
 
-	switch req.Action {
-	case "start":
-		log.Info("Starting Container")
-		go docker.StartContainer(cont_id.Value, endpoint.Value, pair_cpu.Value, pair_memory.Value)
-		break
+		volumes, verr := docker.ContainerVolumes(com)
+		if verr != nil {
+			log.Error("Failed to get the volumes : %s", verr)
+			return verr
+		}
+
+		log.Info("Starting Container of %s", com.Name)
+		if err := docker.StartContainer(cont_id.Value, endpoint.Value, docker.ComponentNetwork(com), res, ports, volumes); err != nil {
+			return err
+		}
+		if err := docker.ReplicaAction(action, com, endpoint.Value); err != nil {
+			return err
+		}
+		docker.SetStatus(com.Id, docker.STARTING)
+		return nil
 	case "stop":
-		log.Info("Stopping Container")
-		go docker.StopContainer(cont_id.Value, endpoint.Value)
-		break
+		log.Info("Stopping Container of %s", com.Name)
+		if err := docker.ReplicaAction(action, com, endpoint.Value); err != nil {
+			return err
+		}
+		if err := docker.StopContainer(cont_id.Value, endpoint.Value); err != nil {
+			return err
+		}
+		// the health monitor leaves a stopped container alone.
+		docker.SetStatus(com.Id, docker.STOPPED)
+		return nil
 	case "restart":
-		log.Info("Restarting container")
-		go docker.RestartContainer(cont_id.Value, endpoint.Value)
-		break
+		log.Info("Restarting container of %s", com.Name)
+		if err := docker.RestartContainer(cont_id.Value, endpoint.Value); err != nil {
+			return err
+		}
+		if err := docker.ReplicaAction(action, com, endpoint.Value); err != nil {
+			return err
+		}
+		docker.SetStatus(com.Id, docker.STARTING)
+		return nil
 	}
+	return fmt.Errorf("unknown container action %s", action)
 }
 
-func requestHandler(chann []byte) {
+func requestHandler(chann []byte, job *global.Job) error {
 	log.Info("Cloud standup handler entered!-------->")
 	m := &global.Message{}
 	parse_err := json.Unmarshal(chann, &m)
 	if parse_err != nil {
 		log.Error("Error: Message parsing error:\n%s.", parse_err)
-		return
+		return permanent(parse_err)
 	}
 	request := global.Request{Id: m.Id}
 	req, err := request.Get(m.Id)
@@ -142,8 +337,10 @@ func requestHandler(chann []byte) {
 	log.Debug("---------")
 	if err != nil {
 		log.Error("Error: Riak didn't cooperate:\n%s.", err)
-		return
+		return err
 	}
+	startJob(job, m.Id, req.ReqType)
+
 	switch req.ReqType {
 	case "create":
 		log.Debug("============Create entry============")
@@ -151,24 +348,53 @@ func requestHandler(chann []byte) {
 		asm, err := assemblies.Get(req.AssembliesId)
 		if err != nil {
 			log.Error("Error: Riak didn't cooperate:\n%s.", err)
-			return
+			return err
 		}
+
+		/*
+		 * every assembly is launched, the launches running are waited for
+		 * even when another failed, so a retry doesn't overlap them.
+		 */
+		var wg sync.WaitGroup
+		errs := make(chan error, len(asm.Assemblies))
 		for i := range asm.Assemblies {
 			log.Debug("Assemblies: [%s]", asm.Assemblies[i])
 			if len(asm.Assemblies[i]) > 1 {
 
 				assemblyID := asm.Assemblies[i]
 				log.Debug("Assemblies id: [%s]", assemblyID)
+
+				/*
+				 * an assembly described by a compose file gets its
+				 * components from it first.
+				 */
+				if _, cerr := compose.Import(assemblyID); cerr != nil {
+					log.Error("Error: Failed to import the compose file:\n%s.", cerr)
+					errs <- cerr
+					continue
+				}
 				assembly := global.Assembly{Id: assemblyID}
 				res, err := assembly.GetAssemblyWithComponents(assemblyID)
 				if err != nil {
 					log.Error("Error: Riak didn't cooperate:\n%s.", err)
-					return
+					errs <- err
+					continue
 				}
-				go app.LaunchApp(res, m.Id, asm.AccountsId)
+				wg.Add(1)
+				go func(res *global.AssemblyWithComponents) {
+					defer wg.Done()
+					lerr := app.LaunchApp(res, m.Id, asm.AccountsId, &jobProgress{job})
+					if lerr != nil {
+						log.Error("Error: Failed to launch %s:\n%s.", res.Name, lerr)
+						errs <- lerr
+					}
+				}(res)
 				go pluginAdministrator(res, asm.AccountsId)
 			}
 		}
+		wg.Wait()
+		close(errs)
+		return <-errs
 
 		//build delete command
 	case "delete":
@@ -177,12 +403,26 @@ func requestHandler(chann []byte) {
 		asm, err := assembly.GetAssemblyWithComponents(req.AssembliesId)
 		if err != nil {
 			log.Error("Error: Riak didn't cooperate:\n%s.", err)
-			return
+			return err
 		}
-		res := asm
-		go app.DeleteApp(res, m.Id)
+		return app.DeleteApp(asm, m.Id, &jobProgress{job})
 
+		//replace the containers with ones of the new images
+	case "update":
+		log.Debug("============Update entry==========")
+		assembly := global.Assembly{Id: req.AssembliesId}
+		asm, err := assembly.GetAssemblyWithComponents(req.AssembliesId)
+		if err != nil {
+			log.Error("Error: Riak didn't cooperate:\n%s.", err)
+			return err
+		}
+		pair_host, perr := global.ParseKeyValuePair(asm.Inputs, "provider")
+		if perr != nil || pair_host.Value != "docker" {
+			return permanent(fmt.Errorf("assembly %s : only docker assemblies can be updated", asm.Name))
+		}
+		return docker.Update(asm)
 	}
+	return permanent(fmt.Errorf("unknown request type %s", req.ReqType))
 }
 
 func pluginAdministrator(asm *global.AssemblyWithComponents, act_id string) {
@@ -195,21 +435,63 @@ func pluginAdministrator(asm *global.AssemblyWithComponents, act_id string) {
 	}
 }
 
-func eventsHandler(chann []byte) {
+func eventsHandler(chann []byte, job *global.Job) error {
 	log.Info("Event was entered")
 	m := &global.EventMessage{}
 	parse_err := json.Unmarshal(chann, &m)
 	if parse_err != nil {
 		log.Error("Error: Message parsing error:\n%s.", parse_err)
-		return
+		return permanent(parse_err)
 	}
+	startJob(job, m.AssemblyId, m.Event)
+
 	switch m.Event {
 	case "notify":
 		perr := plugins.Notify(m)
 		if perr != nil {
 			log.Error("Error: Plugin Notify :\n%s.", perr)
-			break
+			return perr
 		}
 		break
 	}
+	return nil
+}
+
+/*
+* bindHandler binds a service component to a component or unbinds it. The
+* variables reach the container when it is created again.
+ */
+func bindHandler(chann []byte, job *global.Job) error {
+	m := &global.BindMessage{}
+	parse_err := json.Unmarshal(chann, &m)
+	if parse_err != nil {
+		log.Error("Error: Message parsing error:\n%s.", parse_err)
+		return permanent(parse_err)
+	}
+	startJob(job, m.ComponentId, m.Action)
+
+	switch m.Action {
+	case "bind", "unbind":
+	default:
+		return permanent(fmt.Errorf("unknown bind action %s", m.Action))
+	}
+
+	component := global.Component{Id: m.ComponentId}
+	com, err := component.Get(m.ComponentId)
+	if err != nil {
+		log.Error("Error: Riak didn't cooperate:\n%s.", err)
+		return err
+	}
+	service := global.Component{Id: m.ServiceId}
+	svc, err := service.Get(m.ServiceId)
+	if err != nil {
+		log.Error("Error: Riak didn't cooperate:\n%s.", err)
+		return err
+	}
+
+	binder := bind.NewService(svc)
+	if m.Action == "unbind" {
+		return binder.UnbindApp(bind.NewComponentApp(com))
+	}
+	return binder.BindApp(bind.NewComponentApp(com))
 }
@@ -0,0 +1,82 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package coordinator
+
+import (
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/megamsys/megamd/app"
+	"github.com/megamsys/megamd/compose"
+	"github.com/megamsys/megamd/global"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) SetUpSuite(c *check.C) {
+	config.Set("storage:backend", "file")
+	config.Set("storage:path", filepath.Join(c.MkDir(), "megamd.db"))
+}
+
+func (s *S) TestIsPermanent(c *check.C) {
+	c.Assert(IsPermanent(permanent(errors.New("unknown request type"))), check.Equals, true)
+	c.Assert(IsPermanent(&compose.InvalidError{Assembly: "blog", Report: &compose.Report{}}), check.Equals, true)
+	c.Assert(IsPermanent(errors.New("riak didn't cooperate")), check.Equals, false)
+}
+
+func (s *S) TestDispatchUnparsableIsPermanent(c *check.C) {
+	job := global.NewJob("bind")
+	err := Dispatch(job, []byte("{not json"))
+	c.Assert(IsPermanent(err), check.Equals, true)
+	c.Assert(job.Status, check.Equals, global.JOB_FAILED)
+}
+
+func (s *S) TestInterruptSteps(c *check.C) {
+	job := global.NewJob("cloudstandup")
+	job.SetStep("ASM1", "launchedapp", app.STEP_STARTED)
+	job.SetStep("ASM1", "chefcommand", app.STEP_DONE)
+	job.SetStep("ASM2", "launchedapp", app.STEP_FAILED)
+	interruptSteps(job)
+	c.Assert(job.StepStatus("ASM1", "launchedapp"), check.Equals, app.STEP_INTERRUPTED)
+	c.Assert(job.StepStatus("ASM1", "chefcommand"), check.Equals, app.STEP_DONE)
+	c.Assert(job.StepStatus("ASM2", "launchedapp"), check.Equals, app.STEP_FAILED)
+}
+
+func (s *S) TestResumeLeavesTheJobsOfALiveOwner(c *check.C) {
+	c.Assert(global.RenewJobOwner("alive", time.Now().Add(time.Minute)), check.IsNil)
+	c.Assert(global.RenewJobOwner("gone", time.Now().Add(-time.Minute)), check.IsNil)
+	running := global.NewJob("bind")
+	running.Payload, running.Owner, running.Status = "{not json", "alive", global.JOB_RUNNING
+	crashed := global.NewJob("bind")
+	crashed.Payload, crashed.Owner, crashed.Status = "{not json", "gone", global.JOB_RUNNING
+	for _, job := range []*global.Job{running, crashed} {
+		c.Assert(job.Store(), check.IsNil)
+		c.Assert(global.AddToJobIndex(global.ACTIVEINDEX, job.Id), check.IsNil)
+	}
+
+	Resume()
+	idx, err := (&global.JobIndex{}).Get(global.ACTIVEINDEX)
+	c.Assert(err, check.IsNil)
+	c.Assert(idx.Ids, check.DeepEquals, []string{running.Id})
+	stored, err := (&global.Job{}).Get(running.Id)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Status, check.Equals, global.JOB_RUNNING)
+	// the payload of the crashed one can't be read, it fails once taken over.
+	stored, err = (&global.Job{}).Get(crashed.Id)
+	c.Assert(err, check.IsNil)
+	c.Assert(stored.Status, check.Equals, global.JOB_FAILED)
+}
@@ -0,0 +1,48 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package coordinator
+
+import (
+	"github.com/megamsys/megamd/compose"
+)
+
+/*
+* PermanentError is a failure handling the message again can't fix, a
+* payload that doesn't parse or a request megamd doesn't know about.
+ */
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+/*
+* IsPermanent tells the queue servers to dead-letter the message right
+* away instead of retrying it. An invalid compose file is one.
+ */
+func IsPermanent(err error) bool {
+	switch err.(type) {
+	case *PermanentError, *compose.InvalidError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package coordinator
+
+import (
+	"sync"
+)
+
+/*
+* KeyedExecutor runs work sharing a key strictly one after the other, in
+* the order the turns were taken. Different keys run concurrently.
+ */
+type KeyedExecutor struct {
+	mu     sync.Mutex
+	queues map[string][]*turn
+}
+
+/*
+* a turn is ready once it heads the queue of every key it was taken on.
+ */
+type turn struct {
+	behind int
+	ready  chan struct{}
+}
+
+func NewKeyedExecutor() *KeyedExecutor {
+	return &KeyedExecutor{queues: make(map[string][]*turn)}
+}
+
+/*
+* Reserve takes a turn on every key at once, behind the turns already
+* taken on any of them. ready is closed when those are all over; done
+* ends the turn and must be called once the work is, or given up.
+ */
+func (e *KeyedExecutor) Reserve(keys ...string) (ready <-chan struct{}, done func()) {
+	t := &turn{ready: make(chan struct{})}
+	keys = uniqueKeys(keys)
+
+	e.mu.Lock()
+	for _, key := range keys {
+		if len(e.queues[key]) > 0 {
+			t.behind++
+		}
+		e.queues[key] = append(e.queues[key], t)
+	}
+	if t.behind == 0 {
+		close(t.ready)
+	}
+	e.mu.Unlock()
+
+	var once sync.Once
+	return t.ready, func() {
+		once.Do(func() { e.release(keys, t) })
+	}
+}
+
+/*
+* Run waits for every earlier turn on the key to end, then runs f and
+* returns its error.
+ */
+func (e *KeyedExecutor) Run(key string, f func() error) error {
+	ready, done := e.Reserve(key)
+	defer done()
+	<-ready
+	return f()
+}
+
+/*
+* release takes the turn out of the queues, the turn behind it goes next
+* when it was heading one.
+ */
+func (e *KeyedExecutor) release(keys []string, t *turn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, key := range keys {
+		queue := e.queues[key]
+		rest := make([]*turn, 0, len(queue))
+		for _, other := range queue {
+			if other != t {
+				rest = append(rest, other)
+			}
+		}
+		if len(rest) == 0 {
+			delete(e.queues, key)
+			continue
+		}
+		e.queues[key] = rest
+		if queue[0] == t {
+			if rest[0].behind--; rest[0].behind == 0 {
+				close(rest[0].ready)
+			}
+		}
+	}
+}
+
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]bool, len(keys))
+	unique := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,139 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package coordinator
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestKeyedExecutorRunsSameKeyInOrder(c *check.C) {
+	e := NewKeyedExecutor()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		e.Run("ASM1", func() error {
+			close(started)
+			<-release
+			mu.Lock()
+			order = append(order, "create")
+			mu.Unlock()
+			return nil
+		})
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		e.Run("ASM1", func() error {
+			mu.Lock()
+			order = append(order, "delete")
+			mu.Unlock()
+			return nil
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	c.Assert(order, check.DeepEquals, []string{"create", "delete"})
+	c.Assert(e.queues, check.HasLen, 0)
+}
+
+func (s *S) TestKeyedExecutorRunsOtherKeysConcurrently(c *check.C) {
+	e := NewKeyedExecutor()
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go e.Run("ASM1", func() error {
+		<-release
+		return nil
+	})
+	go func() {
+		e.Run("ASM2", func() error { return nil })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("ASM2 waited for ASM1")
+	}
+	close(release)
+}
+
+func (s *S) TestKeyedExecutorReturnsError(c *check.C) {
+	e := NewKeyedExecutor()
+	err := e.Run("ASM1", func() error { return errors.New("launch failed") })
+	c.Assert(err, check.ErrorMatches, "launch failed")
+}
+
+func (s *S) TestKeyedExecutorReserveWaitsForEveryKey(c *check.C) {
+	e := NewKeyedExecutor()
+	ready1, done1 := e.Reserve("ASM1")
+	ready2, done2 := e.Reserve("ASM2")
+	create, doneCreate := e.Reserve("ASM1", "ASM2")
+	ready3, done3 := e.Reserve("ASM2")
+	<-ready1
+	<-ready2
+
+	done1()
+	select {
+	case <-create:
+		c.Fatal("the create didn't wait for ASM2")
+	default:
+	}
+	done2()
+	<-create
+	select {
+	case <-ready3:
+		c.Fatal("a later turn on ASM2 went before the create")
+	default:
+	}
+	doneCreate()
+	<-ready3
+	done3()
+	c.Assert(e.queues, check.HasLen, 0)
+}
+
+func (s *S) TestKeyedExecutorTurnGivenUp(c *check.C) {
+	e := NewKeyedExecutor()
+	ready1, done1 := e.Reserve("ASM1")
+	_, done2 := e.Reserve("ASM1")
+	ready3, done3 := e.Reserve("ASM1")
+	<-ready1
+
+	done2()
+	done2()
+	done1()
+	<-ready3
+	done3()
+	c.Assert(e.queues, check.HasLen, 0)
+}
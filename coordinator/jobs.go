@@ -0,0 +1,381 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package coordinator
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/app"
+	"github.com/megamsys/megamd/global"
+)
+
+/*
+* the jobs being dispatched right now. jobsMu also guards the state
+* changes of a tracked job, Interrupt reads them from another goroutine.
+ */
+var (
+	jobsMu   sync.Mutex
+	inFlight = make(map[string]*global.Job)
+)
+
+const (
+	// how often the process renews its lease and looks for jobs to resume.
+	heartbeatInterval = 10 * time.Second
+	// the intervals a lease outlives its last renewal.
+	heartbeatLease = 3
+)
+
+/*
+* owner is this process, the owner of the jobs it tracks. Another megamd
+* takes them over only once its lease expired.
+ */
+var owner = newOwner()
+
+func newOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), global.RandString(8))
+}
+
+/*
+* track records this process as the owner of the job and lists it in the
+* active index, a job still listed there once its owner is gone was cut
+* short by a crash.
+ */
+func track(job *global.Job) {
+	jobsMu.Lock()
+	inFlight[job.Id] = job
+	job.Owner = owner
+	serr := job.Store()
+	jobsMu.Unlock()
+	if serr != nil {
+		log.Error("Error: Failed to record job %s:\n%s.", job.Id, serr)
+	}
+
+	if err := global.AddToJobIndex(global.ACTIVEINDEX, job.Id); err != nil {
+		log.Error("Error: Failed to index job %s:\n%s.", job.Id, err)
+	}
+}
+
+func untrack(job *global.Job) {
+	jobsMu.Lock()
+	delete(inFlight, job.Id)
+	jobsMu.Unlock()
+
+	if err := global.RemoveFromJobIndex(global.ACTIVEINDEX, job.Id); err != nil {
+		log.Error("Error: Failed to index job %s:\n%s.", job.Id, err)
+	}
+}
+
+/*
+* Accept records a consumed message as a job of this process while it
+* waits for its turn, a crash leaves it in the active index for another
+* megamd to resume.
+ */
+func Accept(job *global.Job) {
+	job.Owner = owner
+	if err := job.Store(); err != nil {
+		log.Error("Error: Failed to record job %s:\n%s.", job.Id, err)
+	}
+	if err := global.AddToJobIndex(global.ACTIVEINDEX, job.Id); err != nil {
+		log.Error("Error: Failed to index job %s:\n%s.", job.Id, err)
+	}
+}
+
+/*
+* Reject fails a job accepted that can't run, it leaves the active index.
+ */
+func Reject(job *global.Job, reason error) {
+	if err := job.Finish(reason); err != nil {
+		log.Error("Error: Failed to record job %s:\n%s.", job.Id, err)
+	}
+	if err := global.RemoveFromJobIndex(global.ACTIVEINDEX, job.Id); err != nil {
+		log.Error("Error: Failed to index job %s:\n%s.", job.Id, err)
+	}
+}
+
+/*
+* jobProgress records the pipeline steps of the app package on the job.
+ */
+type jobProgress struct {
+	job *global.Job
+}
+
+func (p *jobProgress) Step(assemblyId string, action string) string {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return p.job.StepStatus(assemblyId, action)
+}
+
+func (p *jobProgress) Record(assemblyId string, action string, status string) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	p.job.SetStep(assemblyId, action, status)
+	return p.job.Store()
+}
+
+/*
+* transition moves a tracked job to the given state and stores it.
+ */
+func transition(job *global.Job, status string) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if err := job.Transition(status); err != nil {
+		return err
+	}
+	return job.Store()
+}
+
+/*
+* Interrupt records every job still in flight as interrupted, so it can
+* be resumed on the next start. Called when the daemon gives up waiting
+* for them on shutdown.
+ */
+func Interrupt() {
+	jobsMu.Lock()
+	jobs := make([]global.Job, 0, len(inFlight))
+	for _, job := range inFlight {
+		jobs = append(jobs, *job)
+	}
+	jobsMu.Unlock()
+
+	for i := range jobs {
+		MarkInterrupted(&jobs[i])
+	}
+}
+
+/*
+* MarkInterrupted stores the job as interrupted and moves it from the
+* active index to the interrupted one.
+ */
+func MarkInterrupted(job *global.Job) {
+	if err := interrupt(job); err != nil {
+		log.Error("Error: Failed to record job %s:\n%s.", job.Id, err)
+		return
+	}
+	if err := global.AddToJobIndex(global.INTERRUPTEDINDEX, job.Id); err != nil {
+		log.Error("Error: Failed to index job %s:\n%s.", job.Id, err)
+		return
+	}
+	if err := global.RemoveFromJobIndex(global.ACTIVEINDEX, job.Id); err != nil {
+		log.Error("Error: Failed to index job %s:\n%s.", job.Id, err)
+	}
+	log.Info("Job %s was interrupted", job.Id)
+}
+
+func interrupt(job *global.Job) error {
+	if err := job.Transition(global.JOB_INTERRUPTED); err != nil {
+		return err
+	}
+	return job.Store()
+}
+
+/*
+* interruptSteps marks the steps the job had started as interrupted, the
+* pipelines roll back the assembly when one can't be run twice.
+ */
+func interruptSteps(job *global.Job) {
+	for _, step := range job.Steps {
+		if step.Status == app.STEP_STARTED {
+			step.Status = app.STEP_INTERRUPTED
+		}
+	}
+}
+
+/*
+* heartbeat renews the lease of the process and resumes the jobs of the
+* processes that are gone. A draining process keeps its lease, its jobs
+* are still running, and takes no more jobs over.
+ */
+type heartbeat struct {
+	mu       sync.Mutex
+	draining bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+var beat = &heartbeat{}
+
+func renewOwner(now time.Time) {
+	if err := global.RenewJobOwner(owner, now.Add(heartbeatLease*heartbeatInterval)); err != nil {
+		log.Error("Error: Failed to renew the lease of %s:\n%s.", owner, err)
+	}
+}
+
+/*
+* StartHeartbeat stores the lease of the process, resumes the jobs left
+* by the processes that are gone, then does both every interval.
+ */
+func StartHeartbeat() {
+	beat.mu.Lock()
+	if beat.stop != nil {
+		beat.mu.Unlock()
+		return
+	}
+	beat.stop, beat.done, beat.draining = make(chan struct{}), make(chan struct{}), false
+	stop, done := beat.stop, beat.done
+	beat.mu.Unlock()
+
+	renewOwner(time.Now())
+	Resume()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				renewOwner(time.Now())
+				beat.mu.Lock()
+				draining := beat.draining
+				beat.mu.Unlock()
+				if !draining {
+					Resume()
+				}
+			}
+		}
+	}()
+}
+
+/*
+* Drain stops taking jobs over, the lease is still renewed while the
+* jobs in flight finish.
+ */
+func Drain() {
+	beat.mu.Lock()
+	beat.draining = true
+	beat.mu.Unlock()
+}
+
+/*
+* StopHeartbeat stops renewing the lease and gives it up, the jobs left
+* are resumed by another megamd right away.
+ */
+func StopHeartbeat() {
+	beat.mu.Lock()
+	stop, done := beat.stop, beat.done
+	beat.stop = nil
+	beat.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+	if err := global.RenewJobOwner(owner, time.Time{}); err != nil {
+		log.Error("Error: Failed to give the lease of %s up:\n%s.", owner, err)
+	}
+}
+
+/*
+* ownerGone tells if the process owning the job no longer renews its
+* lease. A job without an owner was never dispatched.
+ */
+func ownerGone(job *global.Job, now time.Time) bool {
+	if job.Owner == "" {
+		return true
+	}
+	if job.Owner == owner {
+		return false
+	}
+	alive, err := global.JobOwnerAlive(job.Owner, now)
+	if err != nil {
+		log.Error("Error: Failed to read the lease of %s:\n%s.", job.Owner, err)
+		return false
+	}
+	return !alive
+}
+
+/*
+* Resume dispatches again the jobs that were interrupted on shutdown or
+* were still active when their process died, once the lease of that
+* process expired. Their pipelines skip the actions already done, and
+* roll back the assembly when the interrupted action can't be run twice.
+ */
+func Resume() {
+	now := time.Now()
+	for _, key := range []string{global.INTERRUPTEDINDEX, global.ACTIVEINDEX} {
+		idx := &global.JobIndex{}
+		if _, err := idx.Get(key); err != nil {
+			log.Error("Error: Riak didn't cooperate:\n%s.", err)
+			continue
+		}
+		for _, id := range idx.Ids {
+			job := &global.Job{}
+			if _, err := job.Get(id); err != nil {
+				log.Error("Error: Riak didn't cooperate:\n%s.", err)
+				continue
+			}
+			if !job.IsTerminal() && !ownerGone(job, now) {
+				continue
+			}
+			// of two megamd resuming the job, the one taking it runs it.
+			taken, err := global.TakeFromJobIndex(key, id)
+			if err != nil {
+				log.Error("Error: Failed to index job %s:\n%s.", id, err)
+				continue
+			}
+			if !taken || job.IsTerminal() {
+				continue
+			}
+			if job.Status != global.JOB_INTERRUPTED {
+				if err := interrupt(job); err != nil {
+					log.Error("Error: Failed to record job %s:\n%s.", job.Id, err)
+					continue
+				}
+			}
+			interruptSteps(job)
+
+			/*
+			 * the turns are taken here, in the order of the index, the
+			 * jobs wait for them on their own.
+			 */
+			keys, err := Keys(job.Queue, []byte(job.Payload))
+			if err != nil {
+				log.Error("Error: Failed to resume job %s:\n%s.", job.Id, err)
+				if IsPermanent(err) {
+					if ferr := job.Finish(err); ferr != nil {
+						log.Error("Error: Failed to record job %s:\n%s.", job.Id, ferr)
+					}
+				} else if ierr := global.AddToJobIndex(global.INTERRUPTEDINDEX, job.Id); ierr != nil {
+					log.Error("Error: Failed to index job %s:\n%s.", job.Id, ierr)
+				}
+				continue
+			}
+			// the job is ours while it waits for its turn.
+			job.Owner = owner
+			if err := job.Store(); err != nil {
+				log.Error("Error: Failed to record job %s:\n%s.", job.Id, err)
+			}
+			if err := global.AddToJobIndex(global.ACTIVEINDEX, job.Id); err != nil {
+				log.Error("Error: Failed to index job %s:\n%s.", job.Id, err)
+			}
+			ready, done := Reserve(keys)
+			log.Info("Resuming job %s (%s %s)", job.Id, job.Queue, job.Action)
+			go func(job *global.Job) {
+				defer done()
+				<-ready
+				if err := Dispatch(job, []byte(job.Payload)); err != nil {
+					log.Error("Error: Resumed job %s failed:\n%s.", job.Id, err)
+				}
+			}(job)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package global
+
+import (
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/storage"
+)
+
+const (
+	DEADLETTERSBUCKET  = "deadletters"
+	DEADLETTERINDEXKEY = "dlindex"
+)
+
+/*
+* DeadLetter keeps a message that failed every retry, so that it can
+* be listed and replayed once the outage is over.
+ */
+type DeadLetter struct {
+	Id        string `json:"id"`
+	Queue     string `json:"queue"`
+	JobId     string `json:"job_id"`
+	Payload   string `json:"payload"`
+	Reason    string `json:"reason"`
+	Attempts  int    `json:"attempts"`
+	CreatedAt string `json:"created_at"`
+}
+
+type DeadLetterIndex struct {
+	Ids      []string `json:"ids"`
+	Revision int      `json:"revision"`
+	// the version getDeadLetterIndex read, updateDeadLetterIndex writes over it.
+	read storage.Version
+}
+
+/*
+* getDeadLetterIndex reads the index, empty when nothing was dead-lettered
+* yet.
+ */
+func getDeadLetterIndex() (*DeadLetterIndex, error) {
+	index := &DeadLetterIndex{}
+	read, ferr := storage.FetchRevision(DEADLETTERSBUCKET, DEADLETTERINDEXKEY, index)
+	if ferr != nil && !storage.IsNotFound(ferr) {
+		return nil, ferr
+	}
+	index.read = read
+	return index, nil
+}
+
+/*
+* updateDeadLetterIndex changes the index, read again when another megamd
+* stored it meanwhile.
+ */
+func updateDeadLetterIndex(change func(ids []string) []string) error {
+	return storage.RetryOnConflict(func() error {
+		index, err := getDeadLetterIndex()
+		if err != nil {
+			return err
+		}
+		index.Ids = change(index.Ids)
+		index.Revision++
+		_, err = storage.StoreRevision(DEADLETTERSBUCKET, DEADLETTERINDEXKEY, index, index.read)
+		return err
+	})
+}
+
+func NewDeadLetter(queue string, job *Job, payload []byte, reason error, attempts int) *DeadLetter {
+	return &DeadLetter{
+		Id:        "DLQ" + RandString(19),
+		Queue:     queue,
+		JobId:     job.Id,
+		Payload:   string(payload),
+		Reason:    reason.Error(),
+		Attempts:  attempts,
+		CreatedAt: time.Now().Format(TIMEFORMAT),
+	}
+}
+
+/**
+**fetch the dead letter json from riak and parse the json to struct
+**/
+func (dl *DeadLetter) Get(id string) (*DeadLetter, error) {
+	log.Info("Get DeadLetter message %v", id)
+	ferr := storage.FetchStruct(DEADLETTERSBUCKET, id, dl)
+	if ferr != nil {
+		return dl, ferr
+	}
+	return dl, nil
+}
+
+/**
+**store the dead letter and add it to the index
+**/
+func (dl *DeadLetter) Store() error {
+	if serr := storage.StoreStruct(DEADLETTERSBUCKET, dl.Id, dl); serr != nil {
+		return serr
+	}
+	return updateDeadLetterIndex(func(ids []string) []string {
+		return append(ids, dl.Id)
+	})
+}
+
+/**
+**drop the dead letter from the index, it is no longer listed
+**/
+func (dl *DeadLetter) Remove() error {
+	return updateDeadLetterIndex(func(ids []string) []string {
+		kept := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if id != dl.Id {
+				kept = append(kept, id)
+			}
+		}
+		return kept
+	})
+}
+
+/**
+**list every dead letter that hasn't been replayed yet
+**/
+func ListDeadLetters() ([]*DeadLetter, error) {
+	index, ierr := getDeadLetterIndex()
+	if ierr != nil {
+		return nil, ierr
+	}
+
+	letters := make([]*DeadLetter, 0, len(index.Ids))
+	for _, id := range index.Ids {
+		dl := &DeadLetter{}
+		if ferr := storage.FetchStruct(DEADLETTERSBUCKET, id, dl); ferr != nil {
+			log.Error("Error: Riak didn't cooperate:\n%s.", ferr)
+			continue
+		}
+		letters = append(letters, dl)
+	}
+	return letters, nil
+}
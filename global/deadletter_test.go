@@ -0,0 +1,41 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package global
+
+import (
+	"errors"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestDeadLetterIndex(c *check.C) {
+	job := NewJob("cloudstandup")
+	one := NewDeadLetter("cloudstandup", job, []byte("{}"), errors.New("riak is down"), 3)
+	two := NewDeadLetter("cloudstandup", job, []byte("{}"), errors.New("riak is down"), 3)
+	c.Assert(one.Store(), check.IsNil)
+	c.Assert(two.Store(), check.IsNil)
+
+	letters, err := ListDeadLetters()
+	c.Assert(err, check.IsNil)
+	c.Assert(letters, check.HasLen, 2)
+
+	c.Assert(one.Remove(), check.IsNil)
+	letters, err = ListDeadLetters()
+	c.Assert(err, check.IsNil)
+	c.Assert(letters, check.HasLen, 1)
+	c.Assert(letters[0].Id, check.Equals, two.Id)
+	c.Assert(letters[0].Reason, check.Equals, "riak is down")
+}
@@ -22,7 +22,7 @@ import (
 	"strings"
 
 	log "code.google.com/p/log4go"
-	"github.com/megamsys/libgo/db"
+	"github.com/megamsys/megamd/storage"
 )
 
 type Message struct {
@@ -35,6 +35,16 @@ type EventMessage struct {
 	Event       string `json:"event"`
 }
 
+/*
+* BindMessage binds the service component to the component, or unbinds
+* it, action bind or unbind.
+ */
+type BindMessage struct {
+	ComponentId string `json:"component_id"`
+	ServiceId   string `json:"service_id"`
+	Action      string `json:"action"`
+}
+
 type PredefClouds struct {
 	Id          string     `json:"id"`
 	Name        string     `json:"name"`
@@ -78,16 +88,10 @@ type Request struct {
 **/
 func (req *Request) Get(reqId string) (*Request, error) {
 	log.Info("Get Request message %v", reqId)
-	conn, err := db.Conn("requests")
-	if err != nil {
-		return req, err
-	}
-	//appout := &Requests{}
-	ferr := conn.FetchStruct(reqId, req)
+	ferr := storage.FetchStruct("requests", reqId, req)
 	if ferr != nil {
 		return req, ferr
 	}
-	defer conn.Close()
 
 	return req, nil
 
@@ -134,6 +138,9 @@ type Component struct {
 	Operations        []*Operations   `json:"operations"`
 	Status            string          `json:"status"`
 	CreatedAt         string          `json:"created_at"`
+	Revision          int             `json:"revision"`
+	// the version Get read, Store writes over it.
+	read storage.Version
 }
 
 /**
@@ -141,21 +148,75 @@ type Component struct {
 **/
 func (asm *Component) Get(asmId string) (*Component, error) {
 	log.Info("Get Component message %v", asmId)
-	conn, err := db.Conn("components")
-	if err != nil {
-		return asm, err
-	}
-	//appout := &Requests{}
-	ferr := conn.FetchStruct(asmId, asm)
+	read, ferr := storage.FetchRevision("components", asmId, asm)
 	if ferr != nil {
 		return asm, ferr
 	}
-	defer conn.Close()
-
+	asm.read = read
 	return asm, nil
 
 }
 
+/**
+**store the component into riak, unless it was stored by someone else
+**since it was read (storage.ErrConflict)
+**/
+func (com *Component) Store() error {
+	com.Revision++
+	read, err := storage.StoreRevision("components", com.Id, com, com.read)
+	if err != nil {
+		com.Revision--
+		return err
+	}
+	com.read = read
+	return nil
+}
+
+/*
+* DeleteComponent removes the component from riak.
+ */
+func DeleteComponent(id string) error {
+	return storage.Delete("components", id)
+}
+
+/*
+* SetOutput sets the output under the key, adding it when missing.
+ */
+func (com *Component) SetOutput(key string, value string) {
+	com.Outputs = setKeyValuePair(com.Outputs, key, value)
+}
+
+/*
+* RemoveOutput drops the output under the key.
+ */
+func (com *Component) RemoveOutput(key string) {
+	for i, pair := range com.Outputs {
+		if pair.Key == key {
+			com.Outputs = append(com.Outputs[:i], com.Outputs[i+1:]...)
+			return
+		}
+	}
+}
+
+/*
+* UpdateComponent reads the component, applies change to it and stores
+* it back. It is read and changed again when a concurrent write won.
+ */
+func UpdateComponent(id string, change func(*Component) error) (*Component, error) {
+	var com *Component
+	err := storage.RetryOnConflict(func() error {
+		com = &Component{}
+		if _, err := com.Get(id); err != nil {
+			return err
+		}
+		if err := change(com); err != nil {
+			return err
+		}
+		return com.Store()
+	})
+	return com, err
+}
+
 type Assemblies struct {
 	Id         string          `json:"id"`
 	AccountsId string          `json:"accounts_id"`
@@ -168,16 +229,10 @@ type Assemblies struct {
 
 func (asm *Assemblies) Get(asmId string) (*Assemblies, error) {
 	log.Info("Get Assemblies message %v", asmId)
-	conn, err := db.Conn("assemblies")
-	if err != nil {
-		return asm, err
-	}
-	//appout := &Requests{}
-	ferr := conn.FetchStruct(asmId, asm)
+	ferr := storage.FetchStruct("assemblies", asmId, asm)
 	if ferr != nil {
 		return asm, ferr
 	}
-	defer conn.Close()
 	log.Debug(asm)
 	log.Debug("----------ASSEMBLIES--------")
 	return asm, nil
@@ -194,16 +249,10 @@ type AppRequest struct {
 
 func (req *AppRequest) Get(reqId string) (*AppRequest, error) {
 	log.Info("Get AppRequest message %v", reqId)
-	conn, err := db.Conn("catreqs")
-	if err != nil {
-		return req, err
-	}
-	//appout := &Requests{}
-	ferr := conn.FetchStruct(reqId, req)
+	ferr := storage.FetchStruct("catreqs", reqId, req)
 	if ferr != nil {
 		return req, ferr
 	}
-	defer conn.Close()
 
 	return req, nil
 
@@ -222,6 +271,9 @@ type Assembly struct {
 	Outputs      []*KeyValuePair `json:"outputs"`
 	Status       string          `json:"status"`
 	CreatedAt    string          `json:"created_at"`
+	Revision     int             `json:"revision"`
+	// the version Get read, Store writes over it.
+	read storage.Version
 }
 
 type AssemblyWithComponents struct {
@@ -236,7 +288,10 @@ type AssemblyWithComponents struct {
 	Outputs      []*KeyValuePair `json:"outputs"`
 	Status       string          `json:"status"`
 	Command      string
-	CreatedAt    string `json:"created_at"`
+	// the json attributes of the knife command, written to a private
+	// file only while it runs.
+	Attributes []byte `json:"-"`
+	CreatedAt  string `json:"created_at"`
 }
 
 /**
@@ -244,31 +299,61 @@ type AssemblyWithComponents struct {
 **/
 func (req *Assembly) Get(reqId string) (*Assembly, error) {
 	log.Info("Get Assembly message %v", reqId)
-	conn, err := db.Conn("assembly")
-	if err != nil {
-		return req, err
-	}
-	//appout := &Requests{}
-	ferr := conn.FetchStruct(reqId, req)
+	read, ferr := storage.FetchRevision("assembly", reqId, req)
 	if ferr != nil {
 		return req, ferr
 	}
-	defer conn.Close()
-
+	req.read = read
 	return req, nil
 
 }
 
+/**
+**store the assembly into riak, unless it was stored by someone else
+**since it was read (storage.ErrConflict)
+**/
+func (asm *Assembly) Store() error {
+	asm.Revision++
+	read, err := storage.StoreRevision("assembly", asm.Id, asm, asm.read)
+	if err != nil {
+		asm.Revision--
+		return err
+	}
+	asm.read = read
+	return nil
+}
+
+/*
+* SetOutput sets the output under the key, adding it when missing.
+ */
+func (asm *Assembly) SetOutput(key string, value string) {
+	asm.Outputs = setKeyValuePair(asm.Outputs, key, value)
+}
+
+/*
+* UpdateAssembly reads the assembly, applies change to it and stores
+* it back. It is read and changed again when a concurrent write won.
+ */
+func UpdateAssembly(id string, change func(*Assembly) error) (*Assembly, error) {
+	var asm *Assembly
+	err := storage.RetryOnConflict(func() error {
+		asm = &Assembly{}
+		if _, err := asm.Get(id); err != nil {
+			return err
+		}
+		if err := change(asm); err != nil {
+			return err
+		}
+		return asm.Store()
+	})
+	return asm, err
+}
+
 func (asm *Assembly) GetAssemblyWithComponents(asmId string) (*AssemblyWithComponents, error) {
 	log.Info("Get Assembly message %v", asmId)
 	var j = -1
 	asmresult := &AssemblyWithComponents{}
-	conn, err := db.Conn("assembly")
-	if err != nil {
-		return asmresult, err
-	}
-	//appout := &Requests{}
-	ferr := conn.FetchStruct(asmId, asm)
+	ferr := storage.FetchStruct("assembly", asmId, asm)
 	if ferr != nil {
 		return asmresult, ferr
 	}
@@ -288,7 +373,6 @@ func (asm *Assembly) GetAssemblyWithComponents(asmId string) (*AssemblyWithCompo
 		}
 	}
 	result := &AssemblyWithComponents{Id: asm.Id, Name: asm.Name, ToscaType: asm.ToscaType, Components: arraycomponent, Requirements: asm.Requirements, Policies: asm.Policies, Inputs: asm.Inputs, Outputs: asm.Outputs, Operations: asm.Operations, Status: asm.Status, CreatedAt: asm.CreatedAt}
-	defer conn.Close()
 	return result, nil
 }
 
@@ -301,6 +385,16 @@ func ParseKeyValuePair(keyvaluepair []*KeyValuePair, searchkey string) (*KeyValu
 	return nil, errors.New("The specific search key was not found in pair input...")
 }
 
+func setKeyValuePair(pairs []*KeyValuePair, key string, value string) []*KeyValuePair {
+	for _, pair := range pairs {
+		if pair.Key == key {
+			pair.Value = value
+			return pairs
+		}
+	}
+	return append(pairs, GetKeyValuePair(key, value))
+}
+
 type DockerNetworksInfo struct {
 	Bridge      string `json:"bridge"`
 	ContainerId string `json:"container_id"`
@@ -326,15 +420,10 @@ type IPIndex struct {
 **/
 func (req *IPIndex) Get(key string) (*IPIndex, error) {
 	log.Info("Get IPIndex value %v", key)
-	conn, err := db.Conn("ipindex")
-	if err != nil {
-		return req, err
-	}
-	ferr := conn.FetchStruct(key, req)
+	ferr := storage.FetchStruct("ipindex", key, req)
 	if ferr != nil {
 		return req, ferr
 	}
-	defer conn.Close()
 
 	return req, nil
 
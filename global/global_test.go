@@ -0,0 +1,105 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package global
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/megamsys/megamd/storage"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) SetUpSuite(c *check.C) {
+	config.Set("storage:backend", "file")
+	config.Set("storage:path", filepath.Join(c.MkDir(), "megamd.db"))
+}
+
+func (s *S) TestComponentStoreConflict(c *check.C) {
+	c.Assert(storage.StoreStruct("components", "COM001", &Component{Id: "COM001"}), check.IsNil)
+
+	first, _ := (&Component{}).Get("COM001")
+	second, _ := (&Component{}).Get("COM001")
+	c.Assert(first.Store(), check.IsNil)
+	c.Assert(second.Store(), check.Equals, storage.ErrConflict)
+	c.Assert(second.Revision, check.Equals, 0)
+}
+
+func (s *S) TestUpdateComponentKeepsConcurrentOutputs(c *check.C) {
+	c.Assert(storage.StoreStruct("components", "COM002", &Component{Id: "COM002"}), check.IsNil)
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"ip", "id", "endpoint", "port"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			_, err := UpdateComponent("COM002", func(com *Component) error {
+				com.SetOutput(key, key+"value")
+				return nil
+			})
+			c.Check(err, check.IsNil)
+		}(key)
+	}
+	wg.Wait()
+
+	com, _ := (&Component{}).Get("COM002")
+	c.Assert(com.Outputs, check.HasLen, 4)
+	c.Assert(com.Revision, check.Equals, 4)
+}
+
+func (s *S) TestUpdateAssemblyStatus(c *check.C) {
+	storage.StoreStruct("assembly", "ASM001", &Assembly{Id: "ASM001", Name: "fir", Status: "Launching"})
+
+	asm, err := UpdateAssembly("ASM001", func(asm *Assembly) error {
+		asm.Status = "Terminated"
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(asm.Revision, check.Equals, 1)
+	stored, _ := (&Assembly{}).Get("ASM001")
+	c.Assert(stored.Status, check.Equals, "Terminated")
+	c.Assert(stored.Name, check.Equals, "fir")
+}
+
+func names(components []*Component) []string {
+	n := []string{}
+	for _, com := range components {
+		n = append(n, com.Name)
+	}
+	return n
+}
+
+func (s *S) TestOrderedComponents(c *check.C) {
+	asm := &AssemblyWithComponents{Name: "shop", Components: []*Component{
+		&Component{Id: "COM1", Name: "web", RelatedComponents: []string{"shop/worker", "COM3"}},
+		&Component{Id: "COM2", Name: "worker", RelatedComponents: []string{"cache", "elsewhere/db"}},
+		&Component{Id: "COM3", Name: "cache"},
+		nil,
+	}}
+	ordered, err := asm.OrderedComponents()
+	c.Assert(err, check.IsNil)
+	c.Assert(names(ordered), check.DeepEquals, []string{"cache", "worker", "web"})
+}
+
+func (s *S) TestOrderedComponentsCycle(c *check.C) {
+	asm := &AssemblyWithComponents{Name: "shop", Components: []*Component{
+		&Component{Id: "COM1", Name: "web", RelatedComponents: []string{"worker"}},
+		&Component{Id: "COM2", Name: "worker", RelatedComponents: []string{"web"}},
+	}}
+	_, err := asm.OrderedComponents()
+	c.Assert(err, check.ErrorMatches, ".*cycle.*")
+}
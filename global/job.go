@@ -0,0 +1,314 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package global
+
+import (
+	"fmt"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/storage"
+)
+
+const (
+	JOBSBUCKET = "jobs"
+
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_SUCCEEDED = "succeeded"
+	JOB_FAILED    = "failed"
+	// the daemon stopped before the job could finish.
+	JOB_INTERRUPTED = "interrupted"
+
+	JOBINDEXBUCKET   = "jobindex"
+	INTERRUPTEDINDEX = "interrupted"
+	ACTIVEINDEX      = "active"
+
+	// the leases of the megamd processes running jobs.
+	JOBOWNERSBUCKET = "jobowners"
+
+	// layout used for every timestamp megamd writes into riak.
+	TIMEFORMAT = "2006-01-02 15:04:05 -0700"
+)
+
+/*
+* the states a job is allowed to move to from a given state.
+* a failed job may be queued again when the message is retried, an
+* interrupted one when it is resumed. work that completes after the
+* job was marked interrupted still records its outcome.
+ */
+var jobTransitions = map[string][]string{
+	JOB_QUEUED:      []string{JOB_RUNNING, JOB_FAILED, JOB_INTERRUPTED},
+	JOB_RUNNING:     []string{JOB_SUCCEEDED, JOB_FAILED, JOB_INTERRUPTED},
+	JOB_SUCCEEDED:   []string{},
+	JOB_FAILED:      []string{JOB_QUEUED, JOB_INTERRUPTED},
+	JOB_INTERRUPTED: []string{JOB_QUEUED, JOB_SUCCEEDED, JOB_FAILED},
+}
+
+/*
+* Job records the lifecycle of a single message consumed from a queue.
+ */
+type Job struct {
+	Id         string     `json:"id"`
+	RequestId  string     `json:"request_id"`
+	Queue      string     `json:"queue"`
+	Action     string     `json:"action"`
+	Payload    string     `json:"payload"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error"`
+	Attempts   int        `json:"attempts"`
+	Steps      []*JobStep `json:"steps"`
+	CreatedAt  string     `json:"created_at"`
+	StartedAt  string     `json:"started_at"`
+	FinishedAt string     `json:"finished_at"`
+	// the megamd process running the job, its lease tells if it lives.
+	Owner string `json:"owner,omitempty"`
+}
+
+/*
+* JobStep is the progress of one pipeline action on an assembly.
+ */
+type JobStep struct {
+	AssemblyId string `json:"assembly_id"`
+	Action     string `json:"action"`
+	Status     string `json:"status"`
+}
+
+func NewJob(queue string) *Job {
+	return &Job{
+		Id:        "JOB" + RandString(19),
+		Queue:     queue,
+		Status:    JOB_QUEUED,
+		CreatedAt: time.Now().Format(TIMEFORMAT),
+	}
+}
+
+/**
+**fetch the job json from riak and parse the json to struct
+**/
+func (job *Job) Get(jobId string) (*Job, error) {
+	log.Info("Get Job message %v", jobId)
+	ferr := storage.FetchStruct(JOBSBUCKET, jobId, job)
+	if ferr != nil {
+		return job, ferr
+	}
+	return job, nil
+}
+
+/**
+**store the current state of the job into riak
+**/
+func (job *Job) Store() error {
+	return storage.StoreStruct(JOBSBUCKET, job.Id, job)
+}
+
+/*
+* StepStatus returns the status recorded for the action on the
+* assembly, empty when it never started.
+ */
+func (job *Job) StepStatus(assemblyId string, action string) string {
+	for _, step := range job.Steps {
+		if step.AssemblyId == assemblyId && step.Action == action {
+			return step.Status
+		}
+	}
+	return ""
+}
+
+func (job *Job) SetStep(assemblyId string, action string, status string) {
+	for _, step := range job.Steps {
+		if step.AssemblyId == assemblyId && step.Action == action {
+			step.Status = status
+			return
+		}
+	}
+	job.Steps = append(job.Steps, &JobStep{AssemblyId: assemblyId, Action: action, Status: status})
+}
+
+func (job *Job) IsTerminal() bool {
+	return job.Status == JOB_SUCCEEDED || job.Status == JOB_FAILED
+}
+
+/*
+* Transition moves the job to the given state, stamping the time
+* the work started or finished. It doesn't store the job.
+ */
+func (job *Job) Transition(status string) error {
+	allowed := false
+	for _, next := range jobTransitions[job.Status] {
+		if next == status {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("job %s can't move from %s to %s", job.Id, job.Status, status)
+	}
+
+	now := time.Now().Format(TIMEFORMAT)
+	switch status {
+	case JOB_QUEUED:
+		job.Error = ""
+		job.StartedAt = ""
+		job.FinishedAt = ""
+	case JOB_RUNNING:
+		job.StartedAt = now
+		job.Attempts++
+	case JOB_SUCCEEDED, JOB_FAILED, JOB_INTERRUPTED:
+		job.FinishedAt = now
+	}
+	job.Status = status
+	return nil
+}
+
+/*
+* Finish moves the job to succeeded or failed depending on the
+* error returned by the work it tracked, and stores it.
+ */
+func (job *Job) Finish(err error) error {
+	status := JOB_SUCCEEDED
+	if err != nil {
+		status = JOB_FAILED
+		job.Error = err.Error()
+	}
+	if terr := job.Transition(status); terr != nil {
+		return terr
+	}
+	return job.Store()
+}
+
+/*
+* JobIndex lists job ids under a well known key, so the jobs can be
+* found again without scanning the jobs bucket.
+ */
+type JobIndex struct {
+	Ids      []string `json:"ids"`
+	Revision int      `json:"revision"`
+	// the version Get read, updateJobIndex writes over it.
+	read storage.Version
+}
+
+/**
+**fetch the job index json from riak, an index never stored is empty
+**/
+func (idx *JobIndex) Get(key string) (*JobIndex, error) {
+	read, ferr := storage.FetchRevision(JOBINDEXBUCKET, key, idx)
+	if ferr != nil {
+		if !storage.IsNotFound(ferr) {
+			return idx, ferr
+		}
+		idx.Ids = []string{}
+	}
+	idx.read = read
+	return idx, nil
+}
+
+func AddToJobIndex(key string, jobId string) error {
+	return updateJobIndex(key, func(ids []string) []string {
+		for _, id := range ids {
+			if id == jobId {
+				return ids
+			}
+		}
+		return append(ids, jobId)
+	})
+}
+
+func RemoveFromJobIndex(key string, jobId string) error {
+	return updateJobIndex(key, func(ids []string) []string {
+		rest := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if id != jobId {
+				rest = append(rest, id)
+			}
+		}
+		return rest
+	})
+}
+
+/*
+* TakeFromJobIndex removes the job from the index, true when this call
+* removed it. Of two megamd taking the same job only one gets it.
+ */
+func TakeFromJobIndex(key string, jobId string) (bool, error) {
+	taken := false
+	err := updateJobIndex(key, func(ids []string) []string {
+		taken = false
+		rest := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if id == jobId {
+				taken = true
+				continue
+			}
+			rest = append(rest, id)
+		}
+		return rest
+	})
+	return taken, err
+}
+
+/*
+* JobOwner is the lease of a megamd process on the jobs it runs, renewed
+* while it lives. Expires is in unix seconds.
+ */
+type JobOwner struct {
+	Id      string `json:"id"`
+	Expires int64  `json:"expires"`
+}
+
+/*
+* RenewJobOwner stores the lease of the process until expires, the zero
+* time gives it up.
+ */
+func RenewJobOwner(id string, expires time.Time) error {
+	owner := &JobOwner{Id: id}
+	if !expires.IsZero() {
+		owner.Expires = expires.Unix()
+	}
+	return storage.StoreStruct(JOBOWNERSBUCKET, id, owner)
+}
+
+/*
+* JobOwnerAlive tells if the lease of the process hasn't expired, a
+* process that never stored one is gone.
+ */
+func JobOwnerAlive(id string, now time.Time) (bool, error) {
+	owner := &JobOwner{}
+	if err := storage.FetchStruct(JOBOWNERSBUCKET, id, owner); err != nil {
+		if storage.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return owner.Expires > now.Unix(), nil
+}
+
+/*
+* updateJobIndex changes the index, read again when another megamd stored
+* it meanwhile.
+ */
+func updateJobIndex(key string, update func([]string) []string) error {
+	return storage.RetryOnConflict(func() error {
+		idx := &JobIndex{}
+		if _, err := idx.Get(key); err != nil {
+			return err
+		}
+		idx.Ids = update(idx.Ids)
+		idx.Revision++
+		_, err := storage.StoreRevision(JOBINDEXBUCKET, key, idx, idx.read)
+		return err
+	})
+}
@@ -0,0 +1,85 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package global
+
+import (
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestNewJobIsQueued(c *check.C) {
+	job := NewJob("cloudstandup")
+	c.Assert(job.Status, check.Equals, JOB_QUEUED)
+	c.Assert(job.Queue, check.Equals, "cloudstandup")
+	c.Assert(job.CreatedAt, check.Not(check.Equals), "")
+}
+
+func (s *S) TestJobTransitionToRunning(c *check.C) {
+	job := NewJob("cloudstandup")
+	err := job.Transition(JOB_RUNNING)
+	c.Assert(err, check.IsNil)
+	c.Assert(job.Status, check.Equals, JOB_RUNNING)
+	c.Assert(job.StartedAt, check.Not(check.Equals), "")
+	c.Assert(job.Attempts, check.Equals, 1)
+	c.Assert(job.IsTerminal(), check.Equals, false)
+}
+
+func (s *S) TestJobTransitionInvalid(c *check.C) {
+	job := NewJob("cloudstandup")
+	err := job.Transition(JOB_SUCCEEDED)
+	c.Assert(err, check.NotNil)
+	c.Assert(job.Status, check.Equals, JOB_QUEUED)
+}
+
+func (s *S) TestJobFailedCanBeQueuedAgain(c *check.C) {
+	job := NewJob("events")
+	c.Assert(job.Transition(JOB_FAILED), check.IsNil)
+	c.Assert(job.IsTerminal(), check.Equals, true)
+	c.Assert(job.Transition(JOB_QUEUED), check.IsNil)
+	c.Assert(job.FinishedAt, check.Equals, "")
+}
+
+func (s *S) TestJobRunningCanBeInterrupted(c *check.C) {
+	job := NewJob("cloudstandup")
+	c.Assert(job.Transition(JOB_RUNNING), check.IsNil)
+	c.Assert(job.Transition(JOB_INTERRUPTED), check.IsNil)
+	c.Assert(job.IsTerminal(), check.Equals, false)
+	c.Assert(job.Transition(JOB_QUEUED), check.IsNil)
+}
+
+func (s *S) TestJobIndex(c *check.C) {
+	c.Assert(AddToJobIndex("testindex", "JOB1"), check.IsNil)
+	c.Assert(AddToJobIndex("testindex", "JOB2"), check.IsNil)
+	c.Assert(AddToJobIndex("testindex", "JOB1"), check.IsNil)
+	c.Assert(RemoveFromJobIndex("testindex", "JOB1"), check.IsNil)
+	idx, err := (&JobIndex{}).Get("testindex")
+	c.Assert(err, check.IsNil)
+	c.Assert(idx.Ids, check.DeepEquals, []string{"JOB2"})
+	c.Assert(idx.Revision, check.Equals, 4)
+
+	idx, err = (&JobIndex{}).Get("neverstored")
+	c.Assert(err, check.IsNil)
+	c.Assert(idx.Ids, check.HasLen, 0)
+}
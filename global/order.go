@@ -0,0 +1,104 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package global
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+* relatedTo tells whether the entry of RelatedComponents names the
+* component, by id, by name or as <assembly>/<name>.
+ */
+func relatedTo(entry string, com *Component) bool {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return false
+	}
+	if entry == com.Id || entry == com.Name {
+		return true
+	}
+	if i := strings.LastIndex(entry, "/"); i >= 0 {
+		return entry[i+1:] == com.Name
+	}
+	return false
+}
+
+/*
+* CycleError is returned when the components of an assembly relate to
+* each other in a cycle, Component is one of them.
+ */
+type CycleError struct {
+	Assembly  string
+	Component string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("components of assembly %s relate to each other in a cycle through %s", e.Assembly, e.Component)
+}
+
+/*
+* OrderedComponents returns the components of the assembly, each after
+* the components it lists in RelatedComponents. Related components that
+* aren't part of the assembly are ignored, a cycle is a CycleError.
+ */
+func (asm *AssemblyWithComponents) OrderedComponents() ([]*Component, error) {
+	components := []*Component{}
+	for _, com := range asm.Components {
+		if com != nil {
+			components = append(components, com)
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*Component]int, len(components))
+	ordered := make([]*Component, 0, len(components))
+
+	var visit func(com *Component) error
+	visit = func(com *Component) error {
+		switch state[com] {
+		case visited:
+			return nil
+		case visiting:
+			return &CycleError{Assembly: asm.Name, Component: com.Name}
+		}
+		state[com] = visiting
+		for _, entry := range com.RelatedComponents {
+			for _, dep := range components {
+				if dep != com && relatedTo(entry, dep) {
+					if err := visit(dep); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		state[com] = visited
+		ordered = append(ordered, com)
+		return nil
+	}
+
+	for _, com := range components {
+		if err := visit(com); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
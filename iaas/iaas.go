@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"github.com/megamsys/libgo/db"
 	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/storage"
 	"github.com/tsuru/config"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
@@ -55,6 +56,8 @@ type Attributes struct {
     MonitorHost string  `json:"monitor_host"`
     KibanaHost  string  `json:"kibana_host"`
     EtcdHost    string  `json:"etcd_host"`
+    // the environment of each component, by component name.
+    Envs        map[string]map[string]string `json:"envs,omitempty"`
 }
 
 type Plugins struct {
@@ -103,13 +106,7 @@ func GetIaasProvider(name string) (IaaS, *global.PredefClouds, error) {
 func getProviderName(host string) (*global.PredefClouds, error) {
 	pdc := &global.PredefClouds{}
 	
-	conn, err := db.Conn(PREDEFCLOUDSBUCKET)
-
-	if err != nil {
-		return pdc, err
-	}
-
-	ferr := conn.FetchStruct(host, pdc)
+	ferr := storage.FetchStruct(PREDEFCLOUDSBUCKET, host, pdc)
 	if ferr != nil {
 		return pdc, ferr
 	}
@@ -173,12 +170,7 @@ func downloadSshFiles(pdc *global.PredefClouds, keyvalue string, permission os.F
 	email, name := sa[0], sa[1]
 	ssh := &db.SshObject{}
 	
-	conn, err := db.Conn(SSHFILESBUCKET)
-	if err != nil {
-		return err
-	}
-
-	ferr := conn.FetchObject(pdc.Access.IdentityFile+"_"+keyvalue, ssh)
+	ferr := storage.FetchObject(SSHFILESBUCKET, pdc.Access.IdentityFile+"_"+keyvalue, ssh)
 	if ferr != nil {
 		return ferr
 	}
@@ -218,12 +210,7 @@ type AccessKeys struct {
 func GetAccessKeys(pdc *global.PredefClouds) (*AccessKeys, error) {
 	keys := &AccessKeys{}
 	
-	conn, err := db.Conn(CLOUDACCESSKEYSBUCKET)
-	if err != nil {
-		return keys, err
-	}
-
-	ferr := conn.FetchStruct(pdc.Access.VaultLocation, keys)
+	ferr := storage.FetchStruct(CLOUDACCESSKEYSBUCKET, pdc.Access.VaultLocation, keys)
 	if ferr != nil {
 		return keys, ferr
 	}
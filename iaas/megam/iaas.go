@@ -18,6 +18,7 @@ package megam
 import (
 	log "code.google.com/p/log4go"
 	"github.com/megamsys/megamd/iaas"
+	"github.com/megamsys/megamd/app/bind"
 	"github.com/megamsys/megamd/global"
 	"github.com/tsuru/config"
 	"encoding/json"
@@ -102,17 +103,45 @@ func (i *MegamIaaS) CreateMachine(pdc *global.PredefClouds, assembly *global.Ass
 
 	
 	str = str + " --run-list recipe[" + recipe + "]"
-	attributes := &iaas.Attributes{RiakHost: riakHost, AccountID: act_id, AssemblyID: assembly.Id, RabbitMQ: rabbitmqHost, MonitorHost: monitor, KibanaHost: kibana, EtcdHost: etcdHost}
-    b, aerr := json.Marshal(attributes)
-    if aerr != nil {        
-        return "", aerr
-    }
-	str = str + " --json-attributes " + string(b)
+	envs, err_envs := componentEnvs(assembly)
+	if err_envs != nil {
+		return "", err_envs
+	}
+	attributes := &iaas.Attributes{RiakHost: riakHost, AccountID: act_id, AssemblyID: assembly.Id, RabbitMQ: rabbitmqHost, MonitorHost: monitor, KibanaHost: kibana, EtcdHost: etcdHost, Envs: envs}
+	// the environment holds secrets, the command runs with them in a file.
+	b, aerr := json.Marshal(attributes)
+	if aerr != nil {
+		return "", aerr
+	}
+	assembly.Attributes = b
 	
 	return str, nil
  
 }
 
+/*
+* the environment of the components, the variables of their inputs and
+* bound services.
+*/
+func componentEnvs(assembly *global.AssemblyWithComponents) (map[string]map[string]string, error) {
+	envs := make(map[string]map[string]string)
+	for _, com := range assembly.Components {
+		if com == nil {
+			continue
+		}
+		vars, err := bind.ComponentEnv(com)
+		if err != nil {
+			log.Error("Failed to get the environment of %s : %s", com.Name, err)
+			return nil, err
+		}
+		if len(vars) > 0 {
+			log.Debug("Environment of %s : %s", com.Name, bind.Masked(vars))
+			envs[com.Name] = bind.EnvMap(vars)
+		}
+	}
+	return envs, nil
+}
+
 /*
 * delete the machine from megam server using knife opennebula plugin
 */
@@ -0,0 +1,90 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package ipam
+
+import (
+	"math"
+	"net"
+)
+
+// Given Subnet of interest and free bit position, this method returns the corresponding ip address
+// This method is functional and tested. Refer to ipam_test.go But can be improved
+
+func getIP(subnet net.IPNet, pos uint) net.IP {
+	retAddr := make([]byte, len(subnet.IP))
+	copy(retAddr, subnet.IP)
+
+	mask, _ := subnet.Mask.Size()
+	var tb, byteCount, bitCount int
+	if subnet.IP.To4() != nil {
+		tb = 4
+		byteCount = (32 - mask) / 8
+		bitCount = (32 - mask) % 8
+	} else {
+		tb = 16
+		byteCount = (128 - mask) / 8
+		bitCount = (128 - mask) % 8
+	}
+
+	for i := 0; i <= byteCount; i++ {
+		maskLen := 0xFF
+		if i == byteCount {
+			if bitCount != 0 {
+				maskLen = int(math.Pow(2, float64(bitCount))) - 1
+			} else {
+				maskLen = 0
+			}
+		}
+		masked := pos & uint((0xFF&maskLen)<<uint(8*i))
+		retAddr[tb-i-1] |= byte(masked >> uint(8*i))
+	}
+	return net.IP(retAddr)
+}
+
+func bitCount(addr net.IPNet) float64 {
+	mask, _ := addr.Mask.Size()
+	if addr.IP.To4() != nil {
+		return math.Pow(2, float64(32-mask))
+	} else {
+		return math.Pow(2, float64(128-mask))
+	}
+}
+
+/*
+* testAndSetBit sets the first clear bit and returns its position,
+* false when every bit is set.
+ */
+func testAndSetBit(a []byte) (uint, bool) {
+	for i := uint(0); i < uint(len(a)*8); i++ {
+		if !testBit(a, i) {
+			setBit(a, i)
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func testBit(a []byte, k uint) bool {
+	return ((a[k/8] & (1 << (k % 8))) != 0)
+}
+
+func setBit(a []byte, k uint) {
+	a[k/8] |= 1 << (k % 8)
+}
+
+func clearBit(a []byte, k uint) {
+	a[k/8] &^= 1 << (k % 8)
+}
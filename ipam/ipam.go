@@ -0,0 +1,441 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/storage"
+)
+
+const (
+	IPAMBUCKET = "ipam"
+
+	/*
+	* an owner holding an address for a container about to be created.
+	* One left over by a megamd that died before the container was
+	* created is released after PendingTimeout.
+	 */
+	PENDING        = "pending:"
+	PendingTimeout = time.Hour
+
+	// a pool tracks at most the first 2^maxHostBits addresses of its subnet,
+	// the bitmap of a bigger one (an ipv6 /64) is too large to store.
+	maxHostBits = 16
+)
+
+/*
+* Pool tracks the addresses of a subnet handed out to containers, one bit
+* per address. It is stored with a revision, so two megamd allocating
+* from the same pool never hand out the same address.
+ */
+type Pool struct {
+	Name        string          `json:"name"`
+	Subnet      string          `json:"subnet"`
+	Bitmap      []byte          `json:"bitmap"`
+	Allocations map[string]uint `json:"allocations"`
+	// the assembly of each container holding an address.
+	Assemblies map[string]string `json:"assemblies"`
+	// when each pending owner took its address, in unix seconds.
+	Pending  map[string]int64 `json:"pending,omitempty"`
+	Revision int              `json:"revision"`
+	// the version getPool read, store writes over it.
+	read storage.Version
+}
+
+/*
+* ExhaustedError is returned when every address of a pool is in use.
+ */
+type ExhaustedError struct {
+	Pool   string
+	Subnet string
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("ip pool %s (%s) has no free address left", e.Pool, e.Subnet)
+}
+
+/*
+* InUseError is returned when an address asked for is already taken.
+ */
+type InUseError struct {
+	Pool string
+	IP   string
+}
+
+func (e *InUseError) Error() string {
+	return fmt.Sprintf("ip %s of pool %s is in use", e.IP, e.Pool)
+}
+
+/*
+* HeldError is returned when releasing an address a container holds.
+ */
+type HeldError struct {
+	Pool      string
+	IP        string
+	Container string
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("ip %s of pool %s is held by container %s", e.IP, e.Pool, e.Container)
+}
+
+// serializes the allocations made by this megamd.
+var mu sync.Mutex
+
+// how many addresses of the subnet the pool tracks.
+func poolSize(subnet *net.IPNet) uint {
+	ones, bits := subnet.Mask.Size()
+	if bits-ones > maxHostBits {
+		return 1 << maxHostBits
+	}
+	return uint(bitCount(*subnet))
+}
+
+/*
+* newPool reserves the network address, the gateway (the first address
+* when it isn't in the subnet), the ipv4 broadcast address and the
+* excluded ranges. The positions up to handedOut were given away before
+* the pool existed.
+ */
+func newPool(conf *PoolConfig, handedOut uint) (*Pool, error) {
+	subnet := conf.Subnet
+	size := poolSize(subnet)
+	p := &Pool{
+		Name:        conf.Name,
+		Subnet:      subnet.String(),
+		Bitmap:      make([]byte, (size+7)/8),
+		Allocations: make(map[string]uint),
+		Assemblies:  make(map[string]string),
+	}
+	reserve := func(first uint, last uint) {
+		for i := first; i <= last && i < size; i++ {
+			setBit(p.Bitmap, i)
+		}
+	}
+	// the bits past the end of the subnet are never handed out.
+	for i := size; i < uint(len(p.Bitmap)*8); i++ {
+		setBit(p.Bitmap, i)
+	}
+	reserve(0, handedOut)
+
+	if gw, ok := offset(subnet, conf.Gateway); ok {
+		reserve(gw, gw)
+	} else if size > 2 {
+		reserve(1, 1)
+	}
+	if subnet.IP.To4() != nil && size > 2 && size == uint(bitCount(*subnet)) {
+		reserve(size-1, size-1)
+	}
+	for _, ex := range conf.Exclude {
+		first, last, err := excluded(subnet, ex)
+		if err != nil {
+			return nil, fmt.Errorf("ip pool %s : %s", conf.Name, err)
+		}
+		reserve(first, last)
+	}
+	return p, nil
+}
+
+func getPool(conf *PoolConfig) (*Pool, error) {
+	p := &Pool{}
+	read, err := storage.FetchRevision(IPAMBUCKET, conf.Name, p)
+	if err != nil {
+		return nil, fmt.Errorf("ip pool %s is not available : %s", conf.Name, err)
+	}
+	p.read = read
+	if p.Subnet != conf.Subnet.String() {
+		return nil, fmt.Errorf("ip pool %s was created for %s, not %s", conf.Name, p.Subnet, conf.Subnet)
+	}
+	if p.Allocations == nil {
+		p.Allocations = make(map[string]uint)
+	}
+	if p.Assemblies == nil {
+		p.Assemblies = make(map[string]string)
+	}
+	if p.Pending == nil {
+		p.Pending = make(map[string]int64)
+	}
+	return p, nil
+}
+
+func (p *Pool) store() error {
+	p.Revision++
+	read, err := storage.StoreRevision(IPAMBUCKET, p.Name, p, p.read)
+	if err != nil {
+		p.Revision--
+		return err
+	}
+	p.read = read
+	return nil
+}
+
+/*
+* Init creates the named pool unless it exists. handedOut is the index of
+* the old ip generator, the addresses below it stay reserved. The pending
+* owners of an existing pool that outlived PendingTimeout are released.
+ */
+func Init(name string, handedOut uint) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	conf, err := GetPoolConfig(name)
+	if err != nil {
+		return err
+	}
+	stored := &Pool{}
+	read, ferr := storage.FetchRevision(IPAMBUCKET, conf.Name, stored)
+	if ferr == nil && stored.Subnet != "" {
+		if stored.Subnet != conf.Subnet.String() {
+			return fmt.Errorf("ip pool %s was created for %s, not %s", conf.Name, stored.Subnet, conf.Subnet)
+		}
+		return sweepPending(conf, time.Now())
+	}
+	p, err := newPool(conf, handedOut)
+	if err != nil {
+		return err
+	}
+	// a record without a subnet is written over.
+	p.Revision, p.read = stored.Revision, read
+	if err := p.store(); err != nil && err != storage.ErrConflict {
+		return err
+	}
+	log.Info("ip pool %s %s created", conf.Name, conf.Subnet)
+	return nil
+}
+
+/*
+* sweepPending releases the addresses of the pending owners taken before
+* now less PendingTimeout, or before their time was recorded.
+ */
+func sweepPending(conf *PoolConfig, now time.Time) error {
+	return storage.RetryOnConflict(func() error {
+		p, err := getPool(conf)
+		if err != nil {
+			return err
+		}
+		stale := map[string]uint{}
+		for owner, pos := range p.Allocations {
+			if strings.HasPrefix(owner, PENDING) && now.Sub(time.Unix(p.Pending[owner], 0)) > PendingTimeout {
+				stale[owner] = pos
+			}
+		}
+		if len(stale) == 0 {
+			return nil
+		}
+		for owner, pos := range stale {
+			p.free(owner, pos)
+		}
+		if err := p.store(); err != nil {
+			return err
+		}
+		for owner, pos := range stale {
+			log.Info("ip %s of pool %s released by stale %s", getIP(*conf.Subnet, pos), conf.Name, owner)
+		}
+		return nil
+	})
+}
+
+/*
+* Allocate hands out a free address of the named pool to the container
+* of the assembly. The same address is returned when the container
+* already has one.
+ */
+func Allocate(name string, containerId string, assemblyId string) (net.IP, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	conf, err := GetPoolConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	var pos uint
+	err = storage.RetryOnConflict(func() error {
+		p, err := getPool(conf)
+		if err != nil {
+			return err
+		}
+		if existing, ok := p.Allocations[containerId]; ok {
+			pos = existing
+			return nil
+		}
+		free, ok := testAndSetBit(p.Bitmap)
+		if !ok {
+			return &ExhaustedError{Pool: conf.Name, Subnet: p.Subnet}
+		}
+		pos = free
+		p.Allocations[containerId] = pos
+		p.Assemblies[containerId] = assemblyId
+		if strings.HasPrefix(containerId, PENDING) {
+			p.Pending[containerId] = time.Now().Unix()
+		}
+		return p.store()
+	})
+	if err != nil {
+		return nil, err
+	}
+	ip := getIP(*conf.Subnet, pos)
+	log.Info("ip %s of pool %s allocated to container %s", ip, conf.Name, containerId)
+	return ip, nil
+}
+
+/*
+* Release gives the address of the container back to the named pool. A
+* container without an address is ignored.
+ */
+func Release(name string, containerId string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	conf, err := GetPoolConfig(name)
+	if err != nil {
+		return err
+	}
+	return storage.RetryOnConflict(func() error {
+		p, err := getPool(conf)
+		if err != nil {
+			return err
+		}
+		pos, ok := p.Allocations[containerId]
+		if !ok {
+			return nil
+		}
+		p.free(containerId, pos)
+		if err := p.store(); err != nil {
+			return err
+		}
+		log.Info("ip %s of pool %s released by container %s", getIP(*conf.Subnet, pos), conf.Name, containerId)
+		return nil
+	})
+}
+
+func (p *Pool) free(owner string, pos uint) {
+	clearBit(p.Bitmap, pos)
+	delete(p.Allocations, owner)
+	delete(p.Assemblies, owner)
+	delete(p.Pending, owner)
+}
+
+/*
+* Reserve takes the address out of the named pool for the owner, it is
+* handed out again once released.
+ */
+func Reserve(name string, ip net.IP, owner string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	conf, err := GetPoolConfig(name)
+	if err != nil {
+		return err
+	}
+	pos, ok := offset(conf.Subnet, ip)
+	if !ok || pos >= poolSize(conf.Subnet) {
+		return fmt.Errorf("ip %s is not in pool %s (%s)", ip, conf.Name, conf.Subnet)
+	}
+	return storage.RetryOnConflict(func() error {
+		p, err := getPool(conf)
+		if err != nil {
+			return err
+		}
+		if testBit(p.Bitmap, pos) {
+			return &InUseError{Pool: conf.Name, IP: ip.String()}
+		}
+		setBit(p.Bitmap, pos)
+		p.Allocations[owner] = pos
+		if err := p.store(); err != nil {
+			return err
+		}
+		log.Info("ip %s of pool %s reserved for %s", ip, conf.Name, owner)
+		return nil
+	})
+}
+
+/*
+* Reassign hands the address held by one owner to another, the container
+* created with an address taken under its name gets it under its id.
+ */
+func Reassign(name string, from string, to string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	conf, err := GetPoolConfig(name)
+	if err != nil {
+		return err
+	}
+	return storage.RetryOnConflict(func() error {
+		p, err := getPool(conf)
+		if err != nil {
+			return err
+		}
+		pos, ok := p.Allocations[from]
+		if !ok {
+			return fmt.Errorf("%s holds no address of pool %s", from, conf.Name)
+		}
+		if _, taken := p.Allocations[to]; taken {
+			return fmt.Errorf("%s already holds an address of pool %s", to, conf.Name)
+		}
+		p.Allocations[to] = pos
+		p.Assemblies[to] = p.Assemblies[from]
+		delete(p.Allocations, from)
+		delete(p.Assemblies, from)
+		delete(p.Pending, from)
+		return p.store()
+	})
+}
+
+/*
+* ReleaseIP gives the reserved address back to the named pool. An
+* address allocated to a container is only released when forced, the
+* container would go on using it.
+ */
+func ReleaseIP(name string, ip net.IP, force bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	conf, err := GetPoolConfig(name)
+	if err != nil {
+		return err
+	}
+	pos, ok := offset(conf.Subnet, ip)
+	if !ok {
+		return fmt.Errorf("ip %s is not in pool %s (%s)", ip, conf.Name, conf.Subnet)
+	}
+	return storage.RetryOnConflict(func() error {
+		p, err := getPool(conf)
+		if err != nil {
+			return err
+		}
+		for owner, held := range p.Allocations {
+			if held == pos {
+				if _, container := p.Assemblies[owner]; container && !force {
+					return &HeldError{Pool: conf.Name, IP: ip.String(), Container: owner}
+				}
+				p.free(owner, pos)
+				if err := p.store(); err != nil {
+					return err
+				}
+				log.Info("ip %s of pool %s released from %s", ip, conf.Name, owner)
+				return nil
+			}
+		}
+		return fmt.Errorf("ip %s of pool %s is not allocated", ip, conf.Name)
+	})
+}
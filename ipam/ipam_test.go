@@ -0,0 +1,332 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	config.Set("storage:backend", "file")
+	config.Set("storage:path", filepath.Join(c.MkDir(), "megamd.db"))
+}
+
+func pool(name string, cidr string) string {
+	config.Set("ipam:pools:"+name+":subnet", cidr)
+	return name
+}
+
+func (s *S) TestGetIpFullMask(c *check.C) {
+	_, subnet, _ := net.ParseCIDR("192.168.1.89/24")
+	ip := getIP(*subnet, 7)
+	c.Assert(ip.String(), check.Equals, "192.168.1.7")
+}
+
+func (s *S) TestAllocateSkipsReserved(c *check.C) {
+	n := pool("p1", "10.1.1.0/24")
+	c.Assert(Init(n, 0), check.IsNil)
+
+	ip, err := Allocate(n, "c1", "ASM1")
+	c.Assert(err, check.IsNil)
+	c.Assert(ip.String(), check.Equals, "10.1.1.2")
+
+	again, _ := Allocate(n, "c1", "ASM1")
+	c.Assert(again.String(), check.Equals, "10.1.1.2")
+}
+
+func (s *S) TestInitKeepsOldIndex(c *check.C) {
+	n := pool("p2", "10.1.2.0/24")
+	c.Assert(Init(n, 5), check.IsNil)
+
+	ip, err := Allocate(n, "c1", "ASM1")
+	c.Assert(err, check.IsNil)
+	c.Assert(ip.String(), check.Equals, "10.1.2.6")
+}
+
+func (s *S) TestReleaseReusesAddress(c *check.C) {
+	n := pool("p3", "10.1.3.0/24")
+	Init(n, 0)
+	first, _ := Allocate(n, "c1", "ASM1")
+	Allocate(n, "c2", "ASM1")
+
+	c.Assert(Release(n, "c1"), check.IsNil)
+	c.Assert(Release(n, "unknown"), check.IsNil)
+	reused, err := Allocate(n, "c3", "ASM1")
+	c.Assert(err, check.IsNil)
+	c.Assert(reused.String(), check.Equals, first.String())
+}
+
+func (s *S) TestAllocateExhausted(c *check.C) {
+	n := pool("p4", "10.1.4.0/30")
+	Init(n, 0)
+	_, err := Allocate(n, "c1", "ASM1")
+	c.Assert(err, check.IsNil)
+	_, err = Allocate(n, "c2", "ASM1")
+	c.Assert(err, check.FitsTypeOf, &ExhaustedError{})
+	c.Assert(err, check.ErrorMatches, "ip pool p4 \\(10.1.4.0/30\\) has no free address left")
+}
+
+func (s *S) TestAllocateConcurrentIsUnique(c *check.C) {
+	n := pool("p5", "10.1.5.0/24")
+	Init(n, 0)
+
+	var wg sync.WaitGroup
+	ips := make([]string, 20)
+	for i := range ips {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip, err := Allocate(n, fmt.Sprintf("c%d", i), "ASM1")
+			c.Check(err, check.IsNil)
+			ips[i] = ip.String()
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, ip := range ips {
+		c.Assert(seen[ip], check.Equals, false)
+		seen[ip] = true
+	}
+}
+
+/*
+* TestAllocatorProcess is a megamd of its own for
+* TestAllocateFromTwoProcesses, it does nothing unless started by it.
+ */
+func TestAllocatorProcess(t *testing.T) {
+	if os.Getenv("IPAM_STORAGE") == "" {
+		return
+	}
+	config.Set("storage:backend", "file")
+	config.Set("storage:path", os.Getenv("IPAM_STORAGE"))
+	n := pool("shared", "10.1.9.0/24")
+	if err := Init(n, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		ip, err := Allocate(n, fmt.Sprintf("%s-%d", os.Getenv("IPAM_OWNER"), i), "ASM1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Println(ip)
+	}
+}
+
+func (s *S) TestAllocateFromTwoProcesses(c *check.C) {
+	path := filepath.Join(c.MkDir(), "megamd.db")
+	config.Set("storage:path", path)
+	defer config.Set("storage:path", filepath.Join(c.MkDir(), "megamd.db"))
+
+	var wg sync.WaitGroup
+	outputs := make([]string, 2)
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=TestAllocatorProcess")
+			cmd.Env = append(os.Environ(), "IPAM_STORAGE="+path, fmt.Sprintf("IPAM_OWNER=megamd%d", i))
+			out, err := cmd.CombinedOutput()
+			c.Check(err, check.IsNil, check.Commentf("%s", out))
+			outputs[i] = string(out)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, out := range outputs {
+		for _, line := range strings.Split(out, "\n") {
+			if net.ParseIP(line) == nil {
+				continue
+			}
+			c.Assert(seen[line], check.Equals, false, check.Commentf("%s handed out twice", line))
+			seen[line] = true
+		}
+	}
+	c.Assert(seen, check.HasLen, 20, check.Commentf("%v", outputs))
+}
+
+func (s *S) TestGatewayAndExcludedRanges(c *check.C) {
+	n := pool("p6", "10.1.6.0/29")
+	config.Set("ipam:pools:p6:gateway", "10.1.6.2")
+	config.Set("ipam:pools:p6:exclude", []string{"10.1.6.3-10.1.6.4", "10.1.6.6"})
+	c.Assert(Init(n, 0), check.IsNil)
+
+	first, _ := Allocate(n, "c1", "ASM1")
+	second, _ := Allocate(n, "c2", "ASM1")
+	c.Assert(first.String(), check.Equals, "10.1.6.1")
+	c.Assert(second.String(), check.Equals, "10.1.6.5")
+	_, err := Allocate(n, "c3", "ASM1")
+	c.Assert(err, check.FitsTypeOf, &ExhaustedError{})
+}
+
+func (s *S) TestIPv6Pool(c *check.C) {
+	n := pool("six", "fd00:5::/64")
+	config.Set("ipam:pools:six:gateway", "fd00:5::1")
+	c.Assert(Init(n, 0), check.IsNil)
+
+	ip, err := Allocate(n, "c1", "ASM1")
+	c.Assert(err, check.IsNil)
+	c.Assert(ip.String(), check.Equals, "fd00:5::2")
+}
+
+func (s *S) TestPoolNotConfigured(c *check.C) {
+	_, err := Allocate("nowhere", "c1", "ASM1")
+	c.Assert(err, check.ErrorMatches, "ip pool nowhere is not configured")
+}
+
+func (s *S) TestSubnetChangeRefused(c *check.C) {
+	n := pool("p7", "10.1.7.0/24")
+	c.Assert(Init(n, 0), check.IsNil)
+	pool("p7", "10.1.8.0/24")
+	c.Assert(Init(n, 0), check.ErrorMatches, "ip pool p7 was created for 10.1.7.0/24, not 10.1.8.0/24")
+}
+
+func (s *S) TestDefaultPoolFromDockerSubnet(c *check.C) {
+	config.Set("docker:subnet", "10.1.9.0/24")
+	config.Set("docker:bridge", "one")
+	conf, err := GetPoolConfig("")
+	c.Assert(err, check.IsNil)
+	c.Assert(conf.Name, check.Equals, DEFAULTPOOL)
+	c.Assert(conf.Subnet.String(), check.Equals, "10.1.9.0/24")
+	c.Assert(conf.Bridge, check.Equals, "one")
+}
+
+func (s *S) TestReserveAndReleaseIP(c *check.C) {
+	n := pool("p8", "10.1.10.0/24")
+	Init(n, 0)
+	c.Assert(Reserve(n, net.ParseIP("10.1.10.2"), "router"), check.IsNil)
+	c.Assert(Reserve(n, net.ParseIP("10.1.10.2"), "other"), check.FitsTypeOf, &InUseError{})
+	c.Assert(Reserve(n, net.ParseIP("10.2.0.1"), "other"), check.NotNil)
+
+	ip, _ := Allocate(n, "c1", "ASM1")
+	c.Assert(ip.String(), check.Equals, "10.1.10.3")
+
+	c.Assert(ReleaseIP(n, net.ParseIP("10.1.10.2"), false), check.IsNil)
+	c.Assert(ReleaseIP(n, net.ParseIP("10.1.10.2"), false), check.ErrorMatches, ".*not allocated")
+	again, _ := Allocate(n, "c2", "ASM2")
+	c.Assert(again.String(), check.Equals, "10.1.10.2")
+}
+
+func (s *S) TestReleaseIPHeldByContainer(c *check.C) {
+	n := pool("p12", "10.1.14.0/24")
+	Init(n, 0)
+	ip, _ := Allocate(n, "c1", "ASM1")
+	c.Assert(ReleaseIP(n, ip, false), check.FitsTypeOf, &HeldError{})
+	c.Assert(ReleaseIP(n, ip, true), check.IsNil)
+	again, _ := Allocate(n, "c2", "ASM2")
+	c.Assert(again.String(), check.Equals, ip.String())
+}
+
+func (s *S) TestUsage(c *check.C) {
+	n := pool("p9", "10.1.11.0/28")
+	Init(n, 0)
+	Allocate(n, "c2", "ASM2")
+	Allocate(n, "c1", "ASM1")
+
+	u, err := GetUsage(n)
+	c.Assert(err, check.IsNil)
+	c.Assert(u.Size, check.Equals, 16)
+	c.Assert(u.Used, check.Equals, 5)
+	c.Assert(u.Free, check.Equals, 11)
+	c.Assert(u.Allocations, check.HasLen, 2)
+	c.Assert(u.Allocations[0].Owner, check.Equals, "c2")
+	c.Assert(u.Allocations[0].IP, check.Equals, "10.1.11.2")
+	c.Assert(u.Allocations[0].AssemblyId, check.Equals, "ASM2")
+}
+
+func (s *S) TestPoolDriver(c *check.C) {
+	n := pool("p10", "10.1.12.0/24")
+	conf, err := GetPoolConfig(n)
+	c.Assert(err, check.IsNil)
+	c.Assert(conf.Driver, check.Equals, GULPD)
+	c.Assert(conf.Native(), check.Equals, false)
+
+	config.Set("ipam:pools:p10:driver", "macvlan")
+	defer config.Unset("ipam:pools:p10:driver")
+	_, err = GetPoolConfig(n)
+	c.Assert(err, check.ErrorMatches, "ip pool p10 : a macvlan network needs a parent interface")
+
+	config.Set("ipam:pools:p10:parent", "eth1")
+	defer config.Unset("ipam:pools:p10:parent")
+	conf, err = GetPoolConfig(n)
+	c.Assert(err, check.IsNil)
+	c.Assert(conf.Native(), check.Equals, true)
+	c.Assert(conf.Network, check.Equals, "p10")
+
+	config.Set("ipam:pools:p10:driver", "overlay")
+	_, err = GetPoolConfig(n)
+	c.Assert(err, check.ErrorMatches, "ip pool p10 : overlay is not a network driver.*")
+}
+
+func (s *S) TestReassign(c *check.C) {
+	n := pool("p11", "10.1.13.0/24")
+	Init(n, 0)
+	ip, _ := Allocate(n, "pending:c1", "ASM1")
+	Allocate(n, "c2", "ASM1")
+
+	c.Assert(Reassign(n, "pending:c1", "c2"), check.ErrorMatches, "c2 already holds an address of pool p11")
+	c.Assert(Reassign(n, "pending:c1", "c1"), check.IsNil)
+	c.Assert(Reassign(n, "pending:c1", "c1"), check.ErrorMatches, "pending:c1 holds no address of pool p11")
+
+	held, err := Allocate(n, "c1", "ASM1")
+	c.Assert(err, check.IsNil)
+	c.Assert(held.String(), check.Equals, ip.String())
+}
+
+func (s *S) TestInitSweepsStalePending(c *check.C) {
+	n := pool("p13", "10.1.15.0/24")
+	Init(n, 0)
+	stale, _ := Allocate(n, "pending:c1", "ASM1")
+	Allocate(n, "pending:c2", "ASM1")
+	Allocate(n, "c3", "ASM1")
+
+	conf, _ := GetPoolConfig(n)
+	p, err := getPool(conf)
+	c.Assert(err, check.IsNil)
+	p.Pending["pending:c1"] = time.Now().Add(-2 * PendingTimeout).Unix()
+	c.Assert(p.store(), check.IsNil)
+
+	c.Assert(Init(n, 0), check.IsNil)
+	p, err = getPool(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(p.Allocations, check.HasLen, 2)
+	_, ok := p.Allocations["pending:c1"]
+	c.Assert(ok, check.Equals, false)
+	_, ok = p.Allocations["pending:c2"]
+	c.Assert(ok, check.Equals, true)
+	again, _ := Allocate(n, "c4", "ASM1")
+	c.Assert(again.String(), check.Equals, stale.String())
+}
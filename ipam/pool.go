@@ -0,0 +1,224 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/tsuru/config"
+)
+
+const (
+	DEFAULTPOOL = "default"
+
+	// the drivers networking the containers of a pool. gulpd sets up the
+	// address once the container runs, the others are docker networks
+	// the container joins with its address.
+	GULPD   = "gulpd"
+	BRIDGE  = "bridge"
+	MACVLAN = "macvlan"
+
+	// the assembly input naming the pool its containers get their ip from.
+	POOLINPUT = "ip_pool"
+)
+
+/*
+* PoolConfig is a named address pool of the conf file.
+*
+*   ipam:
+*     default: one
+*     pools:
+*       one:
+*         subnet: 103.56.93.0/24
+*         gateway: 103.56.93.1
+*         bridge: one
+*         exclude:
+*           - 103.56.93.2-103.56.93.20
+*       six:
+*         subnet: fd00:5::/64
+*         driver: macvlan
+*         network: six
+*         parent: eth1
+*
+* Without ipam:pools, docker:subnet, docker:gateway and docker:bridge
+* make the default pool.
+ */
+type PoolConfig struct {
+	Name    string
+	Subnet  *net.IPNet
+	Gateway net.IP
+	Bridge  string
+	// single addresses, first-last ranges or cidrs never handed out.
+	Exclude []string
+	// gulpd, bridge or macvlan, and the docker network of the last two,
+	// named after the pool unless told otherwise.
+	Driver  string
+	Network string
+	// the host interface of a macvlan network.
+	Parent string
+}
+
+/*
+* Native is true when the containers join a docker network of the pool.
+ */
+func (c *PoolConfig) Native() bool {
+	return c.Driver != GULPD
+}
+
+/*
+* NotConfiguredError is returned for a pool missing in the conf file.
+ */
+type NotConfiguredError struct {
+	Pool string
+}
+
+func (e *NotConfiguredError) Error() string {
+	return fmt.Sprintf("ip pool %s is not configured", e.Pool)
+}
+
+/*
+* GetPoolConfig returns the pool named in the conf file, the default
+* pool (ipam:default) when name is empty.
+ */
+func GetPoolConfig(name string) (*PoolConfig, error) {
+	if name == "" {
+		name = defaultPoolName()
+	}
+	prefix := "ipam:pools:" + name + ":"
+	subnetip, err := config.GetString(prefix + "subnet")
+	if err != nil || subnetip == "" {
+		if name != DEFAULTPOOL {
+			return nil, &NotConfiguredError{Pool: name}
+		}
+		// the pool megamd used before named pools.
+		prefix = "docker:"
+		subnetip, _ = config.GetString(prefix + "subnet")
+	}
+
+	_, subnet, perr := net.ParseCIDR(subnetip)
+	if perr != nil {
+		return nil, fmt.Errorf("ip pool %s has no valid subnet : %s", name, perr)
+	}
+	conf := &PoolConfig{Name: name, Subnet: subnet}
+	conf.Bridge, _ = config.GetString(prefix + "bridge")
+	if gateway, gerr := config.GetString(prefix + "gateway"); gerr == nil && gateway != "" {
+		if conf.Gateway = net.ParseIP(gateway); conf.Gateway == nil {
+			return nil, fmt.Errorf("ip pool %s has an invalid gateway %s", name, gateway)
+		}
+	}
+	conf.Driver = GULPD
+	if prefix != "docker:" {
+		conf.Exclude, _ = config.GetList(prefix + "exclude")
+		if driver, derr := config.GetString(prefix + "driver"); derr == nil && driver != "" {
+			conf.Driver = driver
+		}
+		conf.Network, _ = config.GetString(prefix + "network")
+		conf.Parent, _ = config.GetString(prefix + "parent")
+	}
+	switch conf.Driver {
+	case GULPD, BRIDGE:
+	case MACVLAN:
+		if conf.Parent == "" {
+			return nil, fmt.Errorf("ip pool %s : a macvlan network needs a parent interface", name)
+		}
+	default:
+		return nil, fmt.Errorf("ip pool %s : %s is not a network driver, it is gulpd, bridge or macvlan", name, conf.Driver)
+	}
+	if conf.Native() && conf.Network == "" {
+		conf.Network = name
+	}
+	return conf, nil
+}
+
+func defaultPoolName() string {
+	if name, err := config.GetString("ipam:default"); err == nil && name != "" {
+		return name
+	}
+	return DEFAULTPOOL
+}
+
+/*
+* PoolNames lists the pools of the conf file.
+ */
+func PoolNames() []string {
+	names := []string{}
+	if pools, err := config.Get("ipam:pools"); err == nil {
+		if m, ok := pools.(map[interface{}]interface{}); ok {
+			for name := range m {
+				names = append(names, fmt.Sprint(name))
+			}
+		}
+	}
+	if len(names) == 0 {
+		if subnetip, err := config.GetString("docker:subnet"); err == nil && subnetip != "" {
+			names = append(names, DEFAULTPOOL)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+* offset is the position of the ip in the subnet, false when the subnet
+* doesn't hold it or it lies past the addresses a pool tracks.
+ */
+func offset(subnet *net.IPNet, ip net.IP) (uint, bool) {
+	if ip == nil || !subnet.Contains(ip) {
+		return 0, false
+	}
+	a, n := ip.To16(), subnet.IP.To16()
+	for i := 0; i < 16-maxHostBits/8; i++ {
+		if a[i] != n[i] {
+			return 0, false
+		}
+	}
+	var pos uint
+	for i := 16 - maxHostBits/8; i < 16; i++ {
+		pos = pos<<8 | uint(a[i]^n[i])
+	}
+	return pos, true
+}
+
+/*
+* excluded returns the first and last position of an excluded range.
+ */
+func excluded(subnet *net.IPNet, ex string) (uint, uint, error) {
+	if strings.Contains(ex, "/") {
+		_, n, err := net.ParseCIDR(ex)
+		if err != nil {
+			return 0, 0, err
+		}
+		first, ok := offset(subnet, n.IP)
+		if !ok {
+			return 0, 0, fmt.Errorf("%s is not in %s", ex, subnet)
+		}
+		return first, first + uint(bitCount(*n)) - 1, nil
+	}
+
+	bounds := strings.SplitN(ex, "-", 2)
+	first, fok := offset(subnet, net.ParseIP(strings.TrimSpace(bounds[0])))
+	last, lok := first, fok
+	if len(bounds) == 2 {
+		last, lok = offset(subnet, net.ParseIP(strings.TrimSpace(bounds[1])))
+	}
+	if !fok || !lok || last < first {
+		return 0, 0, fmt.Errorf("%s is not a range of %s", ex, subnet)
+	}
+	return first, last, nil
+}
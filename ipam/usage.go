@@ -0,0 +1,119 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package ipam
+
+import (
+	"sort"
+)
+
+/*
+* Allocation is an address handed out to a container, or reserved by
+* hand for an owner.
+ */
+type Allocation struct {
+	IP         string `json:"ip"`
+	Owner      string `json:"owner"`
+	AssemblyId string `json:"assembly_id"`
+}
+
+/*
+* Usage reports how much of a pool is used. Used counts the addresses
+* reserved for the network, gateway and excluded ranges too.
+ */
+type Usage struct {
+	Name        string        `json:"name"`
+	Subnet      string        `json:"subnet"`
+	Gateway     string        `json:"gateway"`
+	Bridge      string        `json:"bridge"`
+	Size        int           `json:"size"`
+	Used        int           `json:"used"`
+	Free        int           `json:"free"`
+	Utilization float64       `json:"utilization"`
+	Allocations []*Allocation `json:"allocations,omitempty"`
+}
+
+/*
+* GetUsage returns the usage of the named pool, with its allocations
+* ordered by address.
+ */
+func GetUsage(name string) (*Usage, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	conf, err := GetPoolConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := getPool(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	size := poolSize(conf.Subnet)
+	u := &Usage{Name: conf.Name, Subnet: p.Subnet, Bridge: conf.Bridge, Size: int(size)}
+	if conf.Gateway != nil {
+		u.Gateway = conf.Gateway.String()
+	}
+	for i := uint(0); i < size; i++ {
+		if testBit(p.Bitmap, i) {
+			u.Used++
+		}
+	}
+	u.Free = u.Size - u.Used
+	if u.Size > 0 {
+		u.Utilization = float64(u.Used) / float64(u.Size)
+	}
+
+	positions := make(map[string]uint, len(p.Allocations))
+	for owner, pos := range p.Allocations {
+		positions[owner] = pos
+		u.Allocations = append(u.Allocations, &Allocation{
+			IP:         getIP(*conf.Subnet, pos).String(),
+			Owner:      owner,
+			AssemblyId: p.Assemblies[owner],
+		})
+	}
+	sort.Sort(byPosition{u.Allocations, positions})
+	return u, nil
+}
+
+/*
+* ListUsage returns the usage of every pool of the conf file, without
+* their allocations.
+ */
+func ListUsage() ([]*Usage, error) {
+	pools := []*Usage{}
+	for _, name := range PoolNames() {
+		u, err := GetUsage(name)
+		if err != nil {
+			return nil, err
+		}
+		u.Allocations = nil
+		pools = append(pools, u)
+	}
+	return pools, nil
+}
+
+type byPosition struct {
+	allocations []*Allocation
+	positions   map[string]uint
+}
+
+func (b byPosition) Len() int      { return len(b.allocations) }
+func (b byPosition) Swap(i, j int) { b.allocations[i], b.allocations[j] = b.allocations[j], b.allocations[i] }
+func (b byPosition) Less(i, j int) bool {
+	return b.positions[b.allocations[i].Owner] < b.positions[b.allocations[j].Owner]
+}
@@ -0,0 +1,129 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"fmt"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/config"
+)
+
+const defaultStartTimeout = 120
+
+/*
+* the part of the docker client readiness is built on.
+ */
+type eventSource interface {
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	RemoveEventListener(listener chan *docker.APIEvents) error
+	InspectContainer(id string) (*docker.Container, error)
+}
+
+/*
+* DiedError is returned when the container stopped before it was up.
+ */
+type DiedError struct {
+	ContainerID string
+	ExitCode    int
+	Reason      string
+}
+
+func (e *DiedError) Error() string {
+	return fmt.Sprintf("container %s died during startup (%s, exit code %d)", e.ContainerID, e.Reason, e.ExitCode)
+}
+
+/*
+* docker:start_timeout in the conf file, the seconds a container has to
+* come up.
+ */
+func startTimeout() time.Duration {
+	secs, err := config.GetInt("docker:start_timeout")
+	if err != nil || secs <= 0 {
+		secs = defaultStartTimeout
+	}
+	return time.Duration(secs) * time.Second
+}
+
+/*
+* waitRunning waits for the container to run, watching the docker event
+* stream. The listener is added before the container is inspected, so a
+* start or die in between isn't missed.
+ */
+func waitRunning(client eventSource, containerID string, timeout time.Duration) error {
+	listener := make(chan *docker.APIEvents, 16)
+	if err := client.AddEventListener(listener); err != nil {
+		return err
+	}
+	defer client.RemoveEventListener(listener)
+
+	if up, err := isRunning(client, containerID); up || err != nil {
+		return err
+	}
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event, ok := <-listener:
+			if !ok {
+				return fmt.Errorf("docker event stream closed while waiting for container %s", containerID)
+			}
+			if event == nil || event.ID != containerID {
+				continue
+			}
+			switch event.Status {
+			case "start":
+				if up, err := isRunning(client, containerID); up || err != nil {
+					return err
+				}
+			case "die", "oom", "kill", "destroy":
+				if _, err := isRunning(client, containerID); err != nil {
+					return err
+				}
+				return &DiedError{ContainerID: containerID, Reason: event.Status}
+			}
+		case <-deadline:
+			return fmt.Errorf("container %s is not running after %s", containerID, timeout)
+		}
+	}
+}
+
+/*
+* isRunning inspects the container, a container that already exited is
+* a DiedError.
+ */
+func isRunning(client eventSource, containerID string) (bool, error) {
+	c, err := client.InspectContainer(containerID)
+	if err != nil {
+		return false, err
+	}
+	if c.State.Running {
+		log.Info("container %s is running", containerID)
+		return true, nil
+	}
+	if !c.State.FinishedAt.IsZero() {
+		reason := "exited"
+		if c.State.OOMKilled {
+			reason = "oom"
+		} else if c.State.Error != "" {
+			reason = c.State.Error
+		}
+		return false, &DiedError{ContainerID: containerID, ExitCode: c.State.ExitCode, Reason: reason}
+	}
+	return false, nil
+}
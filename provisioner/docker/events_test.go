@@ -0,0 +1,109 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	config.Set("storage:backend", "file")
+	config.Set("storage:path", filepath.Join(c.MkDir(), "megamd.db"))
+}
+
+type fakeEvents struct {
+	mu       sync.Mutex
+	state    docker.State
+	listener chan<- *docker.APIEvents
+	removed  bool
+}
+
+func (f *fakeEvents) AddEventListener(listener chan<- *docker.APIEvents) error {
+	f.listener = listener
+	return nil
+}
+
+func (f *fakeEvents) RemoveEventListener(listener chan *docker.APIEvents) error {
+	f.removed = true
+	return nil
+}
+
+func (f *fakeEvents) InspectContainer(id string) (*docker.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &docker.Container{ID: id, State: f.state}, nil
+}
+
+func (f *fakeEvents) emit(id string, status string, state docker.State) {
+	f.mu.Lock()
+	f.state = state
+	f.mu.Unlock()
+	f.listener <- &docker.APIEvents{ID: "other", Status: status}
+	f.listener <- &docker.APIEvents{ID: id, Status: status}
+}
+
+func (s *S) TestWaitRunningAlreadyUp(c *check.C) {
+	f := &fakeEvents{state: docker.State{Running: true}}
+	c.Assert(waitRunning(f, "c1", time.Second), check.IsNil)
+	c.Assert(f.removed, check.Equals, true)
+}
+
+func (s *S) TestWaitRunningOnStartEvent(c *check.C) {
+	f := &fakeEvents{}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		f.emit("c1", "start", docker.State{Running: true})
+	}()
+	c.Assert(waitRunning(f, "c1", time.Second), check.IsNil)
+}
+
+func (s *S) TestWaitRunningContainerDies(c *check.C) {
+	f := &fakeEvents{}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		f.emit("c1", "die", docker.State{ExitCode: 127, FinishedAt: time.Now()})
+	}()
+	err := waitRunning(f, "c1", time.Second)
+	c.Assert(err, check.FitsTypeOf, &DiedError{})
+	c.Assert(err.(*DiedError).ExitCode, check.Equals, 127)
+}
+
+func (s *S) TestWaitRunningAlreadyExited(c *check.C) {
+	f := &fakeEvents{state: docker.State{ExitCode: 1, FinishedAt: time.Now()}}
+	err := waitRunning(f, "c1", time.Second)
+	c.Assert(err, check.FitsTypeOf, &DiedError{})
+}
+
+func (s *S) TestWaitRunningTimeout(c *check.C) {
+	f := &fakeEvents{}
+	err := waitRunning(f, "c1", 20*time.Millisecond)
+	c.Assert(err, check.ErrorMatches, "container c1 is not running after 20ms")
+}
@@ -0,0 +1,630 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/bus"
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/ipam"
+	"github.com/megamsys/megamd/storage"
+	"github.com/tsuru/config"
+)
+
+const (
+	// the components the monitor watches, under a well known key.
+	HEALTHBUCKET = "healthchecks"
+	watchesKey   = "watched"
+
+	// the lease of the megamd checking the watched components.
+	leaseKey = "monitor"
+
+	// the intervals a lease outlives its last renewal.
+	leaseIntervals = 3
+
+	// http:port/path, tcp:port or cmd:command run in the container.
+	healthCheckInput = "health_check"
+
+	// the failed checks in a row that make a component unhealthy.
+	healthRetriesInput = "health_retries"
+
+	// restart, replace or none, what is done to an unhealthy container.
+	restartPolicyInput = "restart_policy"
+
+	HEALTHY   = "healthy"
+	UNHEALTHY = "unhealthy"
+	STARTING  = "starting"
+	STOPPED   = "stopped"
+
+	RESTART = "restart"
+	REPLACE = "replace"
+	NONE    = "none"
+
+	defaultHealthInterval = 30
+	defaultHealthRetries  = 3
+	healthTimeout         = 5 * time.Second
+
+	// the queue health transitions are published on.
+	eventsQueue = "events"
+)
+
+/*
+* HealthCheck is the probe a component declares.
+ */
+type HealthCheck struct {
+	Kind    string
+	Port    string
+	Path    string
+	Command string
+}
+
+/*
+* ComponentHealthCheck returns the health check of the component inputs,
+* nil when it declares none.
+ */
+func ComponentHealthCheck(com *global.Component) (*HealthCheck, error) {
+	pair, err := global.ParseKeyValuePair(com.Inputs, healthCheckInput)
+	if err != nil || strings.TrimSpace(pair.Value) == "" {
+		return nil, nil
+	}
+	check, perr := parseHealthCheck(strings.TrimSpace(pair.Value))
+	if perr != nil {
+		return nil, fmt.Errorf("component %s : %s", com.Name, perr)
+	}
+	return check, nil
+}
+
+func parseHealthCheck(value string) (*HealthCheck, error) {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("%s is not a health check", value)
+	}
+	check := &HealthCheck{Kind: strings.ToLower(value[:i])}
+	rest := value[i+1:]
+	switch check.Kind {
+	case "http":
+		check.Port, check.Path = rest, "/"
+		if j := strings.Index(rest, "/"); j >= 0 {
+			check.Port, check.Path = rest[:j], rest[j:]
+		}
+	case "tcp":
+		check.Port = rest
+	case "cmd":
+		if check.Command = strings.TrimSpace(rest); check.Command == "" {
+			return nil, fmt.Errorf("%s has no command", value)
+		}
+		return check, nil
+	default:
+		return nil, fmt.Errorf("%s is not a health check, it is http, tcp or cmd", check.Kind)
+	}
+	if !validPort(check.Port) {
+		return nil, fmt.Errorf("%s is not a port", check.Port)
+	}
+	return check, nil
+}
+
+/*
+* the part of the docker client the checks are run with.
+ */
+type healthClient interface {
+	InspectContainer(id string) (*docker.Container, error)
+	CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error)
+	StartExec(id string, opts docker.StartExecOptions) error
+	InspectExec(id string) (*docker.ExecInspect, error)
+}
+
+/*
+* probe runs the check against the container at ip. A container that
+* isn't running fails every check.
+ */
+func probe(client healthClient, check *HealthCheck, containerID string, ip string) error {
+	container, err := client.InspectContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if !container.State.Running {
+		return fmt.Errorf("container %s is not running", containerID)
+	}
+
+	switch check.Kind {
+	case "http":
+		if ip == "" {
+			return fmt.Errorf("container %s has no ip", containerID)
+		}
+		httpClient := &http.Client{Timeout: healthTimeout}
+		res, err := httpClient.Get("http://" + net.JoinHostPort(ip, check.Port) + check.Path)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode >= 400 {
+			return fmt.Errorf("%s answered %d", check.Path, res.StatusCode)
+		}
+	case "tcp":
+		if ip == "" {
+			return fmt.Errorf("container %s has no ip", containerID)
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, check.Port), healthTimeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	case "cmd":
+		exec, err := client.CreateExec(docker.CreateExecOptions{Container: containerID, Cmd: []string{"sh", "-c", check.Command}})
+		if err != nil {
+			return err
+		}
+		if err := client.StartExec(exec.ID, docker.StartExecOptions{}); err != nil {
+			return err
+		}
+		inspect, err := client.InspectExec(exec.ID)
+		if err != nil {
+			return err
+		}
+		if inspect.ExitCode != 0 {
+			return fmt.Errorf("%s exited with %d", check.Command, inspect.ExitCode)
+		}
+	}
+	return nil
+}
+
+/*
+* Watch is a component the monitor checks, with what it takes to launch
+* it again.
+ */
+type Watch struct {
+	ComponentId string `json:"component_id"`
+	AssemblyId  string `json:"assembly_id"`
+	AccountId   string `json:"accounts_id"`
+}
+
+type watchIndex struct {
+	Watches  []Watch `json:"watches"`
+	Revision int     `json:"revision"`
+	// the version getWatchIndex read, updateWatches writes over it.
+	read storage.Version
+}
+
+func getWatchIndex() (*watchIndex, error) {
+	idx := &watchIndex{}
+	read, err := storage.FetchRevision(HEALTHBUCKET, watchesKey, idx)
+	if err != nil && !storage.IsNotFound(err) {
+		return nil, err
+	}
+	idx.read = read
+	return idx, nil
+}
+
+/*
+* watched returns the components the monitor checks, none when the index
+* was never stored.
+ */
+func watched() []Watch {
+	idx, err := getWatchIndex()
+	if err != nil {
+		log.Error("Failed to read the watched components : %s", err)
+		return []Watch{}
+	}
+	return idx.Watches
+}
+
+/*
+* updateWatches changes the watch index, read again when another megamd
+* stored it meanwhile.
+ */
+func updateWatches(update func([]Watch) []Watch) error {
+	return storage.RetryOnConflict(func() error {
+		idx, err := getWatchIndex()
+		if err != nil {
+			return err
+		}
+		idx.Watches = update(idx.Watches)
+		idx.Revision++
+		_, err = storage.StoreRevision(HEALTHBUCKET, watchesKey, idx, idx.read)
+		return err
+	})
+}
+
+func watch(w Watch) error {
+	return updateWatches(func(watches []Watch) []Watch {
+		for i := range watches {
+			if watches[i].ComponentId == w.ComponentId {
+				watches[i] = w
+				return watches
+			}
+		}
+		return append(watches, w)
+	})
+}
+
+func unwatch(componentId string) error {
+	return updateWatches(func(watches []Watch) []Watch {
+		rest := make([]Watch, 0, len(watches))
+		for _, w := range watches {
+			if w.ComponentId != componentId {
+				rest = append(rest, w)
+			}
+		}
+		return rest
+	})
+}
+
+/*
+* docker:health_interval in the conf file, the seconds between checks.
+ */
+func healthInterval() time.Duration {
+	secs, err := config.GetInt("docker:health_interval")
+	if err != nil || secs <= 0 {
+		secs = defaultHealthInterval
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func healthRetries(com *global.Component) int {
+	if pair, err := global.ParseKeyValuePair(com.Inputs, healthRetriesInput); err == nil {
+		if n, cerr := strconv.Atoi(pair.Value); cerr == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultHealthRetries
+}
+
+/*
+* restartPolicy is the restart_policy input of the component, else
+* docker:restart_policy in the conf file, restart when both are missing.
+ */
+func restartPolicy(com *global.Component) string {
+	policy := ""
+	if pair, err := global.ParseKeyValuePair(com.Inputs, restartPolicyInput); err == nil {
+		policy = pair.Value
+	} else {
+		policy, _ = config.GetString("docker:restart_policy")
+	}
+	switch policy = strings.ToLower(strings.TrimSpace(policy)); policy {
+	case REPLACE, NONE:
+		return policy
+	}
+	return RESTART
+}
+
+/*
+* monitor counts the failed checks of every watched component. id tells
+* this megamd apart when they elect the one checking.
+ */
+type monitor struct {
+	id       string
+	mu       sync.Mutex
+	failures map[string]int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+var healthMonitor = newMonitor()
+
+func newMonitor() *monitor {
+	host, _ := os.Hostname()
+	return &monitor{
+		id:       fmt.Sprintf("%s/%d/%s", host, os.Getpid(), global.RandString(8)),
+		failures: make(map[string]int),
+	}
+}
+
+/*
+* Serialize runs f in the turn of the assembly. The coordinator sets its
+* executor, so the monitor doesn't recover a container an operation on
+* the assembly is working on.
+ */
+var Serialize = func(assemblyId string, f func() error) error {
+	return f()
+}
+
+/*
+* monitorLease is held by the megamd checking the watched components,
+* Expires in unix seconds.
+ */
+type monitorLease struct {
+	Owner    string `json:"owner"`
+	Expires  int64  `json:"expires"`
+	Revision int    `json:"revision"`
+}
+
+/*
+* lead takes or renews the lease, only the megamd holding it checks the
+* watched components. Another one takes over once the holder stopped
+* renewing it for a few intervals.
+ */
+func (m *monitor) lead(now time.Time, interval time.Duration) bool {
+	lease := &monitorLease{}
+	read, err := storage.FetchRevision(HEALTHBUCKET, leaseKey, lease)
+	if err != nil && !storage.IsNotFound(err) {
+		log.Error("Failed to read the monitor lease : %s", err)
+		return false
+	}
+	if lease.Owner != m.id && lease.Expires > now.Unix() {
+		return false
+	}
+	next := &monitorLease{Owner: m.id, Expires: now.Add(leaseIntervals * interval).Unix(), Revision: lease.Revision + 1}
+	if _, err := storage.StoreRevision(HEALTHBUCKET, leaseKey, next, read); err != nil {
+		if err != storage.ErrConflict {
+			log.Error("Failed to store the monitor lease : %s", err)
+		}
+		return false
+	}
+	if lease.Owner != m.id {
+		log.Info("health monitor %s checks the watched components", m.id)
+	}
+	return true
+}
+
+/*
+* resign gives the lease up, so another megamd takes over right away.
+ */
+func (m *monitor) resign() {
+	lease := &monitorLease{}
+	read, err := storage.FetchRevision(HEALTHBUCKET, leaseKey, lease)
+	if err != nil || lease.Owner != m.id {
+		return
+	}
+	lease.Expires, lease.Revision = 0, lease.Revision+1
+	if _, err := storage.StoreRevision(HEALTHBUCKET, leaseKey, lease, read); err != nil {
+		log.Error("Failed to give the monitor lease up : %s", err)
+	}
+}
+
+/*
+* record counts the check of the component. It returns the status the
+* component moved to, empty when it didn't change, and whether the
+* container has to be recovered.
+ */
+func (m *monitor) record(componentId string, healthy bool, retries int) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if healthy {
+		m.failures[componentId] = 0
+		return HEALTHY, false
+	}
+	m.failures[componentId]++
+	if m.failures[componentId] < retries {
+		return "", false
+	}
+	// the recovered container gets retries checks again.
+	m.failures[componentId] = 0
+	return UNHEALTHY, true
+}
+
+func (m *monitor) forget(componentId string) {
+	m.mu.Lock()
+	delete(m.failures, componentId)
+	m.mu.Unlock()
+}
+
+/*
+* StartMonitor checks the watched components every
+* docker:health_interval seconds, until StopMonitor.
+ */
+func StartMonitor() {
+	m := healthMonitor
+	m.mu.Lock()
+	if m.stop != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.stop, m.done = make(chan struct{}), make(chan struct{})
+	stop, done := m.stop, m.done
+	m.mu.Unlock()
+
+	interval := healthInterval()
+	log.Info("health monitor checks every %s", interval)
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !m.lead(time.Now(), interval) {
+					continue
+				}
+				for _, w := range watched() {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					m.check(w)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+/*
+* StopMonitor stops the checks, waiting for the one running.
+ */
+func StopMonitor() {
+	m := healthMonitor
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+		m.resign()
+	}
+}
+
+func (m *monitor) check(w Watch) {
+	component := global.Component{Id: w.ComponentId}
+	com, err := component.Get(w.ComponentId)
+	if err != nil {
+		log.Error("Health check of %s skipped : %s", w.ComponentId, err)
+		return
+	}
+	if com.Status == STOPPED || com.Status == UPDATING {
+		m.forget(com.Id)
+		return
+	}
+	check, cerr := ComponentHealthCheck(com)
+	if cerr != nil || check == nil {
+		log.Warn("Component %s has no health check anymore : %v", com.Name, cerr)
+		unwatch(com.Id)
+		m.forget(com.Id)
+		return
+	}
+	containerID, endpoint := output(com, "id"), output(com, "endpoint")
+	if containerID == "" {
+		return
+	}
+
+	client, _ := docker.NewClient(endpoint)
+	perr := probe(client, check, containerID, output(com, "ip"))
+	if perr != nil {
+		log.Warn("Health check of %s failed : %s", com.Name, perr)
+	}
+	status, recover := m.record(com.Id, perr == nil, healthRetries(com))
+	if status != "" && status != com.Status {
+		setStatus(com.Id, status)
+		publishHealth(w.AssemblyId, com, status)
+	}
+	if recover {
+		rerr := Serialize(w.AssemblyId, func() error {
+			/*
+			 * an operation on the assembly ran while waiting, the
+			 * container is recovered only if it is still the one checked.
+			 */
+			current, err := (&global.Component{}).Get(w.ComponentId)
+			if err != nil {
+				return err
+			}
+			if output(current, "id") != containerID || current.Status == STOPPED || current.Status == UPDATING {
+				log.Info("Container of %s changed meanwhile, not recovered", com.Name)
+				return nil
+			}
+			return recoverContainer(w, current)
+		})
+		if rerr != nil {
+			log.Error("Failed to recover %s : %s", com.Name, rerr)
+		}
+	}
+}
+
+/*
+* recoverContainer restarts the container of the unhealthy component, or
+* launches a new one in its place, as its restart policy says.
+ */
+func recoverContainer(w Watch, com *global.Component) error {
+	containerID, endpoint := output(com, "id"), output(com, "endpoint")
+	switch restartPolicy(com) {
+	case RESTART:
+		log.Info("Restarting the unhealthy container of %s", com.Name)
+		return RestartContainer(containerID, endpoint)
+	case REPLACE:
+		log.Info("Replacing the unhealthy container of %s", com.Name)
+		assembly := global.Assembly{Id: w.AssemblyId}
+		asm, err := assembly.GetAssemblyWithComponents(w.AssemblyId)
+		if err != nil {
+			return err
+		}
+		pool, err := assemblyPool(asm)
+		if err != nil {
+			return err
+		}
+		/*
+		 * the volumes and the watch stay, the new container takes over
+		 * the data of the old one.
+		 */
+		if err := removeContainer(containerID, endpoint); err != nil {
+			return err
+		}
+		held := output(com, ipam.POOLINPUT)
+		if held == "" {
+			held = pool.Name
+		}
+		if err := ipam.Release(held, containerID); err != nil {
+			clearContainerJSON(com)
+			return err
+		}
+		if _, err = launch(asm, com, endpoint, w.AccountId, pool); err != nil {
+			// the component points to no container until it is launched again.
+			clearContainerJSON(com)
+			return err
+		}
+		return nil
+	}
+	log.Info("Container of %s is left unhealthy, its restart policy is none", com.Name)
+	return nil
+}
+
+/*
+* setStatus records the status of the component.
+ */
+func setStatus(componentId string, status string) {
+	_, err := global.UpdateComponent(componentId, func(com *global.Component) error {
+		com.Status = status
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to store the status of %s : %s", componentId, err)
+	}
+}
+
+/*
+* SetStatus records the status of the component, the monitor doesn't
+* check a stopped one.
+ */
+func SetStatus(componentId string, status string) {
+	if status == STOPPED {
+		healthMonitor.forget(componentId)
+	}
+	setStatus(componentId, status)
+}
+
+/*
+* publishHealth publishes the health transition on the events queue.
+ */
+func publishHealth(assemblyId string, com *global.Component, status string) {
+	msg, _ := json.Marshal(&global.EventMessage{AssemblyId: assemblyId, ComponentId: com.Id, Event: status})
+	b, err := bus.Get()
+	if err == nil {
+		err = b.Pub(eventsQueue, msg)
+	}
+	if err != nil {
+		log.Error("Failed to publish the health of %s : %s", com.Name, err)
+		return
+	}
+	log.Info("Component %s is %s", com.Name, status)
+}
+
+func output(com *global.Component, key string) string {
+	if pair, err := global.ParseKeyValuePair(com.Outputs, key); err == nil {
+		return pair.Value
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"gopkg.in/check.v1"
+)
+
+type fakeHealth struct {
+	running  bool
+	exitCode int
+	cmd      []string
+}
+
+func (f *fakeHealth) InspectContainer(id string) (*docker.Container, error) {
+	return &docker.Container{ID: id, State: docker.State{Running: f.running}}, nil
+}
+
+func (f *fakeHealth) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	f.cmd = opts.Cmd
+	return &docker.Exec{ID: "exec1"}, nil
+}
+
+func (f *fakeHealth) StartExec(id string, opts docker.StartExecOptions) error {
+	return nil
+}
+
+func (f *fakeHealth) InspectExec(id string) (*docker.ExecInspect, error) {
+	return &docker.ExecInspect{ID: id, ExitCode: f.exitCode}, nil
+}
+
+func (s *S) TestParseHealthCheck(c *check.C) {
+	hc, err := parseHealthCheck("http:8080/healthz")
+	c.Assert(err, check.IsNil)
+	c.Assert(hc, check.DeepEquals, &HealthCheck{Kind: "http", Port: "8080", Path: "/healthz"})
+	hc, err = parseHealthCheck("tcp:5432")
+	c.Assert(err, check.IsNil)
+	c.Assert(hc, check.DeepEquals, &HealthCheck{Kind: "tcp", Port: "5432"})
+	hc, err = parseHealthCheck("cmd:pg_isready -U postgres")
+	c.Assert(err, check.IsNil)
+	c.Assert(hc.Command, check.Equals, "pg_isready -U postgres")
+
+	_, err = parseHealthCheck("udp:53")
+	c.Assert(err, check.ErrorMatches, "udp is not a health check, it is http, tcp or cmd")
+	_, err = parseHealthCheck("tcp:none")
+	c.Assert(err, check.ErrorMatches, "none is not a port")
+}
+
+func (s *S) TestProbeHttp(c *check.C) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/healthz")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	client := &fakeHealth{running: true}
+	hc := &HealthCheck{Kind: "http", Port: port, Path: "/healthz"}
+	c.Assert(probe(client, hc, "c1", host), check.IsNil)
+	status = http.StatusServiceUnavailable
+	c.Assert(probe(client, hc, "c1", host), check.ErrorMatches, "/healthz answered 503")
+}
+
+func (s *S) TestProbeTcpAndCmd(c *check.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	client := &fakeHealth{running: true}
+	c.Assert(probe(client, &HealthCheck{Kind: "tcp", Port: port}, "c1", host), check.IsNil)
+	ln.Close()
+	c.Assert(probe(client, &HealthCheck{Kind: "tcp", Port: port}, "c1", host), check.NotNil)
+
+	hc := &HealthCheck{Kind: "cmd", Command: "pg_isready"}
+	c.Assert(probe(client, hc, "c1", ""), check.IsNil)
+	c.Assert(client.cmd, check.DeepEquals, []string{"sh", "-c", "pg_isready"})
+	client.exitCode = 2
+	c.Assert(probe(client, hc, "c1", ""), check.ErrorMatches, "pg_isready exited with 2")
+}
+
+func (s *S) TestProbeStoppedContainer(c *check.C) {
+	hc := &HealthCheck{Kind: "cmd", Command: "true"}
+	c.Assert(probe(&fakeHealth{}, hc, "c1", ""), check.ErrorMatches, "container c1 is not running")
+}
+
+func (s *S) TestMonitorRecord(c *check.C) {
+	m := &monitor{failures: make(map[string]int)}
+	status, recover := m.record("COM1", false, 2)
+	c.Assert(status, check.Equals, "")
+	c.Assert(recover, check.Equals, false)
+	status, recover = m.record("COM1", false, 2)
+	c.Assert(status, check.Equals, UNHEALTHY)
+	c.Assert(recover, check.Equals, true)
+	status, recover = m.record("COM1", false, 2)
+	c.Assert(status, check.Equals, "")
+	status, recover = m.record("COM1", true, 2)
+	c.Assert(status, check.Equals, HEALTHY)
+	c.Assert(recover, check.Equals, false)
+}
+
+func (s *S) TestWatches(c *check.C) {
+	c.Assert(watch(Watch{ComponentId: "COM1", AssemblyId: "ASM1"}), check.IsNil)
+	c.Assert(watch(Watch{ComponentId: "COM2", AssemblyId: "ASM1"}), check.IsNil)
+	c.Assert(watch(Watch{ComponentId: "COM1", AssemblyId: "ASM1", AccountId: "ACT1"}), check.IsNil)
+	c.Assert(watched(), check.DeepEquals, []Watch{
+		{ComponentId: "COM1", AssemblyId: "ASM1", AccountId: "ACT1"},
+		{ComponentId: "COM2", AssemblyId: "ASM1"},
+	})
+	c.Assert(unwatch("COM1"), check.IsNil)
+	c.Assert(watched(), check.DeepEquals, []Watch{{ComponentId: "COM2", AssemblyId: "ASM1"}})
+}
+
+func (s *S) TestMonitorLease(c *check.C) {
+	one, two := newMonitor(), newMonitor()
+	now := time.Now()
+	c.Assert(one.lead(now, time.Second), check.Equals, true)
+	c.Assert(two.lead(now, time.Second), check.Equals, false)
+	c.Assert(one.lead(now.Add(2*time.Second), time.Second), check.Equals, true)
+	c.Assert(two.lead(now.Add(4*time.Second), time.Second), check.Equals, false)
+	c.Assert(two.lead(now.Add(10*time.Second), time.Second), check.Equals, true)
+	c.Assert(one.lead(now.Add(10*time.Second), time.Second), check.Equals, false)
+	two.resign()
+	c.Assert(one.lead(now.Add(11*time.Second), time.Second), check.Equals, true)
+}
+
+func (s *S) TestRestartPolicy(c *check.C) {
+	com := &global.Component{Name: "pg"}
+	c.Assert(restartPolicy(com), check.Equals, RESTART)
+	com.Inputs = []*global.KeyValuePair{global.GetKeyValuePair("restart_policy", "replace")}
+	c.Assert(restartPolicy(com), check.Equals, REPLACE)
+	com.Inputs[0].Value = "none"
+	c.Assert(restartPolicy(com), check.Equals, NONE)
+}
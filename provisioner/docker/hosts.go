@@ -0,0 +1,293 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/ipam"
+	"github.com/megamsys/megamd/storage"
+	"github.com/tsuru/config"
+)
+
+const (
+	HOSTSBUCKET   = "dockerhosts"
+	placementsKey = "placements"
+)
+
+/*
+* Host is a docker engine of the conf file the scheduler places the
+* baremetal containers on. A capacity of 0 is unlimited. gulp_url is the
+* gulpd of the host, it sets the network of the containers up.
+*
+*   docker:
+*     hosts:
+*       one:
+*         endpoint: tcp://10.0.0.5:2375
+*         gulp_url: http://10.0.0.5:8084/
+*         zone: east
+*         cpus: 8
+*         memory: 16g
+*         labels:
+*           - ssd=true
+ */
+type Host struct {
+	Name     string            `json:"name"`
+	Endpoint string            `json:"endpoint"`
+	GulpURL  string            `json:"gulp_url,omitempty"`
+	Zone     string            `json:"zone"`
+	Labels   map[string]string `json:"labels"`
+	Cpus     float64           `json:"cpus"`
+	Memory   int64             `json:"memory"`
+}
+
+/*
+* label is the value of a label of the host, zone included.
+ */
+func (h *Host) label(key string) (string, bool) {
+	if key == "zone" {
+		return h.Zone, h.Zone != ""
+	}
+	v, ok := h.Labels[key]
+	return v, ok
+}
+
+/*
+* Hosts lists the docker hosts of the conf file, none when the baremetal
+* containers all go to docker:swarm_host.
+ */
+func Hosts() ([]*Host, error) {
+	names := []string{}
+	if hosts, err := config.Get("docker:hosts"); err == nil {
+		if m, ok := hosts.(map[interface{}]interface{}); ok {
+			for name := range m {
+				names = append(names, fmt.Sprint(name))
+			}
+		}
+	}
+	sort.Strings(names)
+
+	hosts := make([]*Host, 0, len(names))
+	for _, name := range names {
+		h, err := getHost(name)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+func getHost(name string) (*Host, error) {
+	prefix := "docker:hosts:" + name + ":"
+	h := &Host{Name: name, Labels: map[string]string{}}
+	h.Endpoint, _ = config.GetString(prefix + "endpoint")
+	if h.Endpoint == "" {
+		return nil, fmt.Errorf("docker host %s has no endpoint", name)
+	}
+	h.GulpURL, _ = config.GetString(prefix + "gulp_url")
+	h.Zone, _ = config.GetString(prefix + "zone")
+	if cpus, err := config.GetString(prefix + "cpus"); err == nil && cpus != "" {
+		n, perr := strconv.ParseFloat(cpus, 64)
+		if perr != nil || n < 0 {
+			return nil, fmt.Errorf("docker host %s : %s is not a number of cpus", name, cpus)
+		}
+		h.Cpus = n
+	}
+	if memory, err := config.GetString(prefix + "memory"); err == nil && memory != "" {
+		n, perr := parseSize(memory)
+		if perr != nil || n < 0 {
+			return nil, fmt.Errorf("docker host %s : %s is not a memory size", name, memory)
+		}
+		h.Memory = n
+	}
+	labels, _ := config.GetList(prefix + "labels")
+	for _, l := range labels {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("docker host %s : %s is not a label, it is key=value", name, l)
+		}
+		h.Labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return h, nil
+}
+
+/*
+* gulpURL is the gulpd of the host the container runs on, docker:gulp_url
+* for a container that wasn't placed. A host without one falls back to
+* docker:gulp_url only when it is the single host, that gulpd can't set
+* up the containers of the others.
+ */
+func gulpURL(hostName string) (string, error) {
+	if hostName != "" {
+		h, err := getHost(hostName)
+		if err != nil {
+			return "", err
+		}
+		if h.GulpURL != "" {
+			return h.GulpURL, nil
+		}
+		if hosts, _ := Hosts(); len(hosts) > 1 {
+			return "", fmt.Errorf("docker host %s has no gulp_url", hostName)
+		}
+	}
+	gulpUrl, _ := config.GetString("docker:gulp_url")
+	return gulpUrl, nil
+}
+
+/*
+* Placement is what a container placed on a host takes of it. Since is
+* when a pending owner took it, in unix seconds.
+ */
+type Placement struct {
+	Host        string  `json:"host"`
+	ComponentId string  `json:"component_id"`
+	Cpus        float64 `json:"cpus"`
+	Memory      int64   `json:"memory"`
+	Since       int64   `json:"since,omitempty"`
+}
+
+/*
+* placements are the containers placed on the hosts, stored with a
+* revision so two megamd never overcommit a host together. A container
+* about to be created is held by its pending owner.
+ */
+type placements struct {
+	Containers map[string]Placement `json:"containers"`
+	Revision   int                  `json:"revision"`
+	// the version getPlacements read, store writes over it.
+	read storage.Version
+}
+
+func getPlacements() *placements {
+	p := &placements{}
+	read, err := storage.FetchRevision(HOSTSBUCKET, placementsKey, p)
+	if err != nil {
+		p = &placements{}
+	}
+	p.read = read
+	if p.Containers == nil {
+		p.Containers = make(map[string]Placement)
+	}
+	return p
+}
+
+/*
+* sweep drops the placements of pending owners taken before now less
+* ipam.PendingTimeout, left over by a megamd that died before creating
+* their container.
+ */
+func (p *placements) sweep(now time.Time) {
+	for owner, pl := range p.Containers {
+		if strings.HasPrefix(owner, ipam.PENDING) && now.Sub(time.Unix(pl.Since, 0)) > ipam.PendingTimeout {
+			log.Info("Stale placement of %s on %s dropped", owner, pl.Host)
+			delete(p.Containers, owner)
+		}
+	}
+}
+
+func (p *placements) store() error {
+	p.Revision++
+	read, err := storage.StoreRevision(HOSTSBUCKET, placementsKey, p, p.read)
+	if err != nil {
+		p.Revision--
+		return err
+	}
+	p.read = read
+	return nil
+}
+
+/*
+* HostUsage is a host with what its containers take of it.
+ */
+type HostUsage struct {
+	Host
+	Containers int     `json:"containers"`
+	UsedCpus   float64 `json:"used_cpus"`
+	UsedMemory int64   `json:"used_memory"`
+}
+
+func usage(hosts []*Host, p *placements) map[string]*HostUsage {
+	used := make(map[string]*HostUsage, len(hosts))
+	for _, h := range hosts {
+		used[h.Name] = &HostUsage{Host: *h}
+	}
+	for _, pl := range p.Containers {
+		if u, ok := used[pl.Host]; ok {
+			u.Containers++
+			u.UsedCpus += pl.Cpus
+			u.UsedMemory += pl.Memory
+		}
+	}
+	return used
+}
+
+/*
+* ListHostUsage returns every host with its usage.
+ */
+func ListHostUsage() ([]*HostUsage, error) {
+	hosts, err := Hosts()
+	if err != nil {
+		return nil, err
+	}
+	used := usage(hosts, getPlacements())
+	list := make([]*HostUsage, 0, len(hosts))
+	for _, h := range hosts {
+		list = append(list, used[h.Name])
+	}
+	return list, nil
+}
+
+/*
+* claimPlacement hands the placement of the pending owner to the
+* container created for it.
+ */
+func claimPlacement(pending string, containerID string) error {
+	return storage.RetryOnConflict(func() error {
+		p := getPlacements()
+		pl, ok := p.Containers[pending]
+		if !ok {
+			return nil
+		}
+		pl.Since = 0
+		p.Containers[containerID] = pl
+		delete(p.Containers, pending)
+		return p.store()
+	})
+}
+
+/*
+* releasePlacement gives back what the container took of its host, a
+* container that wasn't placed is ignored.
+ */
+func releasePlacement(owner string) {
+	err := storage.RetryOnConflict(func() error {
+		p := getPlacements()
+		if _, ok := p.Containers[owner]; !ok {
+			return nil
+		}
+		delete(p.Containers, owner)
+		return p.store()
+	})
+	if err != nil {
+		log.Error("Failed to release the placement of %s : %s", owner, err)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+)
+
+/*
+* the part of the docker client the logs are read with.
+ */
+type logClient interface {
+	Logs(opts docker.LogsOptions) error
+}
+
+/*
+* LogOptions says which of the container logs are read. Tail is a number
+* of lines or all, Since a unix time. Follow keeps reading until the
+* container stops or a writer fails.
+ */
+type LogOptions struct {
+	Follow     bool
+	Tail       string
+	Since      int64
+	Stdout     bool
+	Stderr     bool
+	Timestamps bool
+}
+
+var errLogsClosed = errors.New("the logs are no longer read")
+
+/*
+* ComponentLogs writes the logs of the container of the component, its
+* stdout and stderr apart. The logs are read until closed is closed, a
+* followed container with nothing to write stops too.
+ */
+func ComponentLogs(com *global.Component, opts LogOptions, stdout io.Writer, stderr io.Writer, closed <-chan struct{}) error {
+	containerID, endpoint := output(com, "id"), output(com, "endpoint")
+	if containerID == "" {
+		return fmt.Errorf("component %s has no container", com.Name)
+	}
+	client, err := docker.NewClient(endpoint)
+	if err != nil {
+		return err
+	}
+	closeOn(client, closed)
+	return containerLogs(client, containerID, opts, stdout, stderr)
+}
+
+/*
+* closeOn gives the client connections of its own to the engine, closed
+* with closed. A followed read waiting for the next line returns then.
+ */
+func closeOn(client *docker.Client, closed <-chan struct{}) {
+	var mu sync.Mutex
+	conns := []net.Conn{}
+	over := false
+	dial := func(network string, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if over {
+			conn.Close()
+			return nil, errLogsClosed
+		}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+	client.HTTPClient = &http.Client{Transport: &http.Transport{Dial: dial}}
+	go func() {
+		<-closed
+		mu.Lock()
+		defer mu.Unlock()
+		over = true
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+}
+
+func containerLogs(client logClient, containerID string, opts LogOptions, stdout io.Writer, stderr io.Writer) error {
+	if !opts.Stdout && !opts.Stderr {
+		opts.Stdout, opts.Stderr = true, true
+	}
+	if opts.Tail == "" {
+		opts.Tail = "all"
+	}
+	return client.Logs(docker.LogsOptions{
+		Container:    containerID,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Follow:       opts.Follow,
+		Stdout:       opts.Stdout,
+		Stderr:       opts.Stderr,
+		Since:        opts.Since,
+		Timestamps:   opts.Timestamps,
+		Tail:         opts.Tail,
+	})
+}
@@ -0,0 +1,92 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"gopkg.in/check.v1"
+)
+
+type fakeLogs struct {
+	opts docker.LogsOptions
+}
+
+func (f *fakeLogs) Logs(opts docker.LogsOptions) error {
+	f.opts = opts
+	opts.OutputStream.Write([]byte("listening on 8080\n"))
+	opts.ErrorStream.Write([]byte("deprecated flag\n"))
+	return nil
+}
+
+func (s *S) TestContainerLogs(c *check.C) {
+	client := &fakeLogs{}
+	var stdout, stderr bytes.Buffer
+	err := containerLogs(client, "c1", LogOptions{Follow: true, Since: 1450000000}, &stdout, &stderr)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.opts.Container, check.Equals, "c1")
+	c.Assert(client.opts.Stdout, check.Equals, true)
+	c.Assert(client.opts.Stderr, check.Equals, true)
+	c.Assert(client.opts.Tail, check.Equals, "all")
+	c.Assert(client.opts.Follow, check.Equals, true)
+	c.Assert(client.opts.Since, check.Equals, int64(1450000000))
+	c.Assert(stdout.String(), check.Equals, "listening on 8080\n")
+	c.Assert(stderr.String(), check.Equals, "deprecated flag\n")
+
+	containerLogs(client, "c1", LogOptions{Stderr: true, Tail: "10"}, &stdout, &stderr)
+	c.Assert(client.opts.Stdout, check.Equals, false)
+	c.Assert(client.opts.Tail, check.Equals, "10")
+}
+
+func (s *S) TestComponentLogsWithoutContainer(c *check.C) {
+	var out bytes.Buffer
+	err := ComponentLogs(&global.Component{Name: "web"}, LogOptions{}, &out, &out, nil)
+	c.Assert(err, check.ErrorMatches, "component web has no container")
+}
+
+func (s *S) TestCloseOnEndsAWaitingRead(c *check.C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer l.Close()
+	// the engine accepts the request and never answers.
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	client := &docker.Client{}
+	closed := make(chan struct{})
+	closeOn(client, closed)
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.HTTPClient.Get("http://" + l.Addr().String() + "/containers/c1/logs?follow=1")
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(closed)
+	select {
+	case err := <-done:
+		c.Assert(err, check.NotNil)
+	case <-time.After(2 * time.Second):
+		c.Fatal("the read didn't stop once closed")
+	}
+}
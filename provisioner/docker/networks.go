@@ -0,0 +1,138 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	log "code.google.com/p/log4go"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/ipam"
+)
+
+/*
+* the part of the docker client the pool networks are built on.
+ */
+type networkClient interface {
+	NetworkInfo(id string) (*docker.Network, error)
+	CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error)
+}
+
+/*
+* attachment is the docker network a container joins with its address.
+ */
+type attachment struct {
+	Network string
+	IP      net.IP
+}
+
+func (a *attachment) networkingConfig() *docker.NetworkingConfig {
+	addr := &docker.EndpointIPAMConfig{}
+	if a.IP.To4() != nil {
+		addr.IPv4Address = a.IP.String()
+	} else {
+		addr.IPv6Address = a.IP.String()
+	}
+	return &docker.NetworkingConfig{
+		EndpointsConfig: map[string]*docker.EndpointConfig{
+			a.Network: &docker.EndpointConfig{IPAMConfig: addr},
+		},
+	}
+}
+
+/*
+* ensureNetwork creates the docker network of the pool unless it exists.
+* The network hands out no address of its own, megamd picks them.
+ */
+func ensureNetwork(client networkClient, pool *ipam.PoolConfig) error {
+	if _, err := client.NetworkInfo(pool.Network); err == nil {
+		return nil
+	} else if _, missing := err.(*docker.NoSuchNetwork); !missing {
+		return fmt.Errorf("docker network %s of pool %s : %s", pool.Network, pool.Name, err)
+	}
+
+	conf := docker.IPAMConfig{Subnet: pool.Subnet.String()}
+	if pool.Gateway != nil {
+		conf.Gateway = pool.Gateway.String()
+	}
+	opts := docker.CreateNetworkOptions{
+		Name:           pool.Network,
+		CheckDuplicate: true,
+		Driver:         pool.Driver,
+		IPAM:           docker.IPAMOptions{Driver: "default", Config: []docker.IPAMConfig{conf}},
+		Options:        map[string]interface{}{},
+		EnableIPv6:     pool.Subnet.IP.To4() == nil,
+	}
+	switch pool.Driver {
+	case ipam.MACVLAN:
+		opts.Options["parent"] = pool.Parent
+	case ipam.BRIDGE:
+		if pool.Bridge != "" {
+			opts.Options["com.docker.network.bridge.name"] = pool.Bridge
+		}
+	}
+	if _, err := client.CreateNetwork(opts); err != nil {
+		return fmt.Errorf("docker network %s of pool %s was not created : %s", pool.Network, pool.Name, err)
+	}
+	log.Info("docker network %s (%s %s) of pool %s created", pool.Network, pool.Driver, pool.Subnet, pool.Name)
+	return nil
+}
+
+/*
+* pendingOwner holds the address of a container about to be created, it
+* has no id yet.
+ */
+func pendingOwner(com *global.Component, index int) string {
+	return ipam.PENDING + com.Id + "/" + strconv.Itoa(index)
+}
+
+/*
+* attach takes the address of the container before it is created, when
+* the pool is a docker network. A gulpd pool returns nil, the address is
+* set up once the container runs.
+ */
+func attach(client networkClient, pool *ipam.PoolConfig, com *global.Component, index int, assemblyId string) (*attachment, error) {
+	if !pool.Native() {
+		return nil, nil
+	}
+	if err := ensureNetwork(client, pool); err != nil {
+		return nil, err
+	}
+	ip, err := ipam.Allocate(pool.Name, pendingOwner(com, index), assemblyId)
+	if err != nil {
+		return nil, err
+	}
+	return &attachment{Network: pool.Network, IP: ip}, nil
+}
+
+/*
+* ComponentNetwork is the docker network the container of the component
+* joined, empty when gulpd networks it.
+ */
+func ComponentNetwork(com *global.Component) string {
+	name := output(com, ipam.POOLINPUT)
+	if name == "" {
+		return ""
+	}
+	pool, err := ipam.GetPoolConfig(name)
+	if err != nil || !pool.Native() {
+		return ""
+	}
+	return pool.Network
+}
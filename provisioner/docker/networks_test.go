@@ -0,0 +1,100 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"net"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/ipam"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+type fakeNetworks struct {
+	networks map[string]*docker.Network
+	created  []docker.CreateNetworkOptions
+}
+
+func (f *fakeNetworks) NetworkInfo(id string) (*docker.Network, error) {
+	if n, ok := f.networks[id]; ok {
+		return n, nil
+	}
+	return nil, &docker.NoSuchNetwork{ID: id}
+}
+
+func (f *fakeNetworks) CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error) {
+	f.created = append(f.created, opts)
+	n := &docker.Network{Name: opts.Name, Driver: opts.Driver, IPAM: opts.IPAM}
+	f.networks[opts.Name] = n
+	return n, nil
+}
+
+func (s *S) TestEnsureNetwork(c *check.C) {
+	_, subnet, _ := net.ParseCIDR("10.2.1.0/24")
+	pool := &ipam.PoolConfig{Name: "lan", Subnet: subnet, Gateway: net.ParseIP("10.2.1.1"), Driver: ipam.MACVLAN, Network: "lan", Parent: "eth1"}
+	client := &fakeNetworks{networks: map[string]*docker.Network{}}
+
+	c.Assert(ensureNetwork(client, pool), check.IsNil)
+	c.Assert(client.created, check.HasLen, 1)
+	opts := client.created[0]
+	c.Assert(opts.Driver, check.Equals, "macvlan")
+	c.Assert(opts.Options["parent"], check.Equals, "eth1")
+	c.Assert(opts.EnableIPv6, check.Equals, false)
+	c.Assert(opts.IPAM.Config, check.DeepEquals, []docker.IPAMConfig{{Subnet: "10.2.1.0/24", Gateway: "10.2.1.1"}})
+
+	// an existing network is used as it is.
+	c.Assert(ensureNetwork(client, pool), check.IsNil)
+	c.Assert(client.created, check.HasLen, 1)
+}
+
+func (s *S) TestAttach(c *check.C) {
+	config.Set("ipam:pools:native:subnet", "10.2.2.0/24")
+	config.Set("ipam:pools:native:driver", "bridge")
+	config.Set("ipam:pools:native:bridge", "br-native")
+	defer config.Unset("ipam:pools:native:driver")
+	c.Assert(ipam.Init("native", 0), check.IsNil)
+	pool, err := ipam.GetPoolConfig("native")
+	c.Assert(err, check.IsNil)
+
+	client := &fakeNetworks{networks: map[string]*docker.Network{}}
+	com := &global.Component{Id: "COM61", Name: "web"}
+	att, err := attach(client, pool, com, 1, "ASM61")
+	c.Assert(err, check.IsNil)
+	c.Assert(att.Network, check.Equals, "native")
+	c.Assert(att.IP.String(), check.Equals, "10.2.2.2")
+	c.Assert(client.created[0].Options["com.docker.network.bridge.name"], check.Equals, "br-native")
+
+	endpoint := att.networkingConfig().EndpointsConfig["native"]
+	c.Assert(endpoint.IPAMConfig.IPv4Address, check.Equals, "10.2.2.2")
+
+	// the container keeps the address once it has an id.
+	c.Assert(ipam.Reassign("native", pendingOwner(com, 1), "c61"), check.IsNil)
+	ip, _ := ipam.Allocate("native", "c61", "ASM61")
+	c.Assert(ip.String(), check.Equals, "10.2.2.2")
+
+	com.Outputs = []*global.KeyValuePair{global.GetKeyValuePair(ipam.POOLINPUT, "native")}
+	c.Assert(ComponentNetwork(com), check.Equals, "native")
+
+	// a gulpd pool sets the address up once the container runs.
+	config.Unset("ipam:pools:native:driver")
+	pool, _ = ipam.GetPoolConfig("native")
+	att, err = attach(client, pool, com, 2, "ASM61")
+	c.Assert(err, check.IsNil)
+	c.Assert(att, check.IsNil)
+	c.Assert(ComponentNetwork(com), check.Equals, "")
+}
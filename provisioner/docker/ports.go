@@ -0,0 +1,137 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+)
+
+/*
+* the component inputs declaring ports. ports is a comma separated list,
+* an entry is [hostport:]port[/proto], 8080:80/tcp. A free host port is
+* bound when hostport is missing.
+ */
+var portInputs = []string{"ports", "port", "tosca.capabilities.Endpoint"}
+
+/*
+* PortSpec is a container port a component publishes.
+ */
+type PortSpec struct {
+	Port     docker.Port
+	HostPort string
+}
+
+/*
+* ComponentPorts returns the ports declared by the component inputs.
+ */
+func ComponentPorts(com *global.Component) ([]PortSpec, error) {
+	specs := []PortSpec{}
+	seen := map[PortSpec]bool{}
+	for _, key := range portInputs {
+		pair, err := global.ParseKeyValuePair(com.Inputs, key)
+		if err != nil {
+			continue
+		}
+		for _, entry := range strings.Split(pair.Value, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			spec, perr := parsePort(entry)
+			if perr != nil {
+				return nil, fmt.Errorf("component %s : %s", com.Name, perr)
+			}
+			if !seen[spec] {
+				seen[spec] = true
+				specs = append(specs, spec)
+			}
+		}
+	}
+	return specs, nil
+}
+
+func parsePort(entry string) (PortSpec, error) {
+	spec := PortSpec{}
+	proto := "tcp"
+	if i := strings.Index(entry, "/"); i >= 0 {
+		proto = strings.ToLower(entry[i+1:])
+		entry = entry[:i]
+	}
+	if proto != "tcp" && proto != "udp" {
+		return spec, fmt.Errorf("%s is not a port protocol", proto)
+	}
+	port := entry
+	if i := strings.Index(entry, ":"); i >= 0 {
+		spec.HostPort, port = entry[:i], entry[i+1:]
+		if !validPort(spec.HostPort) {
+			return spec, fmt.Errorf("%s is not a port", spec.HostPort)
+		}
+	}
+	if !validPort(port) {
+		return spec, fmt.Errorf("%s is not a port", port)
+	}
+	spec.Port = docker.Port(port + "/" + proto)
+	return spec, nil
+}
+
+func validPort(p string) bool {
+	n, err := strconv.Atoi(p)
+	return err == nil && n > 0 && n < 65536
+}
+
+func exposedPorts(specs []PortSpec) map[docker.Port]struct{} {
+	exposed := make(map[docker.Port]struct{}, len(specs))
+	for _, spec := range specs {
+		exposed[spec.Port] = struct{}{}
+	}
+	return exposed
+}
+
+func portBindings(specs []PortSpec) map[docker.Port][]docker.PortBinding {
+	bindings := make(map[docker.Port][]docker.PortBinding, len(specs))
+	for _, spec := range specs {
+		bindings[spec.Port] = append(bindings[spec.Port], docker.PortBinding{HostPort: spec.HostPort})
+	}
+	return bindings
+}
+
+/*
+* boundPorts returns the host port bound to the first declared port and
+* every binding as port/proto:hostport, as docker reports them.
+ */
+func boundPorts(specs []PortSpec, container *docker.Container) (string, string) {
+	if container == nil || container.NetworkSettings == nil {
+		return "", ""
+	}
+	first := ""
+	all := []string{}
+	for _, spec := range specs {
+		for _, b := range container.NetworkSettings.Ports[spec.Port] {
+			if first == "" {
+				first = b.HostPort
+			}
+			all = append(all, string(spec.Port)+":"+b.HostPort)
+		}
+	}
+	sort.Strings(all)
+	return first, strings.Join(all, ",")
+}
@@ -0,0 +1,61 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestComponentPorts(c *check.C) {
+	com := &global.Component{Name: "web", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair("ports", "80, 8443:443/tcp,53/udp"),
+		global.GetKeyValuePair("port", "80"),
+	}}
+	specs, err := ComponentPorts(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(specs, check.DeepEquals, []PortSpec{
+		{Port: "80/tcp"},
+		{Port: "443/tcp", HostPort: "8443"},
+		{Port: "53/udp"},
+	})
+	c.Assert(portBindings(specs)["443/tcp"], check.DeepEquals, []docker.PortBinding{{HostPort: "8443"}})
+	c.Assert(exposedPorts(specs), check.HasLen, 3)
+}
+
+func (s *S) TestComponentPortsInvalid(c *check.C) {
+	com := &global.Component{Name: "web", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair("ports", "80/sctp"),
+	}}
+	_, err := ComponentPorts(com)
+	c.Assert(err, check.ErrorMatches, "component web : sctp is not a port protocol")
+
+	com.Inputs[0].Value = "99999"
+	_, err = ComponentPorts(com)
+	c.Assert(err, check.ErrorMatches, "component web : 99999 is not a port")
+}
+
+func (s *S) TestBoundPorts(c *check.C) {
+	specs := []PortSpec{{Port: "80/tcp"}, {Port: "443/tcp", HostPort: "8443"}}
+	container := &docker.Container{NetworkSettings: &docker.NetworkSettings{Ports: map[docker.Port][]docker.PortBinding{
+		"80/tcp":  {{HostIP: "0.0.0.0", HostPort: "32768"}},
+		"443/tcp": {{HostIP: "0.0.0.0", HostPort: "8443"}},
+	}}}
+	first, all := boundPorts(specs, container)
+	c.Assert(first, check.Equals, "32768")
+	c.Assert(all, check.Equals, "443/tcp:8443,80/tcp:32768")
+}
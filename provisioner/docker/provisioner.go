@@ -17,12 +17,12 @@ package docker
 
 import (
 	"encoding/json"
-	"fmt"
-	"strconv"
 
 	log "code.google.com/p/log4go"
 	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/app/bind"
 	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/ipam"
 	"github.com/megamsys/megamd/provisioner"
 	"github.com/tsuru/config"
 )
@@ -57,61 +57,245 @@ func (i *Docker) Create(assembly *global.AssemblyWithComponents, id string, inst
 		return "", perrscm
 	}
 
-	var endpoint string
-	if pair_endpoint.Value == BAREMETAL {
+	/*
+	 * every component gets its own container, launched after the
+	 * components it is related to.
+	 */
+	components, oerr := assembly.OrderedComponents()
+	if oerr != nil {
+		log.Error("Failed to order the components : %s", oerr)
+		return "", oerr
+	}
 
-		/*
-		 * swarm host is obtained from conf file. Swarm host is considered
-		 * only when the 'endpoint' is baremetal in the Component JSON
-		 */
-		api_host, _ := config.GetString("docker:swarm_host")
-		endpoint = api_host
+	/*
+	 * swarm host is obtained from conf file. Swarm host is considered
+	 * only when the 'endpoint' is baremetal in the Component JSON, the
+	 * docker engine of the VM otherwise.
+	 */
+	endpoint := pair_endpoint.Value
+	if endpoint == BAREMETAL {
+		endpoint, _ = config.GetString("docker:swarm_host")
+	}
 
-		containerID, containerName, cerr := create(assembly, endpoint)
-		if cerr != nil {
-			log.Error("container creation was failed : %s", cerr)
-			return "", cerr
-		}
+	pool, perr := assemblyPool(assembly)
+	if perr != nil {
+		return "", perr
+	}
 
-		pair_cpu, perrscm := global.ParseKeyValuePair(assembly.Components[0].Inputs, "cpu")
-		if perrscm != nil {
-			log.Error("Failed to get the endpoint value : %s", perrscm)
+	started := []*launched{}
+	promoted := []*global.Component{}
+	for _, com := range components {
+		c, lerr := launch(assembly, com, endpoint, act_id, pool)
+		if lerr == nil {
+			started = append(started, c)
+			promoted = append(promoted, com)
+			// the replicas the component asks for beside the first container.
+			replicas, serr := scale(assembly, com, endpoint, act_id, pool)
+			for _, r := range replicas {
+				started = append(started, &launched{ID: r.ID, Endpoint: r.on(endpoint)})
+			}
+			lerr = serr
 		}
+		if lerr != nil {
+			/*
+			 * the containers of the components launched before are
+			 * removed too, the pipeline rolls back from a clean state.
+			 */
+			for _, c := range started {
+				removeContainer(c.ID, c.Endpoint)
+				ipam.Release(pool.Name, c.ID)
+			}
+			for _, launchedCom := range promoted {
+				clearContainerJSON(launchedCom)
+			}
+			return "", lerr
+		}
+	}
 
-		pair_memory, iderr := global.ParseKeyValuePair(assembly.Components[0].Outputs, "memory")
-		if iderr != nil {
-			log.Error("Failed to get the endpoint value : %s", iderr)
+	/*
+	 * the monitor checks the components declaring a health check.
+	 */
+	for _, com := range components {
+		if check, _ := ComponentHealthCheck(com); check != nil {
+			if werr := watch(Watch{ComponentId: com.Id, AssemblyId: assembly.Id, AccountId: act_id}); werr != nil {
+				log.Error("Failed to watch the health of %s : %s", com.Name, werr)
+			}
 		}
+	}
+	return "", nil
+}
+
+/*
+* launch creates, starts and networks the container of the component,
+* then points the component and its host name to it. A container that
+* doesn't come up is removed.
+ */
+func launch(assembly *global.AssemblyWithComponents, com *global.Component, endpoint string, accountId string, pool *ipam.PoolConfig) (*launched, error) {
+	c, err := run(assembly, com, 0, endpoint, accountId, pool, "")
+	if err != nil {
+		return nil, err
+	}
+	promote(com, c)
+	return c, nil
+}
+
+/*
+* launched is a running container of a component.
+ */
+type launched struct {
+	ID       string
+	Name     string
+	IP       string
+	Endpoint string
+	Host     string
+	Pool     string
+	Port     string
+	Ports    string
+	Volumes  string
+	Account  string
+}
+
+/*
+* run creates, starts and networks a container of the component, the
+* component doesn't point to it yet. index numbers the replicas, 0 is the
+* container the component is launched with. pull is the pull policy of
+* the image, the one of the component when empty.
+ */
+func run(assembly *global.AssemblyWithComponents, com *global.Component, index int, endpoint string, accountId string, pool *ipam.PoolConfig, pull string) (*launched, error) {
+	ports, perr := ComponentPorts(com)
+	if perr != nil {
+		log.Error("Failed to get the ports : %s", perr)
+		return nil, perr
+	}
 
-		serr := StartContainer(containerID, endpoint, pair_cpu.Value, pair_memory.Value)
-		if serr != nil {
-			log.Error("container starting error : %s", serr)
-			return "", serr
+	volumes, verr := ComponentVolumes(assembly.Id, com)
+	if verr != nil {
+		log.Error("Failed to get the volumes : %s", verr)
+		return nil, verr
+	}
+
+	res, rerr := ComponentResources(com)
+	if rerr != nil {
+		log.Error("Failed to get the resources : %s", rerr)
+		return nil, rerr
+	}
+
+	/*
+	 * the scheduler picks the engine among the registered hosts, the
+	 * endpoint given is used when there are none. The containers of a
+	 * VM run on its own engine.
+	 */
+	var host *Host
+	if baremetal(assembly) {
+		placed, herr := place(com, index, res)
+		if herr != nil {
+			log.Error("Failed to place the container : %s", herr)
+			return nil, herr
 		}
+		host = placed
+	}
+	hostName := ""
+	if host != nil {
+		endpoint, hostName = host.Endpoint, host.Name
+	}
+
+	/*
+	 * a pool that is a docker network gives the container its address
+	 * when it is created, taken before the container has an id.
+	 */
+	client, _ := docker.NewClient(endpoint)
+	att, aerr := attach(client, pool, com, index, assembly.Id)
+	if aerr != nil {
+		log.Error("Failed to attach the container to the network : %s", aerr)
+		releasePlacement(pendingOwner(com, index))
+		return nil, aerr
+	}
+	network := ""
+	if att != nil {
+		network = att.Network
+	}
 
-		ipaddress, iperr := setContainerNAL(containerID, containerName, endpoint)
-		if iperr != nil {
-			log.Error("set container network was failed : %s", iperr)
-			return "", iperr
+	containerID, containerName, cerr := create(com, index, endpoint, accountId, ports, volumes, att, pull)
+	if cerr != nil {
+		log.Error("container creation was failed : %s", cerr)
+		if att != nil {
+			ipam.Release(pool.Name, pendingOwner(com, index))
 		}
+		releasePlacement(pendingOwner(com, index))
+		return nil, cerr
+	}
 
-		herr := setHostName(containerName, ipaddress)
-		if herr != nil {
-			log.Error("set host name error : %s", herr)
+	if perr := claimPlacement(pendingOwner(com, index), containerID); perr != nil {
+		log.Error("Failed to hand the placement to the container : %s", perr)
+	}
+
+	if att != nil {
+		if rerr := ipam.Reassign(pool.Name, pendingOwner(com, index), containerID); rerr != nil {
+			log.Error("Failed to hand the ip to the container : %s", rerr)
+			removeContainer(containerID, endpoint)
+			ipam.Release(pool.Name, pendingOwner(com, index))
+			return nil, rerr
 		}
+	}
 
-		updateContainerJSON(assembly, ipaddress, containerID, endpoint)
-	} else {
-		endpoint = pair_endpoint.Value
-		create(assembly, endpoint)
+	serr := StartContainer(containerID, endpoint, network, res, ports, volumes)
+	if serr != nil {
+		log.Error("container starting error : %s", serr)
+		removeContainer(containerID, endpoint)
+		ipam.Release(pool.Name, containerID)
+		return nil, serr
 	}
 
-	return "", nil
+	ipaddress, iperr := setContainerNAL(containerID, containerName, endpoint, hostName, pool, assembly.Id)
+	if iperr != nil {
+		log.Error("set container network was failed : %s", iperr)
+		removeContainer(containerID, endpoint)
+		ipam.Release(pool.Name, containerID)
+		return nil, iperr
+	}
+
+	/*
+	 * the host ports docker bound, free ones are only known once it runs.
+	 */
+	port, bound := "", ""
+	if len(ports) > 0 {
+		container, ierr := client.InspectContainer(containerID)
+		if ierr != nil {
+			log.Error("Failed to inspect the container ports : %s", ierr)
+		}
+		port, bound = boundPorts(ports, container)
+	}
+
+	return &launched{
+		ID:       containerID,
+		Name:     containerName,
+		IP:       ipaddress,
+		Endpoint: endpoint,
+		Host:     hostName,
+		Pool:     pool.Name,
+		Port:     port,
+		Ports:    bound,
+		Volumes:  volumesOutput(volumes),
+		Account:  accountId,
+	}, nil
 }
 
 /*
-* Delete command kills the container by talking to swarm cluster and giving
-* the container ID.
+* promote points the host name and the outputs of the component to the
+* container.
+ */
+func promote(com *global.Component, c *launched) {
+	herr := setHostName(c.Name, c.IP)
+	if herr != nil {
+		log.Error("set host name error : %s", herr)
+	}
+	updateContainerJSON(com, c.IP, c.ID, c.Endpoint, c.Host, c.Pool, c.Port, c.Ports, c.Volumes, c.Account)
+}
+
+/*
+* Delete command kills the containers of every component by talking to
+* swarm cluster and giving the container ID, in the reverse order they
+* were launched. The first failure is returned once all were tried.
 *
  */
 func (i *Docker) Delete(assembly *global.AssemblyWithComponents, id string) (string, error) {
@@ -119,11 +303,7 @@ func (i *Docker) Delete(assembly *global.AssemblyWithComponents, id string) (str
 	pair_endpoint, perrscm := global.ParseKeyValuePair(assembly.Inputs, "endpoint")
 	if perrscm != nil {
 		log.Error("Failed to get the endpoint value : %s", perrscm)
-	}
-
-	pair_id, iderr := global.ParseKeyValuePair(assembly.Components[0].Outputs, "id")
-	if iderr != nil {
-		log.Error("Failed to get the endpoint value : %s", iderr)
+		return "", perrscm
 	}
 
 	var endpoint string
@@ -136,47 +316,139 @@ func (i *Docker) Delete(assembly *global.AssemblyWithComponents, id string) (str
 		endpoint = pair_endpoint.Value
 	}
 
+	components, oerr := assembly.OrderedComponents()
+	if oerr != nil {
+		log.Error("Failed to order the components : %s", oerr)
+		return "", oerr
+	}
+
+	var derr error
+	for i := len(components) - 1; i >= 0; i-- {
+		if err := kill(assembly, components[i], endpoint); err != nil && derr == nil {
+			derr = err
+		}
+	}
+	return "", derr
+}
+
+func kill(assembly *global.AssemblyWithComponents, com *global.Component, endpoint string) error {
+	pair_id, iderr := global.ParseKeyValuePair(com.Outputs, "id")
+	if iderr != nil || pair_id.Value == "" {
+		log.Warn("Component %s has no container", com.Name)
+		return nil
+	}
+
+	if uerr := unwatch(com.Id); uerr != nil {
+		log.Error("Failed to stop watching the health of %s : %s", com.Name, uerr)
+	}
+	healthMonitor.forget(com.Id)
+
+	// the host the scheduler placed the container on.
+	if placed := output(com, "endpoint"); placed != "" {
+		endpoint = placed
+	}
+	if rerr := removeReplicas(com, endpoint); rerr != nil {
+		return rerr
+	}
+
 	client, _ := docker.NewClient(endpoint)
 	kerr := client.KillContainer(docker.KillContainerOptions{ID: pair_id.Value})
 	if kerr != nil {
 		log.Error("Failed to kill the container : %s", kerr)
-		return "", kerr
+		return kerr
 	}
-	log.Info("Container is killed")
-	return "", nil
+	log.Info("Container %s of %s is killed", pair_id.Value, com.Name)
+	releasePlacement(pair_id.Value)
+
+	/*
+	 * the volumes outlive the container unless the component asks for
+	 * them to be destroyed, which needs the container gone first.
+	 */
+	if volumeRetention(com) == DESTROY {
+		if rerr := removeContainer(pair_id.Value, endpoint); rerr != nil {
+			return rerr
+		}
+		if verr := destroyVolumes(client, com); verr != nil {
+			return verr
+		}
+	}
+
+	/*
+	 * the ip goes back to the pool recorded when the container was
+	 * launched, the one asked by the assembly for older containers.
+	 */
+	pool := ""
+	if pair_pool, err := global.ParseKeyValuePair(com.Outputs, ipam.POOLINPUT); err == nil {
+		pool = pair_pool.Value
+	} else if pair_pool, err := global.ParseKeyValuePair(assembly.Inputs, ipam.POOLINPUT); err == nil {
+		pool = pair_pool.Value
+	}
+	if rerr := ipam.Release(pool, pair_id.Value); rerr != nil {
+		log.Error("Failed to release the ip of the container : %s", rerr)
+		return rerr
+	}
+	return nil
 }
 
 /*
 * Docker API client to connect to swarm/docker VM.
 * Swarm supports all docker API endpoints
  */
-func create(assembly *global.AssemblyWithComponents, endpoint string) (string, string, error) {
+func create(com *global.Component, index int, endpoint string, accountId string, ports []PortSpec, volumes []VolumeSpec, att *attachment, pull string) (string, string, error) {
 
-	pair_img, perrscm := global.ParseKeyValuePair(assembly.Components[0].Inputs, "source")
+	pair_img, perrscm := global.ParseKeyValuePair(com.Inputs, "source")
 	if perrscm != nil {
 		log.Error("Failed to get the image value : %s", perrscm)
 		return "", "", perrscm
 	}
 
-	pair_domain, perrdomain := global.ParseKeyValuePair(assembly.Components[0].Inputs, "domain")
+	pair_domain, perrdomain := global.ParseKeyValuePair(com.Inputs, "domain")
 	if perrdomain != nil {
 		log.Error("Failed to get the image value : %s", perrdomain)
 		return "", "", perrdomain
 	}
 
+	env, enverr := bind.ComponentEnv(com)
+	if enverr != nil {
+		log.Error("Failed to get the environment of %s : %s", com.Name, enverr)
+		return "", "", enverr
+	}
+	log.Debug("Environment of %s : %s", com.Name, bind.Masked(env))
+
+	policy := pull
+	if policy == "" {
+		var policyerr error
+		if policy, policyerr = pullPolicy(com); policyerr != nil {
+			log.Error("Failed to get the pull policy : %s", policyerr)
+			return "", "", policyerr
+		}
+	}
+
 	client, _ := docker.NewClient(endpoint)
 
-	opts := docker.PullImageOptions{
-		Repository: pair_img.Value,
-	}
-	pullerr := client.PullImage(opts, docker.AuthConfiguration{})
+	pullerr := pullImage(client, pair_img.Value, policy, accountId)
 	if pullerr != nil {
 		log.Error("Image pulled failed : %s", pullerr)
 		return "", "", pullerr
 	}
 
-	dconfig := docker.Config{Image: pair_img.Value, NetworkDisabled: true}
-	copts := docker.CreateContainerOptions{Name: fmt.Sprint(assembly.Components[0].Name, ".", pair_domain.Value), Config: &dconfig}
+	/*
+	 * the volumes are created first, the container mounts them on start.
+	 */
+	if verr := createVolumes(client, com, volumes); verr != nil {
+		return "", "", verr
+	}
+
+	/*
+	 * a component without ports only gets the network gulpd sets up,
+	 * unless it joins the docker network of its pool.
+	 */
+	dconfig := docker.Config{Image: pair_img.Value, NetworkDisabled: att == nil && len(ports) == 0, ExposedPorts: exposedPorts(ports), Env: bind.DockerEnv(env), Volumes: mountPoints(volumes)}
+	copts := docker.CreateContainerOptions{Name: containerName(com, pair_domain.Value, index), Config: &dconfig}
+	if att != nil {
+		copts.HostConfig = &docker.HostConfig{NetworkMode: att.Network}
+		copts.NetworkingConfig = att.networkingConfig()
+	}
 
 	/*
 	 * Creation of the container with copts.
@@ -196,9 +468,10 @@ func create(assembly *global.AssemblyWithComponents, endpoint string) (string, s
 }
 
 /*
-* start the container using docker endpoint
+* start the container using docker endpoint, network is the docker network
+* it joined when created, empty for the gulpd one.
  */
-func StartContainer(containerID string, endpoint string, cpu string, cmemory string) error {
+func StartContainer(containerID string, endpoint string, network string, res *Resources, ports []PortSpec, volumes []VolumeSpec) error {
 
 	client, _ := docker.NewClient(endpoint)
 
@@ -206,20 +479,16 @@ func StartContainer(containerID string, endpoint string, cpu string, cmemory str
 	 * hostConfig{} struct for portbindings - to expose visible ports
 	 *  Also for specifying the container configurations (memory, cpuquota etc)
 	 */
-	mem, _ := strconv.Atoi(cmemory)
-	var memory int64
-	memory = int64(mem)
-
-	cpuq, _ := strconv.Atoi(cpu)
-	var cpuqo int64
-	cpuqo = int64(cpuq)
-	cpuQuota := cpuqo * 25000
-
-	period := 50000
-	var cpuPeriod int64
-	cpuPeriod = int64(period)
-
-	hostConfig := docker.HostConfig{Memory: memory, CPUPeriod: cpuPeriod, CPUQuota: cpuQuota}
+	hostConfig := docker.HostConfig{NetworkMode: network}
+	if res != nil {
+		res.hostConfig(&hostConfig)
+	}
+	if len(ports) > 0 {
+		hostConfig.PortBindings = portBindings(ports)
+	}
+	if len(volumes) > 0 {
+		hostConfig.Binds = volumeBinds(volumes)
+	}
 
 	/*
 	 *   Starting container once the container is created - container ID &
@@ -234,6 +503,21 @@ func StartContainer(containerID string, endpoint string, cpu string, cmemory str
 	return nil
 }
 
+/*
+* remove the container, running or not, using docker endpoint
+ */
+func removeContainer(containerID string, endpoint string) error {
+
+	client, _ := docker.NewClient(endpoint)
+	rerr := client.RemoveContainer(docker.RemoveContainerOptions{ID: containerID, Force: true})
+	if rerr != nil {
+		log.Error("container was not removed - Error : %s", rerr)
+		return rerr
+	}
+	releasePlacement(containerID)
+	return nil
+}
+
 /*
 * stop the container using docker endpoint
  */
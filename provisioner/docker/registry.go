@@ -0,0 +1,163 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	log "code.google.com/p/log4go"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/app/bind"
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/storage"
+	"github.com/tsuru/config"
+)
+
+const (
+	// the credentials of an account for a registry, keyed <accounts_id>_<registry host>.
+	REGISTRYKEYSBUCKET = "registrykeys"
+
+	// the registry of images without a registry host.
+	DEFAULTREGISTRY = "docker.io"
+
+	pullPolicyInput = "pull_policy"
+
+	PULLALWAYS       = "always"
+	PULLIFNOTPRESENT = "if-not-present"
+	PULLNEVER        = "never"
+)
+
+/*
+* RegistryKeys are the credentials an account pulls images of a private
+* registry with. The password is stored sealed with bind:secret.
+ */
+type RegistryKeys struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+/*
+* StoreRegistryKeys stores the credentials of the account for the
+* registry host, sealing the password.
+ */
+func StoreRegistryKeys(accountId string, host string, keys RegistryKeys) error {
+	sealed, err := bind.Encrypt(keys.Password)
+	if err != nil {
+		return err
+	}
+	keys.Password = sealed
+	return storage.StoreStruct(REGISTRYKEYSBUCKET, accountId+"_"+host, &keys)
+}
+
+/*
+* registryHost returns the registry of the image, the first part of its
+* name when it looks like a host (registry.megam.io/app, localhost:5000/app).
+ */
+func registryHost(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return DEFAULTREGISTRY
+	}
+	host := image[:i]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+	return DEFAULTREGISTRY
+}
+
+/*
+* registryAuth returns the credentials of the account for the registry of
+* the image, none when the account has none.
+ */
+func registryAuth(accountId string, image string) (docker.AuthConfiguration, error) {
+	host := registryHost(image)
+	auth := docker.AuthConfiguration{ServerAddress: host}
+	if accountId == "" {
+		return auth, nil
+	}
+	keys := &RegistryKeys{}
+	if err := storage.FetchStruct(REGISTRYKEYSBUCKET, accountId+"_"+host, keys); err != nil {
+		if storage.IsNotFound(err) {
+			log.Debug("No credentials of %s for %s, pulling anonymously", accountId, host)
+			return auth, nil
+		}
+		return auth, err
+	}
+	password, err := bind.Decrypt(keys.Password)
+	if err != nil {
+		return auth, fmt.Errorf("the credentials of %s for %s : %s", accountId, host, err)
+	}
+	if password == keys.Password && password != "" {
+		log.Warn("The password of %s for %s is stored in the clear", accountId, host)
+	}
+	auth.Username = keys.Username
+	auth.Password = password
+	auth.Email = keys.Email
+	return auth, nil
+}
+
+/*
+* pullPolicy is the pull_policy input of the component, else
+* docker:pull_policy in the conf file, always when both are missing.
+ */
+func pullPolicy(com *global.Component) (string, error) {
+	policy := ""
+	if pair, err := global.ParseKeyValuePair(com.Inputs, pullPolicyInput); err == nil {
+		policy = pair.Value
+	} else {
+		policy, _ = config.GetString("docker:pull_policy")
+	}
+	switch policy = strings.ToLower(strings.TrimSpace(policy)); policy {
+	case "":
+		return PULLALWAYS, nil
+	case PULLALWAYS, PULLIFNOTPRESENT, PULLNEVER:
+		return policy, nil
+	}
+	return "", fmt.Errorf("component %s : %s is not a pull policy", com.Name, policy)
+}
+
+/*
+* the part of the docker client pulling images.
+ */
+type imagePuller interface {
+	InspectImage(name string) (*docker.Image, error)
+	PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error
+}
+
+/*
+* pullImage pulls the image as the policy says, with the credentials of
+* the account for its registry.
+ */
+func pullImage(client imagePuller, image string, policy string, accountId string) error {
+	if policy != PULLALWAYS {
+		if _, err := client.InspectImage(image); err == nil {
+			log.Info("Image %s is present, not pulled", image)
+			return nil
+		} else if err != docker.ErrNoSuchImage {
+			return err
+		}
+		if policy == PULLNEVER {
+			return fmt.Errorf("image %s is not present and the pull policy is never", image)
+		}
+	}
+	auth, err := registryAuth(accountId, image)
+	if err != nil {
+		return err
+	}
+	return client.PullImage(docker.PullImageOptions{Repository: image}, auth)
+}
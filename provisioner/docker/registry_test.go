@@ -0,0 +1,110 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/storage"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+type fakePuller struct {
+	images map[string]bool
+	pulled []docker.AuthConfiguration
+}
+
+func (f *fakePuller) InspectImage(name string) (*docker.Image, error) {
+	if f.images[name] {
+		return &docker.Image{ID: name}, nil
+	}
+	return nil, docker.ErrNoSuchImage
+}
+
+func (f *fakePuller) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	f.pulled = append(f.pulled, auth)
+	return nil
+}
+
+func (s *S) TestRegistryHost(c *check.C) {
+	c.Assert(registryHost("postgres"), check.Equals, "docker.io")
+	c.Assert(registryHost("megam/gulpd:0.9"), check.Equals, "docker.io")
+	c.Assert(registryHost("registry.megam.io/megam/gulpd"), check.Equals, "registry.megam.io")
+	c.Assert(registryHost("localhost:5000/gulpd"), check.Equals, "localhost:5000")
+}
+
+func (s *S) TestPullImageWithAccountCredentials(c *check.C) {
+	config.Set("bind:secret", "s3cr3t")
+	defer config.Unset("bind:secret")
+	keys := RegistryKeys{Username: "megam", Password: "team4dog"}
+	c.Assert(StoreRegistryKeys("ACT001", "registry.megam.io", keys), check.IsNil)
+
+	stored := &RegistryKeys{}
+	c.Assert(storage.FetchStruct(REGISTRYKEYSBUCKET, "ACT001_registry.megam.io", stored), check.IsNil)
+	c.Assert(stored.Password, check.Not(check.Equals), "team4dog")
+
+	puller := &fakePuller{}
+	c.Assert(pullImage(puller, "registry.megam.io/megam/gulpd", PULLALWAYS, "ACT001"), check.IsNil)
+	c.Assert(puller.pulled, check.DeepEquals, []docker.AuthConfiguration{
+		{Username: "megam", Password: "team4dog", ServerAddress: "registry.megam.io"},
+	})
+
+	// other accounts pull anonymously.
+	c.Assert(pullImage(puller, "registry.megam.io/megam/gulpd", PULLALWAYS, "ACT002"), check.IsNil)
+	c.Assert(puller.pulled[1], check.DeepEquals, docker.AuthConfiguration{ServerAddress: "registry.megam.io"})
+}
+
+func (s *S) TestPullImageUnreadableCredentials(c *check.C) {
+	config.Set("bind:secret", "s3cr3t")
+	keys := RegistryKeys{Username: "megam", Password: "team4dog"}
+	c.Assert(StoreRegistryKeys("ACT003", "registry.megam.io", keys), check.IsNil)
+	config.Set("bind:secret", "other")
+	defer config.Unset("bind:secret")
+
+	puller := &fakePuller{}
+	err := pullImage(puller, "registry.megam.io/megam/gulpd", PULLALWAYS, "ACT003")
+	c.Assert(err, check.ErrorMatches, "the credentials of ACT003 for registry.megam.io : .*")
+	c.Assert(puller.pulled, check.HasLen, 0)
+}
+
+func (s *S) TestPullPolicies(c *check.C) {
+	puller := &fakePuller{images: map[string]bool{"postgres": true}}
+	c.Assert(pullImage(puller, "postgres", PULLIFNOTPRESENT, ""), check.IsNil)
+	c.Assert(puller.pulled, check.HasLen, 0)
+	c.Assert(pullImage(puller, "redis", PULLIFNOTPRESENT, ""), check.IsNil)
+	c.Assert(puller.pulled, check.HasLen, 1)
+	c.Assert(pullImage(puller, "postgres", PULLNEVER, ""), check.IsNil)
+	c.Assert(pullImage(puller, "mysql", PULLNEVER, ""), check.ErrorMatches, "image mysql is not present and the pull policy is never")
+	c.Assert(pullImage(puller, "postgres", PULLALWAYS, ""), check.IsNil)
+	c.Assert(puller.pulled, check.HasLen, 2)
+}
+
+func (s *S) TestPullPolicy(c *check.C) {
+	com := &global.Component{Name: "pg"}
+	policy, err := pullPolicy(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(policy, check.Equals, PULLALWAYS)
+
+	config.Set("docker:pull_policy", "if-not-present")
+	defer config.Unset("docker:pull_policy")
+	policy, _ = pullPolicy(com)
+	c.Assert(policy, check.Equals, PULLIFNOTPRESENT)
+
+	com.Inputs = []*global.KeyValuePair{global.GetKeyValuePair("pull_policy", "sometimes")}
+	_, err = pullPolicy(com)
+	c.Assert(err, check.ErrorMatches, "component pg : sometimes is not a pull policy")
+}
@@ -0,0 +1,356 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	log "code.google.com/p/log4go"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/ipam"
+	"github.com/tsuru/config"
+)
+
+/*
+* the component input with the number of containers it runs, and the
+* output listing the replicas beside the first container.
+ */
+const replicasInput = "replicas"
+
+/*
+* Replica is a container a component runs beside the one it was launched
+* with, numbered from 1. Primary is the container of the component when
+* the replica was launched, an update replaces the replicas that don't
+* follow the current one.
+ */
+type Replica struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	IP       string `json:"ip"`
+	Pool     string `json:"ip_pool"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Primary  string `json:"primary,omitempty"`
+}
+
+/*
+* on is the engine the replica runs on, the one given for replicas
+* launched before they were placed.
+ */
+func (r Replica) on(endpoint string) string {
+	if r.Endpoint != "" {
+		return r.Endpoint
+	}
+	return endpoint
+}
+
+func newReplica(index int, c *launched, primary string) Replica {
+	return Replica{Index: index, ID: c.ID, Name: c.Name, IP: c.IP, Pool: c.Pool, Endpoint: c.Endpoint, Host: c.Host, Primary: primary}
+}
+
+/*
+* containerName is <component>.<domain> for the first container of a
+* component, <component>-<index>.<domain> for its replicas.
+ */
+func containerName(com *global.Component, domain string, index int) string {
+	if index == 0 {
+		return fmt.Sprint(com.Name, ".", domain)
+	}
+	return fmt.Sprint(com.Name, "-", index, ".", domain)
+}
+
+/*
+* ComponentReplicas is the number of containers the component asks for,
+* one when it doesn't say.
+ */
+func ComponentReplicas(com *global.Component) (int, error) {
+	pair, err := global.ParseKeyValuePair(com.Inputs, replicasInput)
+	if err != nil || pair.Value == "" {
+		return 1, nil
+	}
+	n, cerr := strconv.Atoi(pair.Value)
+	if cerr != nil || n < 1 {
+		return 0, fmt.Errorf("component %s : %s is not a number of replicas", com.Name, pair.Value)
+	}
+	return n, nil
+}
+
+/*
+* Replicas lists the replicas recorded in the component outputs, oldest
+* first.
+ */
+func Replicas(com *global.Component) ([]Replica, error) {
+	replicas := []Replica{}
+	pair, err := global.ParseKeyValuePair(com.Outputs, replicasInput)
+	if err != nil || pair.Value == "" {
+		return replicas, nil
+	}
+	if jerr := json.Unmarshal([]byte(pair.Value), &replicas); jerr != nil {
+		return nil, fmt.Errorf("component %s has invalid replicas : %s", com.Name, jerr)
+	}
+	sort.Sort(byIndex(replicas))
+	return replicas, nil
+}
+
+type byIndex []Replica
+
+func (r byIndex) Len() int           { return len(r) }
+func (r byIndex) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byIndex) Less(i, j int) bool { return r[i].Index < r[j].Index }
+
+func setReplicas(com *global.Component, replicas []Replica) error {
+	out, err := json.Marshal(replicas)
+	if err != nil {
+		return err
+	}
+	com.SetOutput(replicasInput, string(out))
+	_, err = global.UpdateComponent(com.Id, func(stored *global.Component) error {
+		stored.SetOutput(replicasInput, string(out))
+		return nil
+	})
+	return err
+}
+
+/*
+* Scale runs as many containers for every component of the assembly as
+* its replicas input asks for.
+ */
+func Scale(assembly *global.AssemblyWithComponents) error {
+	pair_endpoint, perrscm := global.ParseKeyValuePair(assembly.Inputs, "endpoint")
+	if perrscm != nil {
+		log.Error("Failed to get the endpoint value : %s", perrscm)
+		return perrscm
+	}
+	if pair_endpoint.Value != BAREMETAL {
+		return fmt.Errorf("assembly %s : only baremetal containers can be scaled", assembly.Name)
+	}
+	endpoint, _ := config.GetString("docker:swarm_host")
+
+	pool, perr := assemblyPool(assembly)
+	if perr != nil {
+		return perr
+	}
+	components, oerr := assembly.OrderedComponents()
+	if oerr != nil {
+		log.Error("Failed to order the components : %s", oerr)
+		return oerr
+	}
+	for _, com := range components {
+		if output(com, "id") == "" {
+			return fmt.Errorf("component %s has no container to scale", com.Name)
+		}
+		if _, err := scale(assembly, com, endpoint, accountOf(com), pool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+* scale adds replicas to the component, or removes the newest ones, until
+* it runs the containers it asks for. The replicas added are returned.
+ */
+func scale(assembly *global.AssemblyWithComponents, com *global.Component, endpoint string, accountId string, pool *ipam.PoolConfig) ([]Replica, error) {
+	want, err := ComponentReplicas(com)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := Replicas(com)
+	if err != nil {
+		return nil, err
+	}
+
+	added := []Replica{}
+	if want > len(replicas)+1 {
+		reason, xerr := exclusive(assembly, com)
+		if xerr != nil {
+			return nil, xerr
+		}
+		if reason != "" {
+			return nil, fmt.Errorf("component %s %s, it can't have replicas", com.Name, reason)
+		}
+	}
+	for len(replicas)+1 < want {
+		index := 1
+		if n := len(replicas); n > 0 {
+			index = replicas[n-1].Index + 1
+		}
+		c, rerr := run(assembly, com, index, endpoint, accountId, pool, "")
+		if rerr != nil {
+			return added, rerr
+		}
+		if herr := setHostName(c.Name, c.IP); herr != nil {
+			log.Error("set host name error : %s", herr)
+		}
+		replica := newReplica(index, c, output(com, "id"))
+		replicas = append(replicas, replica)
+		added = append(added, replica)
+		if serr := setReplicas(com, replicas); serr != nil {
+			return added, serr
+		}
+		log.Info("Replica %d of %s is running at %s", index, com.Name, c.IP)
+	}
+
+	for len(replicas)+1 > want {
+		newest := replicas[len(replicas)-1]
+		if rerr := removeReplica(newest, endpoint); rerr != nil {
+			return added, rerr
+		}
+		replicas = replicas[:len(replicas)-1]
+		if serr := setReplicas(com, replicas); serr != nil {
+			return added, serr
+		}
+		log.Info("Replica %d of %s is removed", newest.Index, com.Name)
+	}
+	return added, nil
+}
+
+/*
+* removeReplica removes the container of the replica and gives its ip
+* back.
+ */
+func removeReplica(r Replica, endpoint string) error {
+	if err := removeContainer(r.ID, r.on(endpoint)); err != nil {
+		return err
+	}
+	return ipam.Release(r.Pool, r.ID)
+}
+
+/*
+* removeReplicas removes every replica of the component.
+ */
+func removeReplicas(com *global.Component, endpoint string) error {
+	replicas, err := Replicas(com)
+	if err != nil {
+		return err
+	}
+	var rerr error
+	for i := len(replicas) - 1; i >= 0; i-- {
+		if err := removeReplica(replicas[i], endpoint); err != nil {
+			log.Error("Failed to remove replica %d of %s : %s", replicas[i].Index, com.Name, err)
+			if rerr == nil {
+				rerr = err
+			}
+		}
+	}
+	return rerr
+}
+
+/*
+* replaceReplicas gives the replicas of the component that don't follow
+* primary, its container once it was updated, a new container one after
+* the other. The new container starts before the old one is removed, a
+* replica failing to start keeps the old one and is replaced when the
+* update is retried.
+ */
+func replaceReplicas(assembly *global.AssemblyWithComponents, com *global.Component, primary string, endpoint string, accountId string, pool *ipam.PoolConfig) error {
+	replicas, err := Replicas(com)
+	if err != nil {
+		return err
+	}
+	for i, r := range replicas {
+		if r.Primary == primary {
+			continue
+		}
+		// the new container takes the name, the old one keeps running aside.
+		old := &launched{ID: r.ID, Name: r.Name}
+		client, _ := docker.NewClient(r.on(endpoint))
+		if err := client.RenameContainer(docker.RenameContainerOptions{ID: r.ID, Name: retiredName(old)}); err != nil {
+			log.Error("Failed to rename replica %d of %s : %s", r.Index, com.Name, err)
+			return err
+		}
+		c, rerr := run(assembly, com, r.Index, endpoint, accountId, pool, PULLALWAYS)
+		if rerr != nil {
+			if err := client.RenameContainer(docker.RenameContainerOptions{ID: r.ID, Name: r.Name}); err != nil {
+				log.Error("Failed to rename replica %d of %s back : %s", r.Index, com.Name, err)
+			}
+			return rerr
+		}
+		if herr := setHostName(c.Name, c.IP); herr != nil {
+			log.Error("set host name error : %s", herr)
+		}
+		replicas[i] = newReplica(r.Index, c, primary)
+		if serr := setReplicas(com, replicas); serr != nil {
+			return serr
+		}
+		if err := removeReplica(r, endpoint); err != nil {
+			log.Error("Failed to remove the old container of replica %d of %s : %s", r.Index, com.Name, err)
+		}
+	}
+	return nil
+}
+
+/*
+* replicasBehind tells if a replica of the components follows a container
+* the component no longer points to, an update switched the components
+* but not all their replicas. Replicas launched before they recorded
+* their primary are taken as following the current one.
+ */
+func replicasBehind(components []*global.Component) (bool, error) {
+	for _, com := range components {
+		replicas, err := Replicas(com)
+		if err != nil {
+			return false, err
+		}
+		for _, r := range replicas {
+			if r.Primary != "" && r.Primary != output(com, "id") {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+/*
+* ReplicaAction starts, stops or restarts the replicas of the component.
+ */
+func ReplicaAction(action string, com *global.Component, endpoint string) error {
+	replicas, err := Replicas(com)
+	if err != nil {
+		return err
+	}
+	ports, err := ComponentPorts(com)
+	if err != nil {
+		return err
+	}
+	volumes, err := ContainerVolumes(com)
+	if err != nil {
+		return err
+	}
+	res, err := ComponentResources(com)
+	if err != nil {
+		return err
+	}
+	for _, r := range replicas {
+		switch action {
+		case "start":
+			err = StartContainer(r.ID, r.on(endpoint), ComponentNetwork(com), res, ports, volumes)
+		case "stop":
+			err = StopContainer(r.ID, r.on(endpoint))
+		case "restart":
+			err = RestartContainer(r.ID, r.on(endpoint))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/ipam"
+	"github.com/megamsys/megamd/storage"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestContainerName(c *check.C) {
+	com := &global.Component{Name: "web"}
+	c.Assert(containerName(com, "megam.co", 0), check.Equals, "web.megam.co")
+	c.Assert(containerName(com, "megam.co", 3), check.Equals, "web-3.megam.co")
+}
+
+func (s *S) TestComponentReplicas(c *check.C) {
+	com := &global.Component{Name: "web"}
+	n, err := ComponentReplicas(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 1)
+
+	com.Inputs = []*global.KeyValuePair{global.GetKeyValuePair("replicas", "4")}
+	n, err = ComponentReplicas(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 4)
+
+	com.Inputs[0].Value = "0"
+	_, err = ComponentReplicas(com)
+	c.Assert(err, check.ErrorMatches, "component web : 0 is not a number of replicas")
+}
+
+func (s *S) TestReplicasRecordedInOutputs(c *check.C) {
+	com := &global.Component{Id: "COMREP", Name: "web"}
+	c.Assert(storage.StoreStruct("components", com.Id, com), check.IsNil)
+
+	replicas := []Replica{
+		{Index: 2, ID: "c2", Name: "web-2.megam.co", IP: "103.56.93.9", Pool: "one"},
+		{Index: 1, ID: "c1", Name: "web-1.megam.co", IP: "103.56.93.8", Pool: "one"},
+	}
+	c.Assert(setReplicas(com, replicas), check.IsNil)
+
+	stored, err := (&global.Component{}).Get(com.Id)
+	c.Assert(err, check.IsNil)
+	listed, err := Replicas(stored)
+	c.Assert(err, check.IsNil)
+	c.Assert(listed, check.HasLen, 2)
+	c.Assert(listed[0].Index, check.Equals, 1)
+	c.Assert(listed[1].ID, check.Equals, "c2")
+}
+
+func (s *S) TestReplicasBehind(c *check.C) {
+	com := &global.Component{Id: "COMBEHIND", Name: "web"}
+	com.SetOutput("id", "c1")
+	c.Assert(storage.StoreStruct("components", com.Id, com), check.IsNil)
+	c.Assert(setReplicas(com, []Replica{{Index: 1, ID: "c2"}, {Index: 2, ID: "c3", Primary: "c1"}}), check.IsNil)
+	behind, err := replicasBehind([]*global.Component{com})
+	c.Assert(err, check.IsNil)
+	c.Assert(behind, check.Equals, false)
+
+	com.SetOutput("id", "c4")
+	behind, err = replicasBehind([]*global.Component{com})
+	c.Assert(err, check.IsNil)
+	c.Assert(behind, check.Equals, true)
+}
+
+func (s *S) TestScaleRefusesNamedVolumes(c *check.C) {
+	asm := &global.AssemblyWithComponents{Id: "ASM1"}
+	com := &global.Component{Name: "db", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair("replicas", "2"),
+		global.GetKeyValuePair("volumes", "data:/var/lib/data"),
+	}}
+	_, err := scale(asm, com, "", "", nil)
+	c.Assert(err, check.ErrorMatches, "component db mounts volume ASM1_data, it can't have replicas")
+}
+
+func (s *S) TestClearContainerJSON(c *check.C) {
+	com := &global.Component{Id: "COMCLEAR", Name: "web"}
+	com.SetOutput("id", "c1")
+	com.SetOutput("ip", "103.56.93.7")
+	com.SetOutput(ipam.POOLINPUT, "one")
+	c.Assert(storage.StoreStruct("components", com.Id, com), check.IsNil)
+	c.Assert(setReplicas(com, []Replica{{Index: 1, ID: "c2"}}), check.IsNil)
+
+	clearContainerJSON(com)
+	stored, err := (&global.Component{}).Get(com.Id)
+	c.Assert(err, check.IsNil)
+	for _, got := range []*global.Component{com, stored} {
+		c.Assert(output(got, "id"), check.Equals, "")
+		c.Assert(output(got, "ip"), check.Equals, "")
+		c.Assert(output(got, replicasInput), check.Equals, "")
+		c.Assert(output(got, ipam.POOLINPUT), check.Equals, "one")
+	}
+}
@@ -0,0 +1,349 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"github.com/tsuru/config"
+)
+
+/*
+* the resource keys. A component input, the plan it names and the docker
+* section of the conf file are looked up in this order.
+*
+*   docker:
+*     memory: 2147483648
+*     plans:
+*       small:
+*         memory: 512m
+*         cpuquota: 50000
+*         ulimits:
+*           - nofile=1024:2048
+ */
+const (
+	planInput = "plan"
+
+	memoryKey    = "memory"
+	swapKey      = "swap"
+	cpuSharesKey = "cpushares"
+	cpuPeriodKey = "cpuperiod"
+	cpuQuotaKey  = "cpuquota"
+	pidsLimitKey = "pidslimit"
+	ulimitsKey   = "ulimits"
+
+	// the cpus of the container, quota is cpus times the period.
+	cpusInput = "cpus"
+	// the cpu input of old, half a cpu each. quota is cpu times 25000 on
+	// a period of 50000.
+	cpuInput = "cpu"
+
+	defaultCpuPeriod = 100000
+	legacyCpuPeriod  = 50000
+	minMemory        = 4 * 1024 * 1024
+)
+
+/*
+* Resources are the limits a container runs with, 0 is no limit.
+ */
+type Resources struct {
+	Memory    int64
+	Swap      int64
+	CPUShares int64
+	CPUPeriod int64
+	CPUQuota  int64
+	PidsLimit int64
+	Ulimits   []docker.ULimit
+}
+
+/*
+* ComponentResources returns the limits of the component, the values it
+* doesn't set come from its plan, then from the conf file.
+ */
+func ComponentResources(com *global.Component) (*Resources, error) {
+	plan := ""
+	if pair, err := global.ParseKeyValuePair(com.Inputs, planInput); err == nil {
+		plan = strings.TrimSpace(pair.Value)
+	}
+	if plan != "" {
+		if _, err := config.Get("docker:plans:" + plan); err != nil {
+			return nil, fmt.Errorf("component %s : plan %s is not configured", com.Name, plan)
+		}
+	}
+	lookup := func(key string) (string, bool) {
+		if pair, err := global.ParseKeyValuePair(com.Inputs, key); err == nil && pair.Value != "" {
+			return pair.Value, true
+		}
+		if plan != "" {
+			if v, ok := configValue("docker:plans:" + plan + ":" + key); ok {
+				return v, true
+			}
+		}
+		return configValue("docker:" + key)
+	}
+	// the lists of the plan and the conf file are read as lists.
+	lookupList := func(key string) ([]string, bool) {
+		if pair, err := global.ParseKeyValuePair(com.Inputs, key); err == nil && pair.Value != "" {
+			return strings.Split(pair.Value, ","), true
+		}
+		if plan != "" {
+			if v, ok := configList("docker:plans:" + plan + ":" + key); ok {
+				return v, true
+			}
+		}
+		return configList("docker:" + key)
+	}
+
+	res, err := resources(lookup, lookupList, com)
+	if err != nil {
+		return nil, fmt.Errorf("component %s : %s", com.Name, err)
+	}
+	return res, nil
+}
+
+func resources(lookup func(string) (string, bool), lookupList func(string) ([]string, bool), com *global.Component) (*Resources, error) {
+	res := &Resources{}
+	var err error
+	if res.Memory, err = sizeValue(lookup, memoryKey); err != nil {
+		return nil, err
+	}
+	if res.Memory == 0 {
+		// launched components used to carry their memory as an output.
+		if pair, perr := global.ParseKeyValuePair(com.Outputs, memoryKey); perr == nil && pair.Value != "" {
+			if res.Memory, err = parseSize(pair.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if res.Swap, err = sizeValue(lookup, swapKey); err != nil {
+		return nil, err
+	}
+	for key, field := range map[string]*int64{cpuSharesKey: &res.CPUShares, cpuPeriodKey: &res.CPUPeriod, cpuQuotaKey: &res.CPUQuota, pidsLimitKey: &res.PidsLimit} {
+		if *field, err = intValue(lookup, key); err != nil {
+			return nil, err
+		}
+	}
+
+	// a cpuquota input wins over the cpus, cpus over cpu.
+	if _, quotaerr := global.ParseKeyValuePair(com.Inputs, cpuQuotaKey); quotaerr != nil {
+		if err := cpuQuota(res, com); err != nil {
+			return nil, err
+		}
+	}
+
+	if res.Ulimits, err = ulimitsValue(lookupList); err != nil {
+		return nil, err
+	}
+	return res, res.validate()
+}
+
+/*
+* cpuQuota sets the quota from the cpus input, else from the cpu input
+* as megamd always read it: half a cpu each.
+ */
+func cpuQuota(res *Resources, com *global.Component) error {
+	input, period, share := cpusInput, int64(defaultCpuPeriod), 1.0
+	pair, perr := global.ParseKeyValuePair(com.Inputs, cpusInput)
+	if perr != nil || pair.Value == "" {
+		input, period, share = cpuInput, legacyCpuPeriod, 0.5
+		if pair, perr = global.ParseKeyValuePair(com.Inputs, cpuInput); perr != nil || pair.Value == "" {
+			return nil
+		}
+	}
+	cpus, cerr := strconv.ParseFloat(pair.Value, 64)
+	if cerr != nil || cpus <= 0 {
+		return fmt.Errorf("%s %s is not a number of cpus", input, pair.Value)
+	}
+	if res.CPUPeriod == 0 {
+		res.CPUPeriod = period
+	}
+	res.CPUQuota = int64(cpus * share * float64(res.CPUPeriod))
+	return nil
+}
+
+/*
+* validate refuses the limits docker would refuse on start.
+ */
+func (res *Resources) validate() error {
+	switch {
+	case res.Memory < 0:
+		return fmt.Errorf("memory %d is negative", res.Memory)
+	case res.Memory > 0 && res.Memory < minMemory:
+		return fmt.Errorf("memory %d is below the 4m docker allows", res.Memory)
+	case res.Swap != 0 && res.Memory == 0:
+		return fmt.Errorf("swap needs a memory limit")
+	case res.Swap < -1:
+		return fmt.Errorf("swap %d is neither a size nor -1", res.Swap)
+	case res.CPUShares < 0:
+		return fmt.Errorf("cpushares %d is negative", res.CPUShares)
+	case res.CPUPeriod != 0 && (res.CPUPeriod < 1000 || res.CPUPeriod > 1000000):
+		return fmt.Errorf("cpuperiod %d is not between 1000 and 1000000", res.CPUPeriod)
+	case res.CPUQuota != 0 && res.CPUQuota < 1000:
+		return fmt.Errorf("cpuquota %d is below 1000", res.CPUQuota)
+	case res.PidsLimit < 0:
+		return fmt.Errorf("pidslimit %d is negative", res.PidsLimit)
+	}
+	return nil
+}
+
+/*
+* hostConfig sets the limits on the host config of a container. swap is
+* on top of the memory, -1 lets the container swap without limit.
+ */
+func (res *Resources) hostConfig(hc *docker.HostConfig) {
+	hc.Memory = res.Memory
+	switch {
+	case res.Swap == -1:
+		hc.MemorySwap = -1
+	case res.Swap > 0:
+		hc.MemorySwap = res.Memory + res.Swap
+	}
+	hc.CPUShares = res.CPUShares
+	hc.CPUPeriod = res.CPUPeriod
+	hc.CPUQuota = res.CPUQuota
+	hc.PidsLimit = res.PidsLimit
+	hc.Ulimits = res.Ulimits
+}
+
+/*
+* configValue reads a number or a string of the conf file.
+ */
+func configValue(key string) (string, bool) {
+	v, err := config.Get(key)
+	if err != nil || v == nil {
+		return "", false
+	}
+	s := strings.TrimSpace(fmt.Sprint(v))
+	return s, s != ""
+}
+
+/*
+* configList reads a list of the conf file, a single value is a list of
+* its comma separated entries.
+ */
+func configList(key string) ([]string, bool) {
+	if list, err := config.GetList(key); err == nil {
+		return list, len(list) > 0
+	}
+	v, ok := configValue(key)
+	if !ok {
+		return nil, false
+	}
+	return strings.Split(v, ","), true
+}
+
+func intValue(lookup func(string) (string, bool), key string) (int64, error) {
+	v, ok := lookup(key)
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s %s is not a number", key, v)
+	}
+	return n, nil
+}
+
+func sizeValue(lookup func(string) (string, bool), key string) (int64, error) {
+	v, ok := lookup(key)
+	if !ok {
+		return 0, nil
+	}
+	n, err := parseSize(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s %s", key, err)
+	}
+	return n, nil
+}
+
+/*
+* parseSize reads bytes, with an optional k, m or g suffix.
+ */
+func parseSize(v string) (int64, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(v, "k"):
+		unit = 1 << 10
+	case strings.HasSuffix(v, "m"):
+		unit = 1 << 20
+	case strings.HasSuffix(v, "g"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a size", v)
+	}
+	if n == -1 {
+		return -1, nil
+	}
+	return n * unit, nil
+}
+
+/*
+* ulimitsValue reads name=soft:hard limits, a comma separated input or a
+* list of the conf file.
+ */
+func ulimitsValue(lookupList func(string) ([]string, bool)) ([]docker.ULimit, error) {
+	entries, ok := lookupList(ulimitsKey)
+	if !ok {
+		return nil, nil
+	}
+	ulimits := []docker.ULimit{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		u, err := parseUlimit(entry)
+		if err != nil {
+			return nil, err
+		}
+		ulimits = append(ulimits, u)
+	}
+	return ulimits, nil
+}
+
+func parseUlimit(entry string) (docker.ULimit, error) {
+	u := docker.ULimit{}
+	i := strings.Index(entry, "=")
+	if i <= 0 {
+		return u, fmt.Errorf("ulimit %s is not name=soft[:hard]", entry)
+	}
+	u.Name = entry[:i]
+	limits := strings.SplitN(entry[i+1:], ":", 2)
+	var err error
+	if u.Soft, err = strconv.ParseInt(limits[0], 10, 64); err != nil {
+		return u, fmt.Errorf("ulimit %s is not name=soft[:hard]", entry)
+	}
+	u.Hard = u.Soft
+	if len(limits) == 2 {
+		if u.Hard, err = strconv.ParseInt(limits[1], 10, 64); err != nil {
+			return u, fmt.Errorf("ulimit %s is not name=soft[:hard]", entry)
+		}
+	}
+	if u.Soft > u.Hard {
+		return u, fmt.Errorf("ulimit %s has a soft limit above the hard one", entry)
+	}
+	return u, nil
+}
@@ -0,0 +1,120 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestComponentResourcesPrecedence(c *check.C) {
+	config.Set("docker:memory", 2147483648)
+	config.Set("docker:cpuperiod", 25000)
+	config.Set("docker:plans:small:memory", "512m")
+	config.Set("docker:plans:small:ulimits", []interface{}{"nofile=1024:2048"})
+	defer func() {
+		for _, key := range []string{"docker:memory", "docker:cpuperiod", "docker:plans:small", "docker:plans:small:memory", "docker:plans:small:ulimits"} {
+			config.Unset(key)
+		}
+	}()
+
+	// the conf file without a plan.
+	res, err := ComponentResources(&global.Component{Name: "web"})
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Memory, check.Equals, int64(2147483648))
+	c.Assert(res.CPUPeriod, check.Equals, int64(25000))
+
+	config.Set("docker:plans:small", map[interface{}]interface{}{})
+	com := &global.Component{Name: "web", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair("plan", "small"),
+		global.GetKeyValuePair("cpus", "2"),
+		global.GetKeyValuePair("pidslimit", "200"),
+	}}
+	res, err = ComponentResources(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Memory, check.Equals, int64(512<<20))
+	c.Assert(res.CPUQuota, check.Equals, int64(50000))
+	c.Assert(res.PidsLimit, check.Equals, int64(200))
+	c.Assert(res.Ulimits, check.DeepEquals, []docker.ULimit{{Name: "nofile", Soft: 1024, Hard: 2048}})
+
+	com.Inputs[0].Value = "huge"
+	_, err = ComponentResources(com)
+	c.Assert(err, check.ErrorMatches, "component web : plan huge is not configured")
+}
+
+func (s *S) TestComponentUlimits(c *check.C) {
+	config.Set("docker:ulimits", []interface{}{"nofile=1024:2048", "nproc=512"})
+	defer config.Unset("docker:ulimits")
+	res, err := ComponentResources(&global.Component{Name: "web"})
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Ulimits, check.DeepEquals, []docker.ULimit{{Name: "nofile", Soft: 1024, Hard: 2048}, {Name: "nproc", Soft: 512, Hard: 512}})
+
+	com := &global.Component{Name: "web", Inputs: []*global.KeyValuePair{global.GetKeyValuePair("ulimits", "core=0, nproc=64:128")}}
+	res, err = ComponentResources(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Ulimits, check.DeepEquals, []docker.ULimit{{Name: "core", Soft: 0, Hard: 0}, {Name: "nproc", Soft: 64, Hard: 128}})
+}
+
+func (s *S) TestComponentResourcesInvalid(c *check.C) {
+	com := &global.Component{Name: "web", Inputs: []*global.KeyValuePair{global.GetKeyValuePair("memory", "1m")}}
+	_, err := ComponentResources(com)
+	c.Assert(err, check.ErrorMatches, "component web : memory 1048576 is below the 4m docker allows")
+
+	com.Inputs[0] = global.GetKeyValuePair("swap", "1g")
+	_, err = ComponentResources(com)
+	c.Assert(err, check.ErrorMatches, "component web : swap needs a memory limit")
+
+	com.Inputs[0] = global.GetKeyValuePair("ulimits", "nofile=4096:1024")
+	_, err = ComponentResources(com)
+	c.Assert(err, check.ErrorMatches, "component web : ulimit nofile=4096:1024 has a soft limit above the hard one")
+
+	com.Inputs[0] = global.GetKeyValuePair("cpushares", "many")
+	_, err = ComponentResources(com)
+	c.Assert(err, check.ErrorMatches, "component web : cpushares many is not a number")
+}
+
+func (s *S) TestResourcesHostConfig(c *check.C) {
+	res := &Resources{Memory: 1 << 30, Swap: 1 << 29, CPUShares: 512}
+	hc := &docker.HostConfig{}
+	res.hostConfig(hc)
+	c.Assert(hc.Memory, check.Equals, int64(1<<30))
+	c.Assert(hc.MemorySwap, check.Equals, int64(1<<30+1<<29))
+	c.Assert(hc.CPUShares, check.Equals, int64(512))
+
+	res.Swap = -1
+	res.hostConfig(hc)
+	c.Assert(hc.MemorySwap, check.Equals, int64(-1))
+}
+
+func (s *S) TestComponentCpuInputIsHalfACpu(c *check.C) {
+	com := &global.Component{Name: "web", Inputs: []*global.KeyValuePair{global.GetKeyValuePair("cpu", "2")}}
+	res, err := ComponentResources(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(res.CPUPeriod, check.Equals, int64(50000))
+	c.Assert(res.CPUQuota, check.Equals, int64(50000))
+
+	com.Inputs = append(com.Inputs, global.GetKeyValuePair("cpus", "0.5"))
+	res, err = ComponentResources(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(res.CPUPeriod, check.Equals, int64(100000))
+	c.Assert(res.CPUQuota, check.Equals, int64(50000))
+
+	com.Inputs[1].Value = "some"
+	_, err = ComponentResources(com)
+	c.Assert(err, check.ErrorMatches, "component web : cpus some is not a number of cpus")
+}
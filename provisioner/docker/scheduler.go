@@ -0,0 +1,240 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/storage"
+	"github.com/tsuru/config"
+)
+
+/*
+* the placement policies. spread puts a container on the host running the
+* fewest containers of its component, then the fewest containers. binpack
+* fills the busiest host that still fits it.
+ */
+const (
+	SPREAD  = "spread"
+	BINPACK = "binpack"
+
+	placementInput    = "placement"
+	affinityInput     = "affinity"
+	antiAffinityInput = "anti_affinity"
+)
+
+/*
+* NoHostError is returned when no host fits the container of the
+* component.
+ */
+type NoHostError struct {
+	Component string
+	Reason    string
+}
+
+func (e *NoHostError) Error() string {
+	return fmt.Sprintf("no docker host for component %s : %s", e.Component, e.Reason)
+}
+
+/*
+* placementPolicy is the placement input of the component, or
+* docker:placement in the conf file.
+ */
+func placementPolicy(com *global.Component) (string, error) {
+	policy := ""
+	if pair, err := global.ParseKeyValuePair(com.Inputs, placementInput); err == nil {
+		policy = pair.Value
+	}
+	if policy == "" {
+		policy, _ = config.GetString("docker:placement")
+	}
+	switch policy {
+	case "":
+		return SPREAD, nil
+	case SPREAD, BINPACK:
+		return policy, nil
+	}
+	return "", fmt.Errorf("component %s : %s is not a placement policy, it is spread or binpack", com.Name, policy)
+}
+
+/*
+* constraints reads the key=value labels of an affinity input, separated
+* by commas. zone is the zone of the host.
+ */
+func constraints(com *global.Component, key string) (map[string]string, error) {
+	labels := map[string]string{}
+	pair, err := global.ParseKeyValuePair(com.Inputs, key)
+	if err != nil {
+		return labels, nil
+	}
+	for _, entry := range strings.Split(pair.Value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("component %s : %s is not a label, it is key=value", com.Name, entry)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+/*
+* matches is true when the host has every affinity label and none of the
+* anti affinity ones.
+ */
+func matches(h *Host, affinity map[string]string, anti map[string]string) bool {
+	for k, v := range affinity {
+		if hv, ok := h.label(k); !ok || hv != v {
+			return false
+		}
+	}
+	for k, v := range anti {
+		if hv, ok := h.label(k); ok && hv == v {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+* cpus is the number of cpus the quota allows, 0 when unlimited.
+ */
+func (res *Resources) cpus() float64 {
+	if res == nil || res.CPUQuota <= 0 || res.CPUPeriod <= 0 {
+		return 0
+	}
+	return float64(res.CPUQuota) / float64(res.CPUPeriod)
+}
+
+func (res *Resources) memory() int64 {
+	if res == nil || res.Memory < 0 {
+		return 0
+	}
+	return res.Memory
+}
+
+func fits(u *HostUsage, cpus float64, memory int64) bool {
+	if u.Cpus > 0 && u.UsedCpus+cpus > u.Cpus {
+		return false
+	}
+	if u.Memory > 0 && u.UsedMemory+memory > u.Memory {
+		return false
+	}
+	return true
+}
+
+/*
+* pick chooses among the hosts fitting the container by the policy, the
+* first by name on a tie. mine counts the containers of the component on
+* each host.
+ */
+func pick(candidates []*HostUsage, policy string, mine map[string]int) *HostUsage {
+	var best *HostUsage
+	better := func(u *HostUsage) bool {
+		if policy == BINPACK {
+			if u.UsedMemory != best.UsedMemory {
+				return u.UsedMemory > best.UsedMemory
+			}
+			return u.Containers > best.Containers
+		}
+		if mine[u.Name] != mine[best.Name] {
+			return mine[u.Name] < mine[best.Name]
+		}
+		return u.Containers < best.Containers
+	}
+	for _, u := range candidates {
+		if best == nil || better(u) {
+			best = u
+		}
+	}
+	return best
+}
+
+/*
+* place picks the host of a container of the component and takes what it
+* asks for of it, held by the pending owner until the container exists.
+* No host is picked when none are registered.
+ */
+func place(com *global.Component, index int, res *Resources) (*Host, error) {
+	hosts, err := Hosts()
+	if err != nil || len(hosts) == 0 {
+		return nil, err
+	}
+	policy, err := placementPolicy(com)
+	if err != nil {
+		return nil, err
+	}
+	affinity, err := constraints(com, affinityInput)
+	if err != nil {
+		return nil, err
+	}
+	anti, err := constraints(com, antiAffinityInput)
+	if err != nil {
+		return nil, err
+	}
+	cpus, memory := res.cpus(), res.memory()
+
+	var chosen *Host
+	err = storage.RetryOnConflict(func() error {
+		p := getPlacements()
+		p.sweep(time.Now())
+		used := usage(hosts, p)
+		mine := map[string]int{}
+		for _, pl := range p.Containers {
+			if pl.ComponentId == com.Id {
+				mine[pl.Host]++
+			}
+		}
+
+		candidates := []*HostUsage{}
+		matching := 0
+		for _, h := range hosts {
+			if !matches(h, affinity, anti) {
+				continue
+			}
+			matching++
+			if fits(used[h.Name], cpus, memory) {
+				candidates = append(candidates, used[h.Name])
+			}
+		}
+		if matching == 0 {
+			return &NoHostError{Component: com.Name, Reason: "no host has the labels it asks for"}
+		}
+		if len(candidates) == 0 {
+			return &NoHostError{Component: com.Name, Reason: fmt.Sprintf("no host has %g cpus and %d bytes of memory left", cpus, memory)}
+		}
+
+		best := pick(candidates, policy, mine)
+		p.Containers[pendingOwner(com, index)] = Placement{Host: best.Name, ComponentId: com.Id, Cpus: cpus, Memory: memory, Since: time.Now().Unix()}
+		if err := p.store(); err != nil {
+			return err
+		}
+		chosen = &best.Host
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Container %d of %s placed on %s (%s)", index, com.Name, chosen.Name, policy)
+	return chosen, nil
+}
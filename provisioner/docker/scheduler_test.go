@@ -0,0 +1,174 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"time"
+
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/storage"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func registerHosts(c *check.C) {
+	hosts := map[interface{}]interface{}{}
+	set := func(name string, values map[string]interface{}) {
+		hosts[name] = values
+		for k, v := range values {
+			config.Set("docker:hosts:"+name+":"+k, v)
+		}
+	}
+	set("east1", map[string]interface{}{"endpoint": "tcp://10.0.0.1:2375", "gulp_url": "http://10.0.0.1:8084/", "zone": "east", "cpus": "4", "memory": "4g", "labels": []interface{}{"ssd=true"}})
+	set("east2", map[string]interface{}{"endpoint": "tcp://10.0.0.2:2375", "zone": "east", "cpus": "4", "memory": "4g"})
+	set("west1", map[string]interface{}{"endpoint": "tcp://10.0.0.3:2375", "zone": "west", "memory": "1g"})
+	config.Set("docker:hosts", hosts)
+	c.Assert(storage.StoreStruct(HOSTSBUCKET, placementsKey, &placements{}), check.IsNil)
+}
+
+func unregisterHosts() {
+	config.Unset("docker:hosts")
+	config.Unset("docker:placement")
+}
+
+func (s *S) TestHosts(c *check.C) {
+	registerHosts(c)
+	defer unregisterHosts()
+
+	hosts, err := Hosts()
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.HasLen, 3)
+	c.Assert(hosts[0].Name, check.Equals, "east1")
+	c.Assert(hosts[0].Cpus, check.Equals, 4.0)
+	c.Assert(hosts[0].Memory, check.Equals, int64(4<<30))
+	c.Assert(hosts[0].Labels, check.DeepEquals, map[string]string{"ssd": "true"})
+	c.Assert(hosts[2].Cpus, check.Equals, 0.0)
+}
+
+func (s *S) TestPlaceSpread(c *check.C) {
+	registerHosts(c)
+	defer unregisterHosts()
+	com := &global.Component{Id: "COM71", Name: "web"}
+	res := &Resources{Memory: 512 << 20}
+
+	placed := []string{}
+	for i := 0; i < 3; i++ {
+		h, err := place(com, i, res)
+		c.Assert(err, check.IsNil)
+		c.Assert(claimPlacement(pendingOwner(com, i), "c"+h.Name), check.IsNil)
+		placed = append(placed, h.Name)
+	}
+	// every replica of the component goes to another host.
+	c.Assert(placed, check.DeepEquals, []string{"east1", "east2", "west1"})
+
+	usage, err := ListHostUsage()
+	c.Assert(err, check.IsNil)
+	c.Assert(usage[0].Containers, check.Equals, 1)
+	c.Assert(usage[0].UsedMemory, check.Equals, int64(512<<20))
+
+	releasePlacement("ceast1")
+	h, err := place(com, 3, res)
+	c.Assert(err, check.IsNil)
+	c.Assert(h.Name, check.Equals, "east1")
+}
+
+func (s *S) TestPlaceBinpack(c *check.C) {
+	registerHosts(c)
+	defer unregisterHosts()
+	config.Set("docker:placement", "binpack")
+	com := &global.Component{Id: "COM72", Name: "worker", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair(affinityInput, "zone=east"),
+	}}
+	res := &Resources{Memory: 3 << 30, CPUPeriod: 100000, CPUQuota: 200000}
+
+	h, err := place(com, 0, res)
+	c.Assert(err, check.IsNil)
+	c.Assert(h.Name, check.Equals, "east1")
+
+	// east1 has no room left for a second one.
+	h, err = place(com, 1, &Resources{Memory: 512 << 20})
+	c.Assert(err, check.IsNil)
+	c.Assert(h.Name, check.Equals, "east1")
+	h, err = place(com, 2, res)
+	c.Assert(err, check.IsNil)
+	c.Assert(h.Name, check.Equals, "east2")
+
+	_, err = place(com, 3, res)
+	c.Assert(err, check.FitsTypeOf, &NoHostError{})
+}
+
+func (s *S) TestPlaceAffinity(c *check.C) {
+	registerHosts(c)
+	defer unregisterHosts()
+	com := &global.Component{Id: "COM73", Name: "db", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair(antiAffinityInput, "ssd=true, zone=west"),
+	}}
+	h, err := place(com, 0, &Resources{})
+	c.Assert(err, check.IsNil)
+	c.Assert(h.Name, check.Equals, "east2")
+
+	com.Inputs = []*global.KeyValuePair{global.GetKeyValuePair(affinityInput, "zone=north")}
+	_, err = place(com, 1, &Resources{})
+	c.Assert(err, check.ErrorMatches, "no docker host for component db : no host has the labels it asks for")
+
+	com.Inputs = []*global.KeyValuePair{global.GetKeyValuePair(placementInput, "random")}
+	_, err = place(com, 1, &Resources{})
+	c.Assert(err, check.ErrorMatches, "component db : random is not a placement policy.*")
+}
+
+func (s *S) TestPlaceWithoutHosts(c *check.C) {
+	h, err := place(&global.Component{Id: "COM74", Name: "web"}, 0, &Resources{})
+	c.Assert(err, check.IsNil)
+	c.Assert(h, check.IsNil)
+}
+
+func (s *S) TestPlaceDropsStalePending(c *check.C) {
+	registerHosts(c)
+	defer unregisterHosts()
+	stale := &placements{Containers: map[string]Placement{
+		"pending:COM75/1": {Host: "west1", ComponentId: "COM75", Memory: 1 << 30, Since: time.Now().Add(-2 * time.Hour).Unix()},
+		"pending:COM75/2": {Host: "east1", ComponentId: "COM75", Memory: 1 << 30, Since: time.Now().Unix()},
+	}}
+	c.Assert(storage.StoreStruct(HOSTSBUCKET, placementsKey, stale), check.IsNil)
+
+	com := &global.Component{Id: "COM76", Name: "web", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair(affinityInput, "zone=west"),
+	}}
+	h, err := place(com, 0, &Resources{Memory: 512 << 20})
+	c.Assert(err, check.IsNil)
+	c.Assert(h.Name, check.Equals, "west1")
+	p := getPlacements()
+	_, ok := p.Containers["pending:COM75/1"]
+	c.Assert(ok, check.Equals, false)
+	_, ok = p.Containers["pending:COM75/2"]
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *S) TestGulpURL(c *check.C) {
+	config.Set("docker:gulp_url", "http://localhost:8084/")
+	defer config.Unset("docker:gulp_url")
+	url, err := gulpURL("")
+	c.Assert(err, check.IsNil)
+	c.Assert(url, check.Equals, "http://localhost:8084/")
+
+	registerHosts(c)
+	defer unregisterHosts()
+	url, err = gulpURL("east1")
+	c.Assert(err, check.IsNil)
+	c.Assert(url, check.Equals, "http://10.0.0.1:8084/")
+	_, err = gulpURL("east2")
+	c.Assert(err, check.ErrorMatches, "docker host east2 has no gulp_url")
+}
@@ -0,0 +1,422 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"fmt"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"github.com/megamsys/megamd/ipam"
+	"github.com/tsuru/config"
+)
+
+const (
+	// rolling or bluegreen, how the containers of an assembly are updated.
+	updateStrategyInput = "update_strategy"
+
+	ROLLING   = "rolling"
+	BLUEGREEN = "bluegreen"
+
+	// the status of a component while its container is replaced, the
+	// health monitor leaves it alone.
+	UPDATING = "updating"
+
+	// the output with the account the container was launched for.
+	accountOutput = "accounts_id"
+
+	healthPoll = 2 * time.Second
+)
+
+/*
+* updateStrategy is the update_strategy input of the assembly, else
+* docker:update_strategy in the conf file, rolling when both are missing.
+ */
+func updateStrategy(assembly *global.AssemblyWithComponents) (string, error) {
+	strategy := ""
+	if pair, err := global.ParseKeyValuePair(assembly.Inputs, updateStrategyInput); err == nil {
+		strategy = pair.Value
+	} else {
+		strategy, _ = config.GetString("docker:update_strategy")
+	}
+	switch strategy {
+	case "":
+		return ROLLING, nil
+	case ROLLING, BLUEGREEN:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("assembly %s : %s is not an update strategy", assembly.Name, strategy)
+}
+
+/*
+* docker:update_timeout in the conf file, the seconds a new container has
+* to pass its health check, docker:start_timeout when missing.
+ */
+func updateTimeout() time.Duration {
+	secs, err := config.GetInt("docker:update_timeout")
+	if err != nil || secs <= 0 {
+		return startTimeout()
+	}
+	return time.Duration(secs) * time.Second
+}
+
+/*
+* replacement is the new container of a component taking over from the
+* old one.
+ */
+type replacement struct {
+	com      *global.Component
+	status   string
+	old      *launched
+	new      *launched
+	renamed  bool
+	stopped  bool
+	promoted bool
+}
+
+/*
+* current is the container the component points to.
+ */
+func current(com *global.Component) (*launched, error) {
+	id := output(com, "id")
+	if id == "" {
+		return nil, fmt.Errorf("component %s has no container to update", com.Name)
+	}
+	pair_domain, err := global.ParseKeyValuePair(com.Inputs, "domain")
+	if err != nil {
+		return nil, err
+	}
+	return &launched{
+		ID:       id,
+		Name:     containerName(com, pair_domain.Value, 0),
+		IP:       output(com, "ip"),
+		Endpoint: output(com, "endpoint"),
+		Host:     output(com, "host"),
+		Pool:     output(com, ipam.POOLINPUT),
+		Port:     output(com, "port"),
+		Ports:    output(com, "ports"),
+		Volumes:  output(com, volumeInput),
+		Account:  output(com, accountOutput),
+	}, nil
+}
+
+/*
+* accountOf is the account the component was launched for, its images
+* are pulled with the account's registry credentials.
+ */
+func accountOf(com *global.Component) string {
+	return output(com, accountOutput)
+}
+
+/*
+* Update replaces the containers of the assembly with new ones of the
+* image its components name now. The rolling strategy replaces one
+* component after the other, in relation order. The blue/green strategy
+* starts every new container before any component points to it. The old
+* containers are removed once every new one passed its health check,
+* until then a failure brings the old ones back.
+ */
+func Update(assembly *global.AssemblyWithComponents) error {
+	pair_endpoint, perrscm := global.ParseKeyValuePair(assembly.Inputs, "endpoint")
+	if perrscm != nil {
+		log.Error("Failed to get the endpoint value : %s", perrscm)
+		return perrscm
+	}
+	if pair_endpoint.Value != BAREMETAL {
+		return fmt.Errorf("assembly %s : only baremetal containers can be updated", assembly.Name)
+	}
+	endpoint, _ := config.GetString("docker:swarm_host")
+
+	strategy, serr := updateStrategy(assembly)
+	if serr != nil {
+		return serr
+	}
+	pool, perr := assemblyPool(assembly)
+	if perr != nil {
+		return perr
+	}
+	components, oerr := assembly.OrderedComponents()
+	if oerr != nil {
+		log.Error("Failed to order the components : %s", oerr)
+		return oerr
+	}
+
+	/*
+	 * a retried update whose components were switched already only
+	 * replaces the replicas left behind.
+	 */
+	behind, berr := replicasBehind(components)
+	if berr != nil {
+		return berr
+	}
+	if behind {
+		log.Info("The components of %s were updated, updating the replicas left", assembly.Name)
+		var err error
+		for _, com := range components {
+			if rerr := replaceReplicas(assembly, com, output(com, "id"), endpoint, accountOf(com), pool); rerr != nil {
+				log.Error("Failed to update the replicas of %s : %s", com.Name, rerr)
+				err = rerr
+			}
+		}
+		return err
+	}
+
+	replacements := make([]*replacement, 0, len(components))
+	for _, com := range components {
+		old, err := current(com)
+		if err != nil {
+			return err
+		}
+		if old.Endpoint == "" {
+			old.Endpoint = endpoint
+		}
+		replacements = append(replacements, &replacement{com: com, status: com.Status, old: old})
+	}
+
+	log.Info("Updating %s, %s", assembly.Name, strategy)
+	for _, r := range replacements {
+		SetStatus(r.com.Id, UPDATING)
+	}
+
+	var err error
+	if strategy == BLUEGREEN {
+		err = blueGreen(assembly, replacements, pool)
+	} else {
+		err = rolling(assembly, replacements, pool)
+	}
+	if err != nil {
+		log.Error("Update of %s failed, rolling back : %s", assembly.Name, err)
+		rollback(replacements)
+		return err
+	}
+
+	for _, r := range replacements {
+		r.retire()
+	}
+
+	/*
+	 * the replicas follow, a failed one keeps its old container until
+	 * the update is retried.
+	 */
+	for _, r := range replacements {
+		if rerr := replaceReplicas(assembly, r.com, r.new.ID, endpoint, r.old.Account, pool); rerr != nil {
+			log.Error("Failed to update the replicas of %s : %s", r.com.Name, rerr)
+			err = rerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("Assembly %s is updated", assembly.Name)
+	return nil
+}
+
+func rolling(assembly *global.AssemblyWithComponents, replacements []*replacement, pool *ipam.PoolConfig) error {
+	for _, r := range replacements {
+		if err := r.start(assembly, pool); err != nil {
+			return err
+		}
+		if err := r.waitHealthy(updateTimeout()); err != nil {
+			return err
+		}
+		r.promote()
+		if err := r.stopOld(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func blueGreen(assembly *global.AssemblyWithComponents, replacements []*replacement, pool *ipam.PoolConfig) error {
+	for _, r := range replacements {
+		if err := r.start(assembly, pool); err != nil {
+			return err
+		}
+	}
+	for _, r := range replacements {
+		if err := r.waitHealthy(updateTimeout()); err != nil {
+			return err
+		}
+	}
+	for _, r := range replacements {
+		r.promote()
+	}
+	for _, r := range replacements {
+		if err := r.stopOld(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+* start runs the new container beside the old one. The old one makes way
+* first when the component binds fixed host ports or mounts named
+* volumes, the two containers would write to the same volume.
+ */
+func (r *replacement) start(assembly *global.AssemblyWithComponents, pool *ipam.PoolConfig) error {
+	reason, err := exclusive(assembly, r.com)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		log.Info("Component %s %s, its old container stops first", r.com.Name, reason)
+		if err := r.stopOld(); err != nil {
+			return err
+		}
+	}
+
+	// the new container takes the name, the old one keeps running aside.
+	client, _ := docker.NewClient(r.old.Endpoint)
+	if err := client.RenameContainer(docker.RenameContainerOptions{ID: r.old.ID, Name: retiredName(r.old)}); err != nil {
+		log.Error("Failed to rename the container of %s : %s", r.com.Name, err)
+		return err
+	}
+	r.renamed = true
+
+	// a tag moved to a new image is pulled whatever the pull policy.
+	r.new, err = run(assembly, r.com, 0, r.old.Endpoint, r.old.Account, pool, PULLALWAYS)
+	return err
+}
+
+/*
+* exclusive tells why a single container of the component may run at a
+* time, empty when several may.
+ */
+func exclusive(assembly *global.AssemblyWithComponents, com *global.Component) (string, error) {
+	ports, err := ComponentPorts(com)
+	if err != nil {
+		return "", err
+	}
+	for _, spec := range ports {
+		if spec.HostPort != "" {
+			return "binds host port " + spec.HostPort, nil
+		}
+	}
+	volumes, err := ComponentVolumes(assembly.Id, com)
+	if err != nil {
+		return "", err
+	}
+	for _, spec := range volumes {
+		if spec.Named() {
+			return "mounts volume " + spec.Source, nil
+		}
+	}
+	return "", nil
+}
+
+func retiredName(c *launched) string {
+	id := c.ID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return c.Name + "-" + id
+}
+
+/*
+* waitHealthy waits for the new container to pass the health check of the
+* component. Without one, running is enough.
+ */
+func (r *replacement) waitHealthy(timeout time.Duration) error {
+	check, err := ComponentHealthCheck(r.com)
+	if err != nil || check == nil {
+		return err
+	}
+	client, _ := docker.NewClient(r.new.Endpoint)
+	deadline := time.Now().Add(timeout)
+	for {
+		perr := probe(client, check, r.new.ID, r.new.IP)
+		if perr == nil {
+			log.Info("New container of %s is healthy", r.com.Name)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("new container of %s isn't healthy after %s : %s", r.com.Name, timeout, perr)
+		}
+		time.Sleep(healthPoll)
+	}
+}
+
+func (r *replacement) promote() {
+	promote(r.com, r.new)
+	r.promoted = true
+}
+
+func (r *replacement) stopOld() error {
+	if r.stopped {
+		return nil
+	}
+	if err := StopContainer(r.old.ID, r.old.Endpoint); err != nil {
+		return err
+	}
+	r.stopped = true
+	return nil
+}
+
+/*
+* retire removes the old container and gives its ip back.
+ */
+func (r *replacement) retire() {
+	removeContainer(r.old.ID, r.old.Endpoint)
+	if err := ipam.Release(r.old.Pool, r.old.ID); err != nil {
+		log.Error("Failed to release the ip of the old container of %s : %s", r.com.Name, err)
+	}
+	status := r.status
+	if check, _ := ComponentHealthCheck(r.com); check != nil {
+		status = HEALTHY
+	}
+	SetStatus(r.com.Id, status)
+}
+
+/*
+* rollback removes the new containers and brings the old ones back, the
+* last replaced first.
+ */
+func rollback(replacements []*replacement) {
+	for i := len(replacements) - 1; i >= 0; i-- {
+		r := replacements[i]
+		if r.new != nil {
+			removeContainer(r.new.ID, r.new.Endpoint)
+			if err := ipam.Release(r.new.Pool, r.new.ID); err != nil {
+				log.Error("Failed to release the ip of the new container of %s : %s", r.com.Name, err)
+			}
+		}
+		if r.renamed {
+			client, _ := docker.NewClient(r.old.Endpoint)
+			if err := client.RenameContainer(docker.RenameContainerOptions{ID: r.old.ID, Name: r.old.Name}); err != nil {
+				log.Error("Failed to rename the container of %s back : %s", r.com.Name, err)
+			}
+		}
+		if r.stopped {
+			if err := RestartContainer(r.old.ID, r.old.Endpoint); err != nil {
+				log.Error("Failed to start the old container of %s : %s", r.com.Name, err)
+			} else if pool, err := ipam.GetPoolConfig(r.old.Pool); err == nil && !pool.Native() {
+				// a started container needs its gulpd network again.
+				if gulpUrl, gerr := gulpURL(r.old.Host); gerr != nil {
+					log.Error("Failed to set the network of the old container of %s up : %s", r.com.Name, gerr)
+				} else {
+					postnetwork(gulpUrl, r.old.ID, r.old.IP, pool)
+				}
+			}
+		}
+		if r.promoted {
+			promote(r.com, r.old)
+		}
+		SetStatus(r.com.Id, r.status)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"time"
+
+	"github.com/megamsys/megamd/global"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestUpdateStrategy(c *check.C) {
+	asm := &global.AssemblyWithComponents{Name: "shop"}
+	strategy, err := updateStrategy(asm)
+	c.Assert(err, check.IsNil)
+	c.Assert(strategy, check.Equals, ROLLING)
+
+	config.Set("docker:update_strategy", "bluegreen")
+	defer config.Unset("docker:update_strategy")
+	strategy, _ = updateStrategy(asm)
+	c.Assert(strategy, check.Equals, BLUEGREEN)
+
+	asm.Inputs = []*global.KeyValuePair{global.GetKeyValuePair("update_strategy", "canary")}
+	_, err = updateStrategy(asm)
+	c.Assert(err, check.ErrorMatches, "assembly shop : canary is not an update strategy")
+}
+
+func (s *S) TestCurrentContainer(c *check.C) {
+	com := &global.Component{Name: "web",
+		Inputs: []*global.KeyValuePair{global.GetKeyValuePair("domain", "megam.co")},
+		Outputs: []*global.KeyValuePair{
+			global.GetKeyValuePair("id", "4f2a9c0e77d1b2c3d4e5"),
+			global.GetKeyValuePair("ip", "103.56.93.7"),
+			global.GetKeyValuePair("ip_pool", "one"),
+			global.GetKeyValuePair("accounts_id", "ACT1"),
+		},
+	}
+	old, err := current(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(old.Name, check.Equals, "web.megam.co")
+	c.Assert(old.Account, check.Equals, "ACT1")
+	c.Assert(accountOf(com), check.Equals, "ACT1")
+	c.Assert(old.IP, check.Equals, "103.56.93.7")
+	c.Assert(old.Pool, check.Equals, "one")
+	c.Assert(retiredName(old), check.Equals, "web.megam.co-4f2a9c0e77d1")
+
+	_, err = current(&global.Component{Name: "db"})
+	c.Assert(err, check.ErrorMatches, "component db has no container to update")
+}
+
+func (s *S) TestWaitHealthyWithoutHealthCheck(c *check.C) {
+	r := &replacement{com: &global.Component{Name: "web"}, new: &launched{ID: "c2"}}
+	c.Assert(r.waitHealthy(time.Millisecond), check.IsNil)
+}
+
+func (s *S) TestExclusive(c *check.C) {
+	asm := &global.AssemblyWithComponents{Id: "ASM1"}
+	com := &global.Component{Name: "web"}
+	reason, err := exclusive(asm, com)
+	c.Assert(err, check.IsNil)
+	c.Assert(reason, check.Equals, "")
+
+	com.Inputs = []*global.KeyValuePair{global.GetKeyValuePair("volumes", "data:/var/lib/data")}
+	reason, err = exclusive(asm, com)
+	c.Assert(err, check.IsNil)
+	c.Assert(reason, check.Equals, "mounts volume ASM1_data")
+
+	com.Inputs = []*global.KeyValuePair{global.GetKeyValuePair("ports", "8080:80")}
+	reason, err = exclusive(asm, com)
+	c.Assert(err, check.IsNil)
+	c.Assert(reason, check.Equals, "binds host port 8080")
+}
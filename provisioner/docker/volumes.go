@@ -0,0 +1,343 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	log "code.google.com/p/log4go"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/megamsys/megamd/global"
+	"github.com/tsuru/config"
+)
+
+const (
+	// the component input declaring volumes, a comma separated list. An
+	// entry is [source:]target[:ro], source a volume name or a host path,
+	// data:/var/lib/postgresql or /srv/conf:/etc/app:ro. A volume named
+	// after the component is created when the source is missing, the
+	// volumes named are the assembly's own. Host paths have to be under
+	// one of docker:volume_host_paths.
+	volumeInput = "volumes"
+
+	// tosca size of the volumes, handed to volume drivers taking a size.
+	diskSizeInput = "disk_size"
+
+	// retain or destroy, what becomes of the volumes on delete.
+	retentionInput = "volume_retention"
+
+	RETAIN  = "retain"
+	DESTROY = "destroy"
+)
+
+/*
+* VolumeSpec is a volume or a host path a component mounts.
+ */
+type VolumeSpec struct {
+	// the volume name, the host path of a bind mount.
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+/*
+* Named is true for a docker volume, false for a host bind mount.
+ */
+func (v VolumeSpec) Named() bool {
+	return !strings.HasPrefix(v.Source, "/")
+}
+
+/*
+* Bind is the volume as docker binds it, source:target[:ro].
+ */
+func (v VolumeSpec) Bind() string {
+	bind := v.Source + ":" + v.Target
+	if v.ReadOnly {
+		bind += ":ro"
+	}
+	return bind
+}
+
+/*
+* ComponentVolumes returns the volumes declared by the component inputs.
+* The volumes it names are prefixed with the assembly id, when given, so
+* no other assembly mounts them.
+ */
+func ComponentVolumes(assemblyId string, com *global.Component) ([]VolumeSpec, error) {
+	pair, err := global.ParseKeyValuePair(com.Inputs, volumeInput)
+	if err != nil {
+		return []VolumeSpec{}, nil
+	}
+	specs, err := parseVolumes(com, pair.Value)
+	if err != nil {
+		return nil, err
+	}
+	roots := hostPathRoots()
+	for i, spec := range specs {
+		switch {
+		case !spec.Named():
+			if !underRoot(spec.Source, roots) {
+				return nil, fmt.Errorf("component %s : host path %s is not allowed", com.Name, spec.Source)
+			}
+		case spec.Source != volumeName(com, spec.Target) && assemblyId != "":
+			specs[i].Source = assemblyId + "_" + spec.Source
+		}
+	}
+	return specs, nil
+}
+
+/*
+* ContainerVolumes returns the volumes the container of the component
+* was created with, as recorded in its outputs.
+ */
+func ContainerVolumes(com *global.Component) ([]VolumeSpec, error) {
+	pair, err := global.ParseKeyValuePair(com.Outputs, volumeInput)
+	if err != nil || pair.Value == "" {
+		return []VolumeSpec{}, nil
+	}
+	return parseVolumes(com, pair.Value)
+}
+
+/*
+* docker:volume_host_paths in the conf file, the directories components
+* may mount host paths from. None when missing.
+ */
+func hostPathRoots() []string {
+	roots, err := config.GetList("docker:volume_host_paths")
+	if err != nil {
+		return []string{}
+	}
+	return roots
+}
+
+func underRoot(source string, roots []string) bool {
+	source = path.Clean(source)
+	for _, root := range roots {
+		if !path.IsAbs(root) {
+			continue
+		}
+		root = path.Clean(root)
+		if source == root || strings.HasPrefix(source, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func parseVolumes(com *global.Component, value string) ([]VolumeSpec, error) {
+	specs := []VolumeSpec{}
+	targets := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		spec, err := parseVolume(com, entry)
+		if err != nil {
+			return nil, fmt.Errorf("component %s : %s", com.Name, err)
+		}
+		if targets[spec.Target] {
+			return nil, fmt.Errorf("component %s : %s is mounted twice", com.Name, spec.Target)
+		}
+		targets[spec.Target] = true
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func parseVolume(com *global.Component, entry string) (VolumeSpec, error) {
+	spec := VolumeSpec{}
+	parts := strings.Split(entry, ":")
+	if n := len(parts); n > 1 && (parts[n-1] == "ro" || parts[n-1] == "rw") {
+		spec.ReadOnly = parts[n-1] == "ro"
+		parts = parts[:n-1]
+	}
+	switch len(parts) {
+	case 1:
+		spec.Target = parts[0]
+		spec.Source = volumeName(com, parts[0])
+	case 2:
+		spec.Source, spec.Target = parts[0], parts[1]
+	default:
+		return spec, fmt.Errorf("%s is not a volume", entry)
+	}
+	if !path.IsAbs(spec.Target) {
+		return spec, fmt.Errorf("%s is not an absolute path", spec.Target)
+	}
+	if spec.Named() && !validVolumeName(spec.Source) {
+		return spec, fmt.Errorf("%s is not a volume name", spec.Source)
+	}
+	if !spec.Named() {
+		spec.Source = path.Clean(spec.Source)
+	}
+	spec.Target = path.Clean(spec.Target)
+	return spec, nil
+}
+
+/*
+* volumeName names the volume of a target without source after the
+* component, the same on every launch so the data outlives the container.
+ */
+func volumeName(com *global.Component, target string) string {
+	name := com.Id + strings.Replace(path.Clean(target), "/", "_", -1)
+	return strings.Map(func(r rune) rune {
+		if validVolumeRune(r) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func validVolumeName(name string) bool {
+	if name == "" || name[0] == '.' || name[0] == '-' || name[0] == '_' {
+		return false
+	}
+	for _, r := range name {
+		if !validVolumeRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func validVolumeRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.' || r == '-'
+}
+
+func mountPoints(specs []VolumeSpec) map[string]struct{} {
+	mounts := make(map[string]struct{}, len(specs))
+	for _, spec := range specs {
+		mounts[spec.Target] = struct{}{}
+	}
+	return mounts
+}
+
+func volumeBinds(specs []VolumeSpec) []string {
+	binds := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		binds = append(binds, spec.Bind())
+	}
+	return binds
+}
+
+/*
+* volumesOutput records the volumes in the component outputs, the way
+* they are declared.
+ */
+func volumesOutput(specs []VolumeSpec) string {
+	return strings.Join(volumeBinds(specs), ",")
+}
+
+/*
+* docker:volume_driver in the conf file, local when missing.
+ */
+func volumeDriver() string {
+	if driver, err := config.GetString("docker:volume_driver"); err == nil && driver != "" {
+		return driver
+	}
+	return "local"
+}
+
+/*
+* createVolumes creates the named volumes of the component before its
+* container. A volume that exists is kept with its data.
+ */
+func createVolumes(client *docker.Client, com *global.Component, specs []VolumeSpec) error {
+	driver := volumeDriver()
+	opts := map[string]string{}
+	if pair, err := global.ParseKeyValuePair(com.Inputs, diskSizeInput); err == nil && pair.Value != "" {
+		if driver == "local" {
+			log.Warn("the local volume driver has no size, disk_size %s of %s is ignored", pair.Value, com.Name)
+		} else {
+			opts["size"] = pair.Value
+		}
+	}
+	for _, spec := range specs {
+		if !spec.Named() {
+			continue
+		}
+		if _, err := client.CreateVolume(docker.CreateVolumeOptions{Name: spec.Source, Driver: driver, DriverOpts: opts}); err != nil {
+			log.Error("Failed to create the volume %s : %s", spec.Source, err)
+			return err
+		}
+		log.Info("volume %s of %s is ready", spec.Source, com.Name)
+	}
+	return nil
+}
+
+/*
+* volumeRetention is retain or destroy, the volume_retention input of the
+* component or docker:volume_retention in the conf file. Volumes are
+* retained unless told otherwise.
+ */
+func volumeRetention(com *global.Component) string {
+	retention := ""
+	if pair, err := global.ParseKeyValuePair(com.Inputs, retentionInput); err == nil {
+		retention = pair.Value
+	} else {
+		retention, _ = config.GetString("docker:volume_retention")
+	}
+	if strings.ToLower(strings.TrimSpace(retention)) == DESTROY {
+		return DESTROY
+	}
+	return RETAIN
+}
+
+/*
+* destroyVolumes removes the named volumes recorded in the component
+* outputs. Host paths are never touched, nor are the volumes a container
+* of another component still mounts.
+ */
+func destroyVolumes(client *docker.Client, com *global.Component) error {
+	specs, perr := ContainerVolumes(com)
+	if perr != nil {
+		return perr
+	}
+	var derr error
+	for _, spec := range specs {
+		if !spec.Named() {
+			continue
+		}
+		users, lerr := client.ListContainers(docker.ListContainersOptions{All: true, Filters: map[string][]string{"volume": {spec.Source}}})
+		if lerr != nil {
+			log.Error("Failed to list the containers of the volume %s : %s", spec.Source, lerr)
+			if derr == nil {
+				derr = lerr
+			}
+			continue
+		}
+		if len(users) > 0 {
+			log.Info("volume %s of %s is kept, %d other containers mount it", spec.Source, com.Name, len(users))
+			continue
+		}
+		err := client.RemoveVolume(spec.Source)
+		if err == docker.ErrVolumeInUse {
+			log.Info("volume %s of %s is kept, it is in use", spec.Source, com.Name)
+			continue
+		}
+		if err != nil && err != docker.ErrNoSuchVolume {
+			log.Error("Failed to remove the volume %s : %s", spec.Source, err)
+			if derr == nil {
+				derr = err
+			}
+			continue
+		}
+		log.Info("volume %s of %s is destroyed", spec.Source, com.Name)
+	}
+	return derr
+}
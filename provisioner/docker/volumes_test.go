@@ -0,0 +1,101 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package docker
+
+import (
+	"github.com/megamsys/megamd/global"
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestComponentVolumes(c *check.C) {
+	config.Set("docker:volume_host_paths", []interface{}{"/srv"})
+	defer config.Unset("docker:volume_host_paths")
+	com := &global.Component{Id: "COM42", Name: "pg", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair("volumes", "pgdata:/var/lib/postgresql, /srv/conf:/etc/pg:ro,/var/log/pg/"),
+	}}
+	specs, err := ComponentVolumes("ASM1", com)
+	c.Assert(err, check.IsNil)
+	c.Assert(specs, check.DeepEquals, []VolumeSpec{
+		{Source: "ASM1_pgdata", Target: "/var/lib/postgresql"},
+		{Source: "/srv/conf", Target: "/etc/pg", ReadOnly: true},
+		{Source: "COM42_var_log_pg", Target: "/var/log/pg"},
+	})
+	c.Assert(specs[1].Named(), check.Equals, false)
+	c.Assert(volumeBinds(specs), check.DeepEquals, []string{
+		"ASM1_pgdata:/var/lib/postgresql", "/srv/conf:/etc/pg:ro", "COM42_var_log_pg:/var/log/pg",
+	})
+	c.Assert(mountPoints(specs), check.HasLen, 3)
+
+	// the recorded output parses back to the same volumes.
+	com.Outputs = []*global.KeyValuePair{global.GetKeyValuePair("volumes", volumesOutput(specs))}
+	again, err := ContainerVolumes(com)
+	c.Assert(err, check.IsNil)
+	c.Assert(again, check.DeepEquals, specs)
+}
+
+func (s *S) TestComponentVolumesHostPaths(c *check.C) {
+	com := &global.Component{Name: "pg", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair("volumes", "/srv/conf:/etc/pg"),
+	}}
+	_, err := ComponentVolumes("ASM1", com)
+	c.Assert(err, check.ErrorMatches, "component pg : host path /srv/conf is not allowed")
+
+	config.Set("docker:volume_host_paths", []interface{}{"/srv/megam"})
+	defer config.Unset("docker:volume_host_paths")
+	_, err = ComponentVolumes("ASM1", com)
+	c.Assert(err, check.NotNil)
+
+	com.Inputs[0].Value = "/srv/megam/../../etc:/etc/pg"
+	_, err = ComponentVolumes("ASM1", com)
+	c.Assert(err, check.ErrorMatches, "component pg : host path /etc is not allowed")
+
+	com.Inputs[0].Value = "/srv/megamx:/etc/pg"
+	_, err = ComponentVolumes("ASM1", com)
+	c.Assert(err, check.NotNil)
+
+	com.Inputs[0].Value = "/srv/megam/pg:/etc/pg"
+	_, err = ComponentVolumes("ASM1", com)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestComponentVolumesInvalid(c *check.C) {
+	com := &global.Component{Name: "pg", Inputs: []*global.KeyValuePair{
+		global.GetKeyValuePair("volumes", "data:relative"),
+	}}
+	_, err := ComponentVolumes("ASM1", com)
+	c.Assert(err, check.ErrorMatches, "component pg : relative is not an absolute path")
+
+	com.Inputs[0].Value = "my data:/data"
+	_, err = ComponentVolumes("ASM1", com)
+	c.Assert(err, check.ErrorMatches, "component pg : my data is not a volume name")
+
+	com.Inputs[0].Value = "a:/data,b:/data"
+	_, err = ComponentVolumes("ASM1", com)
+	c.Assert(err, check.ErrorMatches, "component pg : /data is mounted twice")
+}
+
+func (s *S) TestVolumeRetention(c *check.C) {
+	com := &global.Component{Name: "pg"}
+	c.Assert(volumeRetention(com), check.Equals, RETAIN)
+
+	config.Set("docker:volume_retention", "destroy")
+	defer config.Unset("docker:volume_retention")
+	c.Assert(volumeRetention(com), check.Equals, DESTROY)
+
+	com.Inputs = []*global.KeyValuePair{global.GetKeyValuePair("volume_retention", "retain")}
+	c.Assert(volumeRetention(com), check.Equals, RETAIN)
+}
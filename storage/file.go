@@ -0,0 +1,265 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/megamsys/libgo/db"
+	"github.com/tsuru/config"
+)
+
+const defaultFileName = "megamd.db"
+
+/*
+ * fileRepository keeps every bucket in a single json file, for dev, edge
+ * and test setups without a riak cluster. Each write rewrites the file
+ * through a temp file and a rename, so a crash never leaves it half written.
+ * The daemon and the cli share the file, so every call locks it and reads
+ * it again before looking at the buckets.
+ */
+type fileRepository struct {
+	mu      sync.Mutex
+	path    string
+	buckets map[string]map[string]json.RawMessage
+}
+
+/*
+ * the file is storage:path, or megamd.db under megam_home.
+ */
+func newFileRepository() (Repository, error) {
+	path, err := config.GetString("storage:path")
+	if err != nil || path == "" {
+		home, herr := config.GetString("megam_home")
+		if herr != nil {
+			return nil, herr
+		}
+		path = filepath.Join(home, defaultFileName)
+	}
+	return OpenFile(path)
+}
+
+/*
+ * OpenFile loads the repository kept in the file, creating it if needed.
+ */
+func OpenFile(path string) (Repository, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	r := &fileRepository{path: path}
+	err := r.locked(func() error {
+		if _, serr := os.Stat(path); os.IsNotExist(serr) {
+			return r.save()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/*
+ * locked runs fn holding the lock file next to the repository, with the
+ * buckets as the file has them now. The lock is the one every process
+ * opening the file takes, fn sees the writes of the others.
+ */
+func (r *fileRepository) locked(fn func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lock, err := os.OpenFile(r.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	if err := r.load(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func (r *fileRepository) load() error {
+	r.buckets = make(map[string]map[string]json.RawMessage)
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &r.buckets); err != nil {
+			return fmt.Errorf("%s is not a megamd storage file: %s", r.path, err)
+		}
+	}
+	return nil
+}
+
+func (r *fileRepository) fetch(bucket string, key string) (json.RawMessage, error) {
+	raw, ok := r.buckets[bucket][key]
+	if !ok {
+		return nil, &NotFoundError{Bucket: bucket, Key: key}
+	}
+	return raw, nil
+}
+
+func (r *fileRepository) store(bucket string, key string, raw json.RawMessage) error {
+	b, ok := r.buckets[bucket]
+	if !ok {
+		b = make(map[string]json.RawMessage)
+		r.buckets[bucket] = b
+	}
+	b[key] = raw
+	return r.save()
+}
+
+func (r *fileRepository) save() error {
+	data, err := json.Marshal(r.buckets)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+func (r *fileRepository) FetchStruct(bucket string, key string, out interface{}) error {
+	return r.locked(func() error {
+		raw, err := r.fetch(bucket, key)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(raw, out)
+	})
+}
+
+func (r *fileRepository) StoreStruct(bucket string, key string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return r.locked(func() error {
+		return r.store(bucket, key, raw)
+	})
+}
+
+/*
+ * objects are kept as json strings. an ssh file gets the raw content,
+ * anything else is parsed like a struct.
+ */
+func (r *fileRepository) FetchObject(bucket string, key string, out interface{}) error {
+	var data string
+	err := r.locked(func() error {
+		raw, err := r.fetch(bucket, key)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(raw, &data)
+	})
+	if err != nil {
+		return err
+	}
+	switch o := out.(type) {
+	case *db.SshObject:
+		o.Data = data
+		return nil
+	case *string:
+		*o = data
+		return nil
+	}
+	return json.Unmarshal([]byte(data), out)
+}
+
+func (r *fileRepository) StoreObject(bucket string, key string, data string) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return r.locked(func() error {
+		return r.store(bucket, key, raw)
+	})
+}
+
+func (r *fileRepository) FetchRevision(bucket string, key string, out interface{}) (Version, error) {
+	var read Version
+	err := r.locked(func() error {
+		raw, err := r.fetch(bucket, key)
+		if err != nil {
+			return err
+		}
+		read = versionOf(raw)
+		return json.Unmarshal(raw, out)
+	})
+	return read, err
+}
+
+func (r *fileRepository) StoreRevision(bucket string, key string, data interface{}, read Version) (Version, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Version{}, err
+	}
+
+	err = r.locked(func() error {
+		current := Version{}
+		if old, ferr := r.fetch(bucket, key); ferr == nil {
+			current = versionOf(old)
+		}
+		if current != read {
+			return ErrConflict
+		}
+		return r.store(bucket, key, raw)
+	})
+	if err != nil {
+		return Version{}, err
+	}
+	return versionOf(raw), nil
+}
+
+// the version of a record in the file is the digest of its json.
+func versionOf(raw []byte) Version {
+	return Version{tag: fmt.Sprintf("%x", sha1.Sum(raw))}
+}
+
+func (r *fileRepository) Delete(bucket string, key string) error {
+	return r.locked(func() error {
+		if _, ok := r.buckets[bucket][key]; !ok {
+			return nil
+		}
+		delete(r.buckets[bucket], key)
+		return r.save()
+	})
+}
+
+func (r *fileRepository) Ping() error {
+	return r.locked(r.save)
+}
@@ -0,0 +1,152 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/megamsys/libgo/db"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+type record struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+}
+
+func (s *S) TestFileStructRoundTrip(c *check.C) {
+	path := filepath.Join(c.MkDir(), "megamd.db")
+	repo, err := OpenFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.StoreStruct("assembly", "ASM1", &record{Id: "ASM1", Status: "LAUNCHING"}), check.IsNil)
+
+	out := &record{}
+	c.Assert(repo.FetchStruct("assembly", "ASM1", out), check.IsNil)
+	c.Assert(out.Status, check.Equals, "LAUNCHING")
+}
+
+func (s *S) TestFileSurvivesReopen(c *check.C) {
+	path := filepath.Join(c.MkDir(), "megamd.db")
+	repo, _ := OpenFile(path)
+	repo.StoreStruct("components", "COM1", &record{Id: "COM1"})
+
+	reopened, err := OpenFile(path)
+	c.Assert(err, check.IsNil)
+	out := &record{}
+	c.Assert(reopened.FetchStruct("components", "COM1", out), check.IsNil)
+	c.Assert(out.Id, check.Equals, "COM1")
+}
+
+func (s *S) TestFileSharedByTwoProcesses(c *check.C) {
+	path := filepath.Join(c.MkDir(), "megamd.db")
+	daemon, _ := OpenFile(path)
+	cli, _ := OpenFile(path)
+	c.Assert(daemon.StoreStruct("jobs", "JOB1", &record{Id: "JOB1"}), check.IsNil)
+	c.Assert(cli.StoreStruct("deadletters", "DL1", &record{Id: "DL1"}), check.IsNil)
+	c.Assert(daemon.StoreStruct("jobs", "JOB2", &record{Id: "JOB2"}), check.IsNil)
+
+	out := &record{}
+	c.Assert(cli.FetchStruct("jobs", "JOB2", out), check.IsNil)
+	c.Assert(daemon.FetchStruct("deadletters", "DL1", out), check.IsNil)
+	c.Assert(out.Id, check.Equals, "DL1")
+
+	_, err := cli.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 1}, Version{})
+	c.Assert(err, check.IsNil)
+	_, err = daemon.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 1}, Version{})
+	c.Assert(err, check.Equals, ErrConflict)
+}
+
+func (s *S) TestFileDelete(c *check.C) {
+	repo, _ := OpenFile(filepath.Join(c.MkDir(), "megamd.db"))
+	c.Assert(repo.StoreStruct("components", "COM1", &record{Id: "COM1"}), check.IsNil)
+	c.Assert(repo.Delete("components", "COM1"), check.IsNil)
+	err := repo.FetchStruct("components", "COM1", &record{})
+	c.Assert(IsNotFound(err), check.Equals, true)
+	c.Assert(repo.Delete("components", "COM1"), check.IsNil)
+}
+
+func (s *S) TestFileFetchMissing(c *check.C) {
+	repo, _ := OpenFile(filepath.Join(c.MkDir(), "megamd.db"))
+	err := repo.FetchStruct("requests", "RIP1", &record{})
+	c.Assert(IsNotFound(err), check.Equals, true)
+}
+
+func (s *S) TestFileObjects(c *check.C) {
+	repo, _ := OpenFile(filepath.Join(c.MkDir(), "megamd.db"))
+	c.Assert(repo.StoreObject("sshfiles", "a@b.com_key_key", "-----BEGIN RSA"), check.IsNil)
+
+	ssh := &db.SshObject{}
+	c.Assert(repo.FetchObject("sshfiles", "a@b.com_key_key", ssh), check.IsNil)
+	c.Assert(ssh.Data, check.Equals, "-----BEGIN RSA")
+
+	repo.StoreObject("ipindex", "ipgen", `{"id":"ipgen","status":"ok"}`)
+	out := &record{}
+	c.Assert(repo.FetchObject("ipindex", "ipgen", out), check.IsNil)
+	c.Assert(out.Status, check.Equals, "ok")
+}
+
+func (s *S) TestGetRepositoryUnknown(c *check.C) {
+	_, err := GetRepository("mongo")
+	c.Assert(err, check.NotNil)
+}
+
+type versioned struct {
+	Id       string `json:"id"`
+	Revision int    `json:"revision"`
+	Name     string `json:"name,omitempty"`
+}
+
+func (s *S) TestFileStoreRevision(c *check.C) {
+	repo, _ := OpenFile(filepath.Join(c.MkDir(), "megamd.db"))
+	first, err := repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 1}, Version{})
+	c.Assert(err, check.IsNil)
+	_, err = repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 2}, first)
+	c.Assert(err, check.IsNil)
+
+	_, err = repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 2}, first)
+	c.Assert(err, check.Equals, ErrConflict)
+	out := &versioned{}
+	read, err := repo.FetchRevision("components", "COM1", out)
+	c.Assert(err, check.IsNil)
+	c.Assert(out.Revision, check.Equals, 2)
+
+	// a write that leaves the revision as it was is a change all the same.
+	repo.StoreStruct("components", "COM1", &versioned{Id: "COM1", Revision: 2, Name: "api"})
+	_, err = repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 3}, read)
+	c.Assert(err, check.Equals, ErrConflict)
+}
+
+func (s *S) TestRetryOnConflict(c *check.C) {
+	calls := 0
+	err := RetryOnConflict(func() error {
+		calls++
+		if calls < 3 {
+			return ErrConflict
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(calls, check.Equals, 3)
+}
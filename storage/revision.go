@@ -0,0 +1,73 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	conflictRetries = 5
+	conflictWait    = 50 * time.Millisecond
+)
+
+/*
+ * ErrConflict is returned by StoreRevision when the record was stored by
+ * someone else since it was read.
+ */
+var ErrConflict = errors.New("the record was changed since it was read")
+
+/*
+ * Version is what a read saw of a record: the etag and vclock riak
+ * answered, the digest of the json for the file backend. The zero
+ * Version is a record nothing was stored under yet.
+ */
+type Version struct {
+	tag    string
+	vclock string
+}
+
+func FetchRevision(bucket string, key string, out interface{}) (Version, error) {
+	repo, err := Get()
+	if err != nil {
+		return Version{}, err
+	}
+	return repo.FetchRevision(bucket, key, out)
+}
+
+func StoreRevision(bucket string, key string, data interface{}, read Version) (Version, error) {
+	repo, err := Get()
+	if err != nil {
+		return Version{}, err
+	}
+	return repo.StoreRevision(bucket, key, data, read)
+}
+
+/*
+ * RetryOnConflict runs the read-modify-write in fn again, with a fresh
+ * read, for as long as it ends in ErrConflict, at most a few times.
+ */
+func RetryOnConflict(fn func() error) error {
+	var err error
+	for i := 0; i < conflictRetries; i++ {
+		if err = fn(); err != ErrConflict {
+			return err
+		}
+		time.Sleep(time.Duration(i+1) * conflictWait)
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/megamsys/libgo/db"
+	"github.com/tsuru/config"
+)
+
+// the http port of riak, when riak:http isn't set.
+const defaultHTTPPort = "8098"
+
+// what riakpbc answers for a key nothing is stored under.
+const riakNotFound = "object not found"
+
+/*
+ * riakRepository opens a libgo connection to the bucket for each call,
+ * riak:url in the conf file tells where.
+ */
+type riakRepository struct{}
+
+func (r *riakRepository) FetchStruct(bucket string, key string, out interface{}) error {
+	conn, err := db.Conn(bucket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.FetchStruct(key, out); err != nil {
+		if err.Error() == riakNotFound {
+			return &NotFoundError{Bucket: bucket, Key: key}
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *riakRepository) StoreStruct(bucket string, key string, data interface{}) error {
+	conn, err := db.Conn(bucket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.StoreStruct(key, data)
+}
+
+func (r *riakRepository) FetchObject(bucket string, key string, out interface{}) error {
+	conn, err := db.Conn(bucket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.FetchObject(key, out)
+}
+
+func (r *riakRepository) StoreObject(bucket string, key string, data string) error {
+	conn, err := db.Conn(bucket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.StoreObject(key, data)
+}
+
+/*
+ * libgo doesn't hand out the vector clocks, so the records stored by
+ * revision are read and written through the http interface of riak. The
+ * read keeps the etag and vclock riak answered, and the write is
+ * conditional on riak still having that version (If-Match), or none
+ * (If-None-Match). The api or another megamd storing it after the read
+ * makes riak refuse the write.
+ */
+func (r *riakRepository) FetchRevision(bucket string, key string, out interface{}) (Version, error) {
+	target, err := riakHTTP(bucket, key)
+	if err != nil {
+		return Version{}, err
+	}
+	res, err := http.Get(target)
+	if err != nil {
+		return Version{}, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return Version{}, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return Version{}, &NotFoundError{Bucket: bucket, Key: key}
+	case http.StatusMultipleChoices:
+		// siblings, written concurrently by clients that don't check.
+		return Version{}, ErrConflict
+	default:
+		return Version{}, fmt.Errorf("riak answered %s for %s/%s", res.Status, bucket, key)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return Version{}, err
+	}
+	return riakVersion(res), nil
+}
+
+func (r *riakRepository) StoreRevision(bucket string, key string, data interface{}, read Version) (Version, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Version{}, err
+	}
+	target, err := riakHTTP(bucket, key)
+	if err != nil {
+		return Version{}, err
+	}
+
+	// the body comes back with the etag and vclock of what was stored.
+	req, err := http.NewRequest("PUT", target+"?returnbody=true", bytes.NewReader(raw))
+	if err != nil {
+		return Version{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if read.tag == "" {
+		req.Header.Set("If-None-Match", "*")
+	} else {
+		req.Header.Set("If-Match", read.tag)
+		req.Header.Set("X-Riak-Vclock", read.vclock)
+	}
+
+	put, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Version{}, err
+	}
+	ioutil.ReadAll(put.Body)
+	put.Body.Close()
+	switch put.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusCreated:
+		return riakVersion(put), nil
+	case http.StatusPreconditionFailed:
+		return Version{}, ErrConflict
+	}
+	return Version{}, fmt.Errorf("riak answered %s storing %s/%s", put.Status, bucket, key)
+}
+
+func riakVersion(res *http.Response) Version {
+	return Version{tag: res.Header.Get("ETag"), vclock: res.Header.Get("X-Riak-Vclock")}
+}
+
+/*
+ * Delete goes through the http interface of riak too, libgo has no
+ * delete.
+ */
+func (r *riakRepository) Delete(bucket string, key string) error {
+	target, err := riakHTTP(bucket, key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", target, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("riak answered %s deleting %s/%s", res.Status, bucket, key)
+}
+
+/*
+ * riakHTTP is the url of the key on riak:http in the conf file, by
+ * default the host of riak:url on the http port.
+ */
+func riakHTTP(bucket string, key string) (string, error) {
+	addr, err := config.GetString("riak:http")
+	if err != nil || addr == "" {
+		pb, perr := config.GetString("riak:url")
+		if perr != nil {
+			return "", perr
+		}
+		host, _, serr := net.SplitHostPort(strings.TrimSpace(pb))
+		if serr != nil {
+			host = strings.TrimSpace(pb)
+		}
+		addr = net.JoinHostPort(host, defaultHTTPPort)
+	}
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return fmt.Sprintf("%s/buckets/%s/keys/%s", strings.TrimSuffix(addr, "/"), url.QueryEscape(bucket), url.QueryEscape(key)), nil
+}
+
+func (r *riakRepository) Ping() error {
+	return r.StoreObject("connection", "sampleobject", "sampledata")
+}
@@ -0,0 +1,151 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+/*
+* fakeRiak keeps one object per url and honours the conditional headers
+* the way the riak http interface does. meddle runs after every read, as
+* a writer sneaking in between the read and the store.
+ */
+type fakeRiak struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	etags   map[string]int
+	meddle  func(path string)
+}
+
+func (f *fakeRiak) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[r.URL.Path]
+	etag := fmt.Sprintf(`"%d"`, f.etags[r.URL.Path])
+	switch r.Method {
+	case "GET":
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("X-Riak-Vclock", "a85hYGBgzGDKBVIcypz/fgaUHjmTwZTImMfKwDLh")
+		w.Write(obj)
+		if f.meddle != nil {
+			f.meddle(r.URL.Path)
+		}
+	case "PUT":
+		if m := r.Header.Get("If-Match"); m != "" && (!ok || m != etag) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && ok {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+		f.etags[r.URL.Path]++
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, f.etags[r.URL.Path]))
+		w.Write(body)
+	case "DELETE":
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newFakeRiak() (*fakeRiak, *httptest.Server) {
+	f := &fakeRiak{objects: map[string][]byte{}, etags: map[string]int{}}
+	server := httptest.NewServer(f)
+	config.Set("riak:http", server.URL)
+	return f, server
+}
+
+func (s *S) TestRiakStoreRevision(c *check.C) {
+	_, server := newFakeRiak()
+	defer server.Close()
+	repo := &riakRepository{}
+	first, err := repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 1}, Version{})
+	c.Assert(err, check.IsNil)
+	second, err := repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 2}, first)
+	c.Assert(err, check.IsNil)
+	_, err = repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 2}, first)
+	c.Assert(err, check.Equals, ErrConflict)
+	_, err = repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 2}, Version{})
+	c.Assert(err, check.Equals, ErrConflict)
+	_, err = repo.StoreRevision("components", "COM2", &versioned{Id: "COM2", Revision: 4}, second)
+	c.Assert(err, check.Equals, ErrConflict)
+}
+
+func (s *S) TestRiakFetchRevision(c *check.C) {
+	_, server := newFakeRiak()
+	defer server.Close()
+	repo := &riakRepository{}
+	_, err := repo.FetchRevision("components", "COM1", &versioned{})
+	c.Assert(IsNotFound(err), check.Equals, true)
+
+	_, err = repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 1}, Version{})
+	c.Assert(err, check.IsNil)
+	out := &versioned{}
+	read, err := repo.FetchRevision("components", "COM1", out)
+	c.Assert(err, check.IsNil)
+	c.Assert(out.Revision, check.Equals, 1)
+	_, err = repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 2}, read)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestRiakStoreRevisionWrittenInBetween(c *check.C) {
+	f, server := newFakeRiak()
+	defer server.Close()
+	repo := &riakRepository{}
+	_, err := repo.StoreRevision("assembly", "ASM1", &versioned{Id: "ASM1", Revision: 1}, Version{})
+	c.Assert(err, check.IsNil)
+
+	// the api stores the record right after megamd read it, and doesn't
+	// bump the revision.
+	f.meddle = func(path string) {
+		f.objects[path] = []byte(`{"id":"ASM1","revision":1,"name":"api"}`)
+		f.etags[path]++
+	}
+	read, err := repo.FetchRevision("assembly", "ASM1", &versioned{})
+	c.Assert(err, check.IsNil)
+	_, err = repo.StoreRevision("assembly", "ASM1", &versioned{Id: "ASM1", Revision: 2}, read)
+	c.Assert(err, check.Equals, ErrConflict)
+	c.Assert(string(f.objects["/buckets/assembly/keys/ASM1"]), check.Equals, `{"id":"ASM1","revision":1,"name":"api"}`)
+}
+
+func (s *S) TestRiakDelete(c *check.C) {
+	f, server := newFakeRiak()
+	defer server.Close()
+	repo := &riakRepository{}
+	_, err := repo.StoreRevision("components", "COM1", &versioned{Id: "COM1", Revision: 1}, Version{})
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.Delete("components", "COM1"), check.IsNil)
+	c.Assert(f.objects, check.HasLen, 0)
+	c.Assert(repo.Delete("components", "COM1"), check.IsNil)
+}
@@ -0,0 +1,167 @@
+/*
+** Copyright [2013-2015] [Megam Systems]
+**
+** Licensed under the Apache License, Version 2.0 (the "License");
+** you may not use this file except in compliance with the License.
+** You may obtain a copy of the License at
+**
+** http://www.apache.org/licenses/LICENSE-2.0
+**
+** Unless required by applicable law or agreed to in writing, software
+** distributed under the License is distributed on an "AS IS" BASIS,
+** WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+** See the License for the specific language governing permissions and
+** limitations under the License.
+ */
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tsuru/config"
+)
+
+/*
+ * Repository is where megamd keeps requests, assemblies, components,
+ * jobs and ip indexes. Every record lives under a key of a bucket.
+ */
+type Repository interface {
+	// FetchStruct parses the json stored under the key into out.
+	FetchStruct(bucket string, key string, out interface{}) error
+
+	// StoreStruct stores data as json under the key.
+	StoreStruct(bucket string, key string, data interface{}) error
+
+	// FetchObject reads a raw object, like the ssh files, into out.
+	FetchObject(bucket string, key string, out interface{}) error
+
+	// StoreObject stores the raw data under the key.
+	StoreObject(bucket string, key string, data string) error
+
+	// FetchRevision parses the json stored under the key into out, and
+	// returns the version of the record it read.
+	FetchRevision(bucket string, key string, out interface{}) (Version, error)
+
+	// StoreRevision stores data as json under the key, only when the
+	// stored record is still the version read, ErrConflict otherwise. It
+	// returns the version stored.
+	StoreRevision(bucket string, key string, data interface{}, read Version) (Version, error)
+
+	// Delete removes what is stored under the key, nothing stored is no
+	// error.
+	Delete(bucket string, key string) error
+
+	// Ping verifies the repository can be read and written.
+	Ping() error
+}
+
+const defaultBackend = "riak"
+
+/*
+ * NotFoundError is returned when nothing is stored under the key.
+ */
+type NotFoundError struct {
+	Bucket string
+	Key    string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s/%s not found", e.Bucket, e.Key)
+}
+
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+var (
+	backendsMu sync.Mutex
+	backends   = make(map[string]func() (Repository, error))
+	opened     = make(map[string]Repository)
+)
+
+func init() {
+	Register("riak", func() (Repository, error) { return &riakRepository{}, nil })
+	Register("file", newFileRepository)
+}
+
+/*
+ * Register registers a repository backend, opened the first time it is used.
+ */
+func Register(name string, open func() (Repository, error)) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[name] = open
+}
+
+func GetRepository(name string) (Repository, error) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if repo, ok := opened[name]; ok {
+		return repo, nil
+	}
+	open, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("Storage backend %s not registered", name)
+	}
+	repo, err := open()
+	if err != nil {
+		return nil, err
+	}
+	opened[name] = repo
+	return repo, nil
+}
+
+/*
+ * Get returns the repository named by storage:backend in the conf file,
+ * riak when it isn't set.
+ */
+func Get() (Repository, error) {
+	name, err := config.GetString("storage:backend")
+	if err != nil || name == "" {
+		name = defaultBackend
+	}
+	return GetRepository(name)
+}
+
+func FetchStruct(bucket string, key string, out interface{}) error {
+	repo, err := Get()
+	if err != nil {
+		return err
+	}
+	return repo.FetchStruct(bucket, key, out)
+}
+
+func StoreStruct(bucket string, key string, data interface{}) error {
+	repo, err := Get()
+	if err != nil {
+		return err
+	}
+	return repo.StoreStruct(bucket, key, data)
+}
+
+func FetchObject(bucket string, key string, out interface{}) error {
+	repo, err := Get()
+	if err != nil {
+		return err
+	}
+	return repo.FetchObject(bucket, key, out)
+}
+
+func StoreObject(bucket string, key string, data string) error {
+	repo, err := Get()
+	if err != nil {
+		return err
+	}
+	return repo.StoreObject(bucket, key, data)
+}
+
+func Delete(bucket string, key string) error {
+	repo, err := Get()
+	if err != nil {
+		return err
+	}
+	return repo.Delete(bucket, key)
+}